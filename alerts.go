@@ -0,0 +1,297 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"math"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	// AlertTemperature compares the temperature in °F
+	AlertTemperature = "temperature"
+	// AlertGravity compares the specific gravity
+	AlertGravity = "gravity"
+	// AlertBattery compares the battery level
+	AlertBattery = "battery"
+	// AlertPower compares the signal strength in dBm
+	AlertPower = "power"
+	// AlertAge compares the seconds since the device last reported a metric
+	AlertAge = "age"
+
+	// AlertPending is an alert whose condition has not yet held for the
+	// rule's duration
+	AlertPending = "pending"
+	// AlertFiring is an alert whose condition has held for the duration
+	AlertFiring = "firing"
+	// AlertResolved is a fired alert whose condition has cleared
+	AlertResolved = "resolved"
+)
+
+// AlertRule fires an alert for a device once its metric has compared true
+// against the threshold for the duration. A firing alert only resolves once
+// the metric is back past the threshold by the hysteresis, so readings
+// hovering around the threshold don't flap.
+type AlertRule struct {
+	ID         int     `json:"id" db:"id"`
+	Name       string  `json:"name" db:"name"`
+	Metric     string  `json:"metric" db:"metric"`
+	Comparator string  `json:"comparator" db:"comparator"`
+	Threshold  float64 `json:"threshold" db:"threshold"`
+	Hysteresis float64 `json:"hysteresis" db:"hysteresis"`
+	// Duration is in seconds
+	Duration int `json:"duration" db:"duration"`
+	// DeviceID limits the rule to one device, and BatchID to the device of
+	// an active batch. Rules without either apply to every device.
+	DeviceID string    `json:"device_id" db:"device_id"`
+	BatchID  int       `json:"batch_id" db:"batch_id"`
+	Disabled bool      `json:"disabled" db:"disabled"`
+	Created  time.Time `json:"created" db:"created"`
+	Updated  time.Time `json:"updated" db:"updated"`
+}
+
+// Alert is a rule's condition holding for a device
+type Alert struct {
+	ID       int        `json:"id" db:"id"`
+	RuleID   int        `json:"rule_id" db:"rule_id"`
+	DeviceID string     `json:"device_id" db:"device_id"`
+	State    string     `json:"state" db:"state"`
+	Value    float64    `json:"value" db:"value"`
+	Started  time.Time  `json:"started" db:"started"`
+	Fired    *time.Time `json:"fired" db:"fired"`
+	Resolved *time.Time `json:"resolved" db:"resolved"`
+	Updated  time.Time  `json:"updated" db:"updated"`
+}
+
+// AlertEvent is published with each alert that fires or resolves
+type AlertEvent struct {
+	Alert
+	Rule AlertRule `json:"rule"`
+}
+
+// Validate checks the rule can be evaluated
+func (r AlertRule) Validate() error {
+	if r.Name == "" {
+		return fmt.Errorf("Alert rule name is required")
+	}
+	switch r.Metric {
+	case AlertTemperature, AlertGravity, AlertBattery, AlertPower, AlertAge:
+	default:
+		return fmt.Errorf("Unknown alert metric: %s", r.Metric)
+	}
+	switch r.Comparator {
+	case ">", ">=", "<", "<=":
+	default:
+		return fmt.Errorf("Unknown alert comparator: %s", r.Comparator)
+	}
+	if r.Hysteresis < 0 || r.Duration < 0 {
+		return fmt.Errorf("Alert hysteresis and duration can't be negative")
+	}
+	return nil
+}
+
+// Breached reports whether the value compares true against the threshold
+func (r AlertRule) Breached(value float64) bool {
+	return r.compare(value, r.Threshold)
+}
+
+// Recovered reports whether the value is back past the threshold by the
+// hysteresis
+func (r AlertRule) Recovered(value float64) bool {
+	switch r.Comparator {
+	case ">", ">=":
+		return !r.compare(value, r.Threshold-r.Hysteresis)
+	default:
+		return !r.compare(value, r.Threshold+r.Hysteresis)
+	}
+}
+
+func (r AlertRule) compare(value float64, threshold float64) bool {
+	switch r.Comparator {
+	case ">":
+		return value > threshold
+	case ">=":
+		return value >= threshold
+	case "<":
+		return value < threshold
+	case "<=":
+		return value <= threshold
+	}
+	return false
+}
+
+// Value returns the rule's metric for the device's latest reading
+func (r AlertRule) Value(metric Metric, now time.Time) float64 {
+	switch r.Metric {
+	case AlertTemperature:
+		return metric.Temperature
+	case AlertGravity:
+		return metric.Gravity
+	case AlertBattery:
+		return float64(metric.Battery)
+	case AlertPower:
+		return float64(metric.Power)
+	case AlertAge:
+		return math.Floor(now.Sub(metric.Created).Seconds())
+	}
+	return 0
+}
+
+// AlertEngine evaluates the alert rules against each metric as it is stored,
+// and against every device's latest metric on a timer so stale devices and
+// rule durations are noticed without new readings
+type AlertEngine struct {
+	datastore Datastore
+	events    *EventBus
+	interval  time.Duration
+}
+
+// NewAlertEngine returns an engine also evaluating every interval
+func NewAlertEngine(datastore Datastore, events *EventBus, interval time.Duration) *AlertEngine {
+	return &AlertEngine{datastore: datastore, events: events, interval: interval}
+}
+
+// Run evaluates rules until the events subscription is closed
+func (e *AlertEngine) Run() {
+	metrics := e.events.SubscribeReliable(NewEventFilter("", EventMetric))
+	ticker := time.NewTicker(e.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case event, ok := <-metrics:
+			if !ok {
+				return
+			}
+			if err := e.Evaluate(event.DeviceID, event.Data.(Metric), time.Now()); err != nil {
+				log.Errorf("[alerts] Error evaluating rules for %s: %s", event.DeviceID, err)
+			}
+		case now := <-ticker.C:
+			if err := e.EvaluateAll(now); err != nil {
+				log.Errorf("[alerts] Error loading devices: %s", err)
+			}
+		}
+	}
+}
+
+// EvaluateAll moves the alerts of every enabled device on for its latest
+// metric. Devices that have never reported are as old as the device itself,
+// and only have their age rules evaluated.
+func (e *AlertEngine) EvaluateAll(now time.Time) error {
+	devices, err := e.datastore.GetDevices()
+	if err != nil {
+		return err
+	}
+	for _, device := range devices {
+		if device.Disabled {
+			continue
+		}
+		metric, err := e.datastore.GetDeviceLatestMetrics(device.ID)
+		reported := err == nil
+		if err == sql.ErrNoRows {
+			metric = Metric{DeviceID: device.ID, Created: device.Created}
+		} else if err != nil {
+			log.Errorf("[alerts] Error loading latest metric of %s: %s", device.ID, err)
+			continue
+		}
+		if err := e.evaluate(device.ID, metric, reported, now); err != nil {
+			log.Errorf("[alerts] Error evaluating rules for %s: %s", device.ID, err)
+		}
+	}
+	return nil
+}
+
+// Evaluate moves the device's alerts on for its latest metric
+func (e *AlertEngine) Evaluate(deviceID string, metric Metric, now time.Time) error {
+	return e.evaluate(deviceID, metric, true, now)
+}
+
+func (e *AlertEngine) evaluate(deviceID string, metric Metric, reported bool, now time.Time) error {
+	rules, err := e.datastore.GetAlertRules()
+	if err != nil {
+		return err
+	}
+
+	for _, rule := range rules {
+		if !reported && rule.Metric != AlertAge {
+			continue
+		}
+		applies, err := e.applies(rule, deviceID)
+		if err != nil {
+			return err
+		}
+		if !applies {
+			continue
+		}
+		if err := e.evaluateRule(rule, deviceID, rule.Value(metric, now), now); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (e *AlertEngine) applies(rule AlertRule, deviceID string) (bool, error) {
+	if rule.Disabled || (rule.DeviceID != "" && rule.DeviceID != deviceID) {
+		return false, nil
+	}
+	if rule.BatchID == 0 {
+		return true, nil
+	}
+
+	batch, err := e.datastore.GetBatch(rule.BatchID)
+	if err == sql.ErrNoRows {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return batch.DeviceID == deviceID && batch.Ended == nil, nil
+}
+
+func (e *AlertEngine) evaluateRule(rule AlertRule, deviceID string, value float64, now time.Time) error {
+	alert, err := e.datastore.GetOpenAlert(rule.ID, deviceID)
+	if err == sql.ErrNoRows {
+		if !rule.Breached(value) {
+			return nil
+		}
+		alert = Alert{RuleID: rule.ID, DeviceID: deviceID, State: AlertPending, Started: now}
+	} else if err != nil {
+		return err
+	}
+	alert.Value = value
+	alert.Updated = now
+
+	changed := false
+	switch alert.State {
+	case AlertPending:
+		if !rule.Breached(value) {
+			// Never fired, so there is nothing to resolve
+			return e.datastore.DeleteAlert(alert.ID)
+		}
+		if now.Sub(alert.Started) >= time.Duration(rule.Duration)*time.Second {
+			alert.State = AlertFiring
+			alert.Fired = &now
+			changed = true
+		}
+	case AlertFiring:
+		if rule.Recovered(value) {
+			alert.State = AlertResolved
+			alert.Resolved = &now
+			changed = true
+		}
+	}
+
+	if alert.ID == 0 {
+		alert, err = e.datastore.CreateAlert(alert)
+	} else {
+		err = e.datastore.UpdateAlert(alert)
+	}
+	if err != nil || !changed {
+		return err
+	}
+
+	log.Infof("[alerts] %s %s for %s: %s is %g", rule.Name, alert.State, deviceID, rule.Metric, value)
+	e.events.Publish(EventAlert, deviceID, AlertEvent{alert, rule})
+	return nil
+}
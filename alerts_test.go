@@ -0,0 +1,249 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAlertRuleRecovered(t *testing.T) {
+	tests := []struct {
+		comparator string
+		value      float64
+		breached   bool
+		recovered  bool
+	}{
+		{">", 73, true, false},
+		{">", 72, false, false},
+		{">", 71.5, false, false},
+		{">", 71, false, true},
+		{">=", 72, true, false},
+		{">=", 71, false, false},
+		{">=", 70.9, false, true},
+		{"<", 71, true, false},
+		{"<", 72, false, false},
+		{"<", 73, false, true},
+		{"<=", 72, true, false},
+		{"<=", 73, false, false},
+		{"<=", 73.1, false, true},
+	}
+	for _, test := range tests {
+		rule := AlertRule{Comparator: test.comparator, Threshold: 72, Hysteresis: 1}
+		if got := rule.Breached(test.value); got != test.breached {
+			t.Errorf("%g %s 72 breached %t, want %t", test.value, test.comparator, got, test.breached)
+		}
+		if got := rule.Recovered(test.value); got != test.recovered {
+			t.Errorf("%g %s 72 recovered %t, want %t", test.value, test.comparator, got, test.recovered)
+		}
+	}
+}
+
+// alertTest drives an alert engine over a test datastore, collecting the
+// alert events it publishes by device
+type alertTest struct {
+	t         *testing.T
+	d         Datastore
+	engine    *AlertEngine
+	events    chan Event
+	published map[string][]AlertEvent
+}
+
+func newAlertTest(t *testing.T, devices ...string) *alertTest {
+	d := newTestDatastore(t)
+	for _, id := range devices {
+		if err := d.CreateOrUpdateDevice(Device{ID: id, Color: "red"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	events := NewEventBus()
+	alerts := events.Subscribe(NewEventFilter("", EventAlert))
+	t.Cleanup(func() { events.Unsubscribe(alerts) })
+	return &alertTest{t: t, d: d, engine: NewAlertEngine(d, events, time.Minute), events: alerts, published: map[string][]AlertEvent{}}
+}
+
+func (a *alertTest) rule(rule AlertRule) AlertRule {
+	a.t.Helper()
+	rule, err := a.d.CreateAlertRule(rule)
+	if err != nil {
+		a.t.Fatal(err)
+	}
+	return rule
+}
+
+func (a *alertTest) evaluate(id string, temperature float64, now time.Time) {
+	a.t.Helper()
+	metric := Metric{DeviceID: id, Temperature: temperature, Gravity: 1.050, Created: now}
+	if err := a.engine.Evaluate(id, metric, now); err != nil {
+		a.t.Fatal(err)
+	}
+}
+
+// expect checks the device's only alert is in the state, and whether an
+// event was published for it
+func (a *alertTest) expect(id string, state string, published bool) {
+	a.t.Helper()
+	alerts, err := a.d.GetAlerts(AlertPending, AlertFiring, AlertResolved)
+	if err != nil {
+		a.t.Fatal(err)
+	}
+	found := []Alert{}
+	for _, alert := range alerts {
+		if alert.DeviceID == id {
+			found = append(found, alert)
+		}
+	}
+	if state == "" && len(found) != 0 {
+		a.t.Errorf("%s has alerts %+v, want none", id, found)
+	} else if state != "" && (len(found) != 1 || found[0].State != state) {
+		a.t.Errorf("%s has alerts %+v, want one %s", id, found, state)
+	}
+
+	for drained := false; !drained; {
+		select {
+		case e := <-a.events:
+			a.published[e.DeviceID] = append(a.published[e.DeviceID], e.Data.(AlertEvent))
+		default:
+			drained = true
+		}
+	}
+	events := a.published[id]
+	delete(a.published, id)
+	if published && (len(events) != 1 || events[0].State != state) {
+		a.t.Errorf("%s alert events %+v, want one %s", id, events, state)
+	} else if !published && len(events) != 0 {
+		a.t.Errorf("unexpected %s alert events %+v", id, events)
+	}
+}
+
+func TestAlertLifecycle(t *testing.T) {
+	a := newAlertTest(t, "tilt")
+	a.rule(AlertRule{Name: "Too warm", Metric: AlertTemperature, Comparator: ">", Threshold: 72, Hysteresis: 1, Duration: 600})
+	start := time.Now()
+
+	a.evaluate("tilt", 70, start)
+	a.expect("tilt", "", false)
+
+	// Pending until the condition has held for the duration
+	a.evaluate("tilt", 75, start)
+	a.expect("tilt", AlertPending, false)
+	a.evaluate("tilt", 74, start.Add(9*time.Minute))
+	a.expect("tilt", AlertPending, false)
+	a.evaluate("tilt", 73, start.Add(10*time.Minute))
+	a.expect("tilt", AlertFiring, true)
+
+	// Still firing until back below the threshold by the hysteresis
+	a.evaluate("tilt", 72, start.Add(11*time.Minute))
+	a.expect("tilt", AlertFiring, false)
+	a.evaluate("tilt", 71.5, start.Add(12*time.Minute))
+	a.expect("tilt", AlertFiring, false)
+	a.evaluate("tilt", 71, start.Add(13*time.Minute))
+	a.expect("tilt", AlertResolved, true)
+
+	alerts, err := a.d.GetAlerts(AlertResolved)
+	if err != nil || len(alerts) != 1 {
+		t.Fatalf("resolved alerts %+v, %v", alerts, err)
+	}
+	alert := alerts[0]
+	if !alert.Started.Equal(start) || alert.Fired == nil || !alert.Fired.Equal(start.Add(10*time.Minute)) ||
+		alert.Resolved == nil || !alert.Resolved.Equal(start.Add(13*time.Minute)) || alert.Value != 71 {
+		t.Errorf("resolved alert %+v", alert)
+	}
+
+	// A resolved alert is done with, so a new breach starts another
+	a.evaluate("tilt", 75, start.Add(14*time.Minute))
+	if pending, err := a.d.GetAlerts(AlertPending); err != nil || len(pending) != 1 {
+		t.Errorf("pending alerts %+v, %v", pending, err)
+	}
+}
+
+func TestAlertPendingClears(t *testing.T) {
+	a := newAlertTest(t, "tilt")
+	a.rule(AlertRule{Name: "Too warm", Metric: AlertTemperature, Comparator: ">", Threshold: 72, Hysteresis: 1, Duration: 600})
+	start := time.Now()
+
+	a.evaluate("tilt", 75, start)
+	a.expect("tilt", AlertPending, false)
+	// Clearing before the duration forgets the alert without publishing
+	a.evaluate("tilt", 72, start.Add(5*time.Minute))
+	a.expect("tilt", "", false)
+
+	// The duration starts again from the next breach
+	a.evaluate("tilt", 75, start.Add(6*time.Minute))
+	a.evaluate("tilt", 75, start.Add(11*time.Minute))
+	a.expect("tilt", AlertPending, false)
+	a.evaluate("tilt", 75, start.Add(16*time.Minute))
+	a.expect("tilt", AlertFiring, true)
+}
+
+func TestAlertScope(t *testing.T) {
+	a := newAlertTest(t, "one", "two", "three")
+	a.rule(AlertRule{Name: "One too warm", Metric: AlertTemperature, Comparator: ">", Threshold: 72, DeviceID: "one"})
+	a.rule(AlertRule{Name: "Disabled", Metric: AlertTemperature, Comparator: ">", Threshold: 72, Disabled: true})
+	batch, err := a.d.CreateBatch(Batch{Name: "IPA", DeviceID: "two", Started: time.Now().Add(-time.Hour)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.rule(AlertRule{Name: "IPA too warm", Metric: AlertTemperature, Comparator: ">", Threshold: 72, BatchID: batch.ID})
+	now := time.Now()
+
+	// The device rule only applies to its device, and the batch rule to
+	// the batch's device
+	a.evaluate("one", 75, now)
+	a.expect("one", AlertFiring, true)
+	a.evaluate("two", 75, now)
+	a.expect("two", AlertFiring, true)
+	a.evaluate("three", 75, now)
+	a.expect("three", "", false)
+
+	// Batch rules stop applying once the batch has ended, so its alert is
+	// no longer moved on
+	if err := a.d.EndBatch(batch.ID); err != nil {
+		t.Fatal(err)
+	}
+	a.evaluate("two", 60, now.Add(time.Minute))
+	a.expect("two", AlertFiring, false)
+	a.evaluate("one", 60, now.Add(time.Minute))
+	a.expect("one", AlertResolved, true)
+}
+
+func TestAlertStaleDevices(t *testing.T) {
+	a := newAlertTest(t, "reporting", "silent", "disabled")
+	a.rule(AlertRule{Name: "Stale", Metric: AlertAge, Comparator: ">", Threshold: 3600})
+	a.rule(AlertRule{Name: "Too cold", Metric: AlertTemperature, Comparator: "<", Threshold: 50})
+	if err := a.d.CreateMetric(Metric{DeviceID: "reporting", Temperature: 68, Gravity: 1.050, Created: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+	disabled, err := a.d.GetDevice("disabled")
+	if err != nil {
+		t.Fatal(err)
+	}
+	disabled.Disabled = true
+	if err := a.d.CreateOrUpdateDevice(disabled); err != nil {
+		t.Fatal(err)
+	}
+
+	// Devices that never reported are only stale once they've been added
+	// for longer than the threshold, and don't trip other rules
+	if err := a.engine.EvaluateAll(time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	a.expect("silent", "", false)
+	a.expect("reporting", "", false)
+
+	later := time.Now().Add(2 * time.Hour)
+	if err := a.engine.EvaluateAll(later); err != nil {
+		t.Fatal(err)
+	}
+	a.expect("reporting", AlertFiring, true)
+	a.expect("silent", AlertFiring, true)
+	a.expect("disabled", "", false)
+
+	alerts, err := a.d.GetAlerts(AlertFiring)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, alert := range alerts {
+		if alert.DeviceID == "silent" && (alert.Value < 7200-60 || alert.Value > 7200+60) {
+			t.Errorf("silent device is %g seconds old, want about 7200", alert.Value)
+		}
+	}
+}
@@ -6,24 +6,40 @@ import (
 	"io/ioutil"
 	"net/http"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/gorilla/handlers"
 	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
 	"github.com/justinas/alice"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 type API struct {
 	Router    *mux.Router
-	datastore *Datastore
+	datastore Datastore
 	state     *State
+	events    *EventBus
+	units     Units
+	outbox    *Outbox
 }
 
-func NewAPI(datastore *Datastore, state *State) *API {
+var upgrader = websocket.Upgrader{
+	// Match the CORS policy, which allows any origin
+	CheckOrigin: func(r *http.Request) bool { return true },
+}
+
+func NewAPI(datastore Datastore, state *State, events *EventBus, units Units, outbox *Outbox) *API {
 	a := &API{
 		Router:    mux.NewRouter().StrictSlash(true),
 		datastore: datastore,
 		state:     state,
+		events:    events,
+		units:     units,
+		outbox:    outbox,
 	}
 
 	v1Router := mux.NewRouter()
@@ -34,9 +50,47 @@ func NewAPI(datastore *Datastore, state *State) *API {
 	v1.HandleFunc("/devices/{id}", a.DeviceDeleteHandler).Methods("DELETE")
 	v1.HandleFunc("/devices/{id}/metrics", a.DeviceMetricsHandler).Methods("GET")
 	v1.HandleFunc("/devices/{id}/latest", a.DeviceLatestMetricsHandler).Methods("GET")
+	v1.HandleFunc("/devices/{id}/attenuation", a.DeviceAttenuationHandler).Methods("GET")
+	v1.HandleFunc("/devices/{id}/forecast", a.DeviceForecastHandler).Methods("GET")
 	v1.HandleFunc("/devices/{id}/refresh", a.DeviceRefreshHandler).Methods("POST")
+	v1.HandleFunc("/devices/{id}/presence", a.DevicePresenceHandler).Methods("GET")
+	v1.HandleFunc("/devices/{id}/calibration", a.DeviceCalibrationHandler).Methods("GET")
+	v1.HandleFunc("/devices/{id}/calibration", a.DeviceCalibrationUpdateHandler).Methods("POST")
+	v1.HandleFunc("/devices/{id}/calibration/points", a.CalibrationPointCreateHandler).Methods("POST")
+	v1.HandleFunc("/devices/{id}/calibration/points/{point:[0-9]+}", a.CalibrationPointDeleteHandler).Methods("DELETE")
+	v1.HandleFunc("/presence", a.PresenceHandler).Methods("GET", "OPTIONS", "HEAD")
+	v1.HandleFunc("/state", a.StateHandler).Methods("GET", "OPTIONS", "HEAD")
+	v1.HandleFunc("/events", a.EventsHandler).Methods("GET")
+	v1.HandleFunc("/events/ws", a.EventsWebSocketHandler).Methods("GET")
+	v1.HandleFunc("/batches", a.BatchesHandler).Methods("GET", "OPTIONS", "HEAD")
+	v1.HandleFunc("/batches", a.BatchCreateHandler).Methods("POST")
+	v1.HandleFunc("/batches/{id:[0-9]+}", a.BatchHandler).Methods("GET", "OPTIONS")
+	v1.HandleFunc("/batches/{id:[0-9]+}", a.BatchUpdateHandler).Methods("POST")
+	v1.HandleFunc("/batches/{id:[0-9]+}", a.BatchDeleteHandler).Methods("DELETE")
+	v1.HandleFunc("/batches/{id:[0-9]+}/end", a.BatchEndHandler).Methods("POST")
+	v1.HandleFunc("/batches/{id:[0-9]+}/metrics", a.BatchMetricsHandler).Methods("GET")
+	v1.HandleFunc("/batches/{id:[0-9]+}/attenuation", a.BatchAttenuationHandler).Methods("GET")
+	v1.HandleFunc("/alerts", a.AlertsHandler).Methods("GET", "OPTIONS", "HEAD")
+	v1.HandleFunc("/alerts/rules", a.AlertRulesHandler).Methods("GET", "OPTIONS", "HEAD")
+	v1.HandleFunc("/alerts/rules", a.AlertRuleCreateHandler).Methods("POST")
+	v1.HandleFunc("/alerts/rules/{id:[0-9]+}", a.AlertRuleHandler).Methods("GET", "OPTIONS")
+	v1.HandleFunc("/alerts/rules/{id:[0-9]+}", a.AlertRuleUpdateHandler).Methods("POST")
+	v1.HandleFunc("/alerts/rules/{id:[0-9]+}", a.AlertRuleDeleteHandler).Methods("DELETE")
+	v1.HandleFunc("/notifiers", a.NotifiersHandler).Methods("GET", "OPTIONS", "HEAD")
+	v1.HandleFunc("/notifiers", a.NotifierCreateHandler).Methods("POST")
+	v1.HandleFunc("/notifiers/{id:[0-9]+}", a.NotifierHandler).Methods("GET", "OPTIONS")
+	v1.HandleFunc("/notifiers/{id:[0-9]+}", a.NotifierUpdateHandler).Methods("POST")
+	v1.HandleFunc("/notifiers/{id:[0-9]+}", a.NotifierDeleteHandler).Methods("DELETE")
+	v1.HandleFunc("/notifiers/{id:[0-9]+}/test", a.NotifierTestHandler).Methods("POST")
+	v1.HandleFunc("/outbox", a.OutboxHandler).Methods("GET", "OPTIONS", "HEAD")
+	v1.HandleFunc("/outbox", a.OutboxPurgeHandler).Methods("DELETE")
+	v1.HandleFunc("/outbox/retry", a.OutboxRetryHandler).Methods("POST")
+	v1.HandleFunc("/outbox/{id:[0-9]+}", a.OutboxMessageHandler).Methods("GET", "OPTIONS")
+	v1.HandleFunc("/outbox/{id:[0-9]+}", a.OutboxMessageDeleteHandler).Methods("DELETE")
+	v1.HandleFunc("/outbox/{id:[0-9]+}/retry", a.OutboxMessageRetryHandler).Methods("POST")
 
 	a.Router.PathPrefix("/api/v1").Handler(v1Router)
+	a.Router.Handle("/metrics", promhttp.Handler()).Methods("GET")
 	a.Router.PathPrefix("/").Handler(http.FileServer(http.Dir("./www")))
 	return a
 }
@@ -44,7 +98,7 @@ func NewAPI(datastore *Datastore, state *State) *API {
 func (a *API) Start() {
 	headersOk := handlers.AllowedHeaders([]string{"X-Requested-With"})
 	originsOk := handlers.AllowedOrigins([]string{"*"})
-	methodsOk := handlers.AllowedMethods([]string{"GET", "HEAD", "POST", "PUT", "OPTIONS"})
+	methodsOk := handlers.AllowedMethods([]string{"GET", "HEAD", "POST", "PUT", "DELETE", "OPTIONS"})
 
 	chain := alice.New(
 		func(h http.Handler) http.Handler {
@@ -64,6 +118,23 @@ func (a *API) DevicesHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	for i, device := range devices {
+		units, err := a.unitsFor(r, device)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, err.Error())
+			return
+		}
+		attenuation, err := DeviceAttenuation(a.datastore, device.ID, device.LatestMetric)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprintf(w, err.Error())
+			return
+		}
+		devices[i].LatestMetric = units.Metric(device.LatestMetric)
+		devices[i].Attenuation = units.Attenuation(attenuation)
+	}
+
 	respondJSON(w, devices)
 }
 
@@ -78,6 +149,13 @@ func (a *API) DeviceHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	units, err := a.unitsFor(r, device)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, err.Error())
+		return
+	}
+
 	device.LatestMetric, err = a.datastore.GetDeviceLatestMetrics(id)
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
@@ -85,6 +163,15 @@ func (a *API) DeviceHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	attenuation, err := DeviceAttenuation(a.datastore, id, device.LatestMetric)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, err.Error())
+		return
+	}
+
+	device.LatestMetric = units.Metric(device.LatestMetric)
+	device.Attenuation = units.Attenuation(attenuation)
 	respondJSON(w, device)
 }
 
@@ -97,6 +184,7 @@ func (a *API) DeviceDeleteHandler(w http.ResponseWriter, r *http.Request) {
 		fmt.Fprintf(w, err.Error())
 		return
 	}
+	a.state.Forget(id)
 
 	w.WriteHeader(http.StatusNoContent)
 }
@@ -126,38 +214,181 @@ func (a *API) DeviceUpdateHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if err := (Units{device.GravityUnits, device.TemperatureUnits}).Validate(); err != nil {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		fmt.Fprintf(w, err.Error())
+		return
+	}
+
+	if err := ValidateEndpoint(device); err != nil {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		fmt.Fprintf(w, err.Error())
+		return
+	}
+
+	if device.PollInterval < 0 {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		fmt.Fprintf(w, "Poll interval can't be negative")
+		return
+	}
+
 	if err := a.datastore.UpdateDevice(device); err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		fmt.Fprintf(w, err.Error())
 		return
 	}
+	a.state.SetPollInterval(id, device.PollInterval)
 
 	w.WriteHeader(http.StatusOK)
 }
 
+// DeviceMetricsHandler returns the device's metrics, optionally limited to the
+// from/to (RFC3339) time range and summarised over buckets of interval (e.g.
+// 15m, 1h, 1d). When more results are available the X-Next-Cursor header holds
+// the cursor parameter for the next page.
 func (a *API) DeviceMetricsHandler(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	id := vars["id"]
-	limit := r.URL.Query().Get("limit")
 
-	if limit == "" {
-		limit = "24"
+	query, err := parseMetricQuery(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, err.Error())
+		return
+	}
+
+	units, err := a.deviceUnits(r, id)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, err.Error())
+		return
+	}
+
+	if interval := r.URL.Query().Get("interval"); interval != "" {
+		duration, err := parseInterval(interval)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, err.Error())
+			return
+		}
+
+		buckets, err := a.datastore.GetDeviceMetricBuckets(id, query, duration)
+		if err != nil {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprintf(w, err.Error())
+			return
+		}
+
+		if !query.latest() && len(buckets) == query.Limit {
+			w.Header().Set("X-Next-Cursor", strconv.FormatInt(buckets[len(buckets)-1].Bucket, 10))
+		}
+		setUnitsHeaders(w, units)
+		respondJSON(w, units.Buckets(buckets))
+		return
 	}
 
-	metrics, err := a.datastore.GetDeviceMetrics(id, limit)
+	metrics, err := a.datastore.GetDeviceMetrics(id, query)
 	if err != nil {
 		w.WriteHeader(http.StatusNotFound)
 		fmt.Fprintf(w, err.Error())
 		return
 	}
 
-	respondJSON(w, metrics)
+	if !query.latest() && len(metrics) == query.Limit {
+		w.Header().Set("X-Next-Cursor", strconv.Itoa(metrics[len(metrics)-1].ID))
+	}
+	setUnitsHeaders(w, units)
+	respondJSON(w, units.Metrics(metrics))
+}
+
+// DeviceAttenuationHandler returns the attenuation at each of the device's
+// metrics, selected like DeviceMetricsHandler, from the original gravity of
+// its active batch
+func (a *API) DeviceAttenuationHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id := vars["id"]
+
+	query, err := parseMetricQuery(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, err)
+		return
+	}
+
+	units, err := a.deviceUnits(r, id)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, err)
+		return
+	}
+
+	og, detected, ok, err := DeviceOriginalGravity(a.datastore, id)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(w, err)
+		return
+	}
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, "Original gravity not set or detected for device: %s", id)
+		return
+	}
+
+	metrics, err := a.datastore.GetDeviceMetrics(id, query)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(w, err)
+		return
+	}
+
+	if !query.latest() && len(metrics) == query.Limit {
+		w.Header().Set("X-Next-Cursor", strconv.Itoa(metrics[len(metrics)-1].ID))
+	}
+	setUnitsHeaders(w, units)
+	respondJSON(w, units.Attenuations(AttenuationSeries(og, detected, metrics)))
+}
+
+// DeviceForecastHandler predicts the final gravity of the device's active
+// batch and when it will be reached
+func (a *API) DeviceForecastHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id := vars["id"]
+
+	device, err := a.datastore.GetDevice(id)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(w, err)
+		return
+	}
+
+	units, err := a.unitsFor(r, device)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, err)
+		return
+	}
+
+	forecast, err := DeviceForecast(a.datastore, id)
+	if err != nil {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		fmt.Fprint(w, err)
+		return
+	}
+
+	respondJSON(w, units.Forecast(forecast))
 }
 
 func (a *API) DeviceLatestMetricsHandler(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	id := vars["id"]
 
+	units, err := a.deviceUnits(r, id)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, err.Error())
+		return
+	}
+
 	metrics, err := a.datastore.GetDeviceLatestMetrics(id)
 	if err != nil {
 		w.WriteHeader(http.StatusNotFound)
@@ -165,13 +396,50 @@ func (a *API) DeviceLatestMetricsHandler(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	respondJSON(w, metrics)
+	setUnitsHeaders(w, units)
+	respondJSON(w, units.Metric(metrics))
+}
+
+// PresenceHandler lists the presence of every discovered tilt
+func (a *API) PresenceHandler(w http.ResponseWriter, r *http.Request) {
+	respondJSON(w, a.state.Tilts())
+}
+
+// StateHandler compares the tilts in the in-memory state with those stored
+func (a *API) StateHandler(w http.ResponseWriter, r *http.Request) {
+	entries, err := a.state.Compare()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(w, err)
+		return
+	}
+	respondJSON(w, entries)
+}
+
+func (a *API) DevicePresenceHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id := vars["id"]
+
+	tilt, ok := a.state.Tilt(id)
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, "No such tilt: %s", id)
+		return
+	}
+	respondJSON(w, tilt)
 }
 
 func (a *API) DeviceRefreshHandler(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	id := vars["id"]
 
+	units, err := a.deviceUnits(r, id)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, err.Error())
+		return
+	}
+
 	if err := a.state.RefreshTilt(id); err != nil {
 		w.WriteHeader(http.StatusNotFound)
 		fmt.Fprintf(w, err.Error())
@@ -185,7 +453,953 @@ func (a *API) DeviceRefreshHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	respondJSON(w, metric)
+	setUnitsHeaders(w, units)
+	respondJSON(w, units.Metric(metric))
+}
+
+// DeviceCalibrationHandler returns the device's calibration with the fitted
+// gravity at each point, previewing the fit at any comma separated raw
+// gravities given as the preview parameter
+func (a *API) DeviceCalibrationHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id := vars["id"]
+
+	calibration, err := LoadCalibration(a.datastore, id)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(w, err)
+		return
+	}
+
+	type previewPoint struct {
+		Raw    float64 `json:"raw"`
+		Fitted float64 `json:"fitted"`
+	}
+	preview := []previewPoint{}
+	if raw := r.URL.Query().Get("preview"); raw != "" {
+		for _, value := range strings.Split(raw, ",") {
+			gravity, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				fmt.Fprintf(w, "Invalid preview gravity: %s", value)
+				return
+			}
+			preview = append(preview, previewPoint{gravity, calibration.Gravity(gravity)})
+		}
+	}
+
+	respondJSON(w, struct {
+		Calibration
+		Preview []previewPoint `json:"preview"`
+	}{calibration, preview})
+}
+
+func (a *API) DeviceCalibrationUpdateHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id := vars["id"]
+
+	device, err := a.datastore.GetDevice(id)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(w, err)
+		return
+	}
+
+	offsets := struct {
+		GravityOffset     float64 `json:"gravity_offset"`
+		TemperatureOffset float64 `json:"temperature_offset"`
+	}{device.GravityOffset, device.TemperatureOffset}
+	if err := json.NewDecoder(r.Body).Decode(&offsets); err != nil {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		fmt.Fprint(w, err)
+		return
+	}
+
+	if err := a.datastore.SetDeviceCalibration(id, offsets.GravityOffset, offsets.TemperatureOffset); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+func (a *API) CalibrationPointCreateHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id := vars["id"]
+
+	device, err := a.datastore.GetDevice(id)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(w, err)
+		return
+	}
+
+	point := CalibrationPoint{}
+	if err := json.NewDecoder(r.Body).Decode(&point); err != nil {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		fmt.Fprint(w, err)
+		return
+	}
+	point.DeviceID = id
+
+	// Refuse points that would leave the calibration without a fit
+	points, err := a.datastore.GetCalibrationPoints(id)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(w, err)
+		return
+	}
+	if _, err := NewCalibration(device, append(points, point)); err != nil {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		fmt.Fprint(w, err)
+		return
+	}
+
+	point, err = a.datastore.CreateCalibrationPoint(point)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(w, err)
+		return
+	}
+
+	respondJSON(w, point)
+}
+
+func (a *API) CalibrationPointDeleteHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id := vars["id"]
+	point, _ := strconv.Atoi(vars["point"])
+
+	if err := a.datastore.DeleteCalibrationPoint(id, point); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// EventsHandler streams events as Server-Sent Events, optionally filtered by
+// comma separated device IDs and event types
+func (a *API) EventsHandler(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "Streaming unsupported")
+		return
+	}
+
+	events := a.events.Subscribe(NewEventFilter(r.URL.Query().Get("device"), r.URL.Query().Get("type")))
+	defer a.events.Unsubscribe(events)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	keepalive := time.NewTicker(30 * time.Second)
+	defer keepalive.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepalive.C:
+			fmt.Fprintf(w, ": keepalive\n\n")
+		case e := <-events:
+			payload, err := json.Marshal(e)
+			if err != nil {
+				log.Errorf("[api] Error encoding event: %s", err)
+				continue
+			}
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", e.Type, payload)
+		}
+		flusher.Flush()
+	}
+}
+
+// EventsWebSocketHandler streams events as JSON messages over a WebSocket,
+// filtered like EventsHandler
+func (a *API) EventsWebSocketHandler(w http.ResponseWriter, r *http.Request) {
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Errorf("[api] Error upgrading to websocket: %s", err)
+		return
+	}
+	defer conn.Close()
+
+	events := a.events.Subscribe(NewEventFilter(r.URL.Query().Get("device"), r.URL.Query().Get("type")))
+	defer a.events.Unsubscribe(events)
+
+	// Discard anything the client sends, noticing when it goes away
+	closed := make(chan bool)
+	go func() {
+		defer close(closed)
+		for {
+			if _, _, err := conn.NextReader(); err != nil {
+				return
+			}
+		}
+	}()
+
+	for {
+		select {
+		case <-closed:
+			return
+		case e := <-events:
+			conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+			if err := conn.WriteJSON(e); err != nil {
+				log.Debugf("[api] Closing websocket: %s", err)
+				return
+			}
+		}
+	}
+}
+
+func (a *API) BatchesHandler(w http.ResponseWriter, r *http.Request) {
+	var batches []Batch
+	var err error
+	if device := r.URL.Query().Get("device"); device != "" {
+		batches, err = a.datastore.GetDeviceBatches(device)
+	} else {
+		batches, err = a.datastore.GetBatches()
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(w, err)
+		return
+	}
+
+	for i, batch := range batches {
+		units, err := a.deviceUnits(r, batch.DeviceID)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, err)
+			return
+		}
+		if batch.Attenuation, err = BatchAttenuation(a.datastore, batch); err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprint(w, err)
+			return
+		}
+		batches[i] = units.Batch(batch)
+	}
+
+	respondJSON(w, batches)
+}
+
+func (a *API) BatchHandler(w http.ResponseWriter, r *http.Request) {
+	batch, err := a.getBatch(r)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(w, err)
+		return
+	}
+
+	units, err := a.deviceUnits(r, batch.DeviceID)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, err)
+		return
+	}
+
+	if batch.Attenuation, err = BatchAttenuation(a.datastore, batch); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(w, err)
+		return
+	}
+
+	respondJSON(w, units.Batch(batch))
+}
+
+func (a *API) BatchCreateHandler(w http.ResponseWriter, r *http.Request) {
+	batch := Batch{}
+	if err := json.NewDecoder(r.Body).Decode(&batch); err != nil {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		fmt.Fprint(w, err)
+		return
+	}
+
+	if status, err := a.validateBatch(batch); err != nil {
+		w.WriteHeader(status)
+		fmt.Fprint(w, err)
+		return
+	}
+
+	units, err := a.deviceUnits(r, batch.DeviceID)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, err)
+		return
+	}
+
+	batch, err = a.datastore.CreateBatch(units.BatchToSG(batch))
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(w, err)
+		return
+	}
+
+	respondJSON(w, units.Batch(batch))
+}
+
+func (a *API) BatchUpdateHandler(w http.ResponseWriter, r *http.Request) {
+	batch, err := a.getBatch(r)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(w, err)
+		return
+	}
+
+	units, err := a.deviceUnits(r, batch.DeviceID)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, err)
+		return
+	}
+
+	// Gravities are given in the same units the batch is presented in
+	id := batch.ID
+	batch = units.Batch(batch)
+	if err := json.NewDecoder(r.Body).Decode(&batch); err != nil {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		fmt.Fprint(w, err)
+		return
+	}
+	batch.ID = id
+
+	if status, err := a.validateBatch(batch); err != nil {
+		w.WriteHeader(status)
+		fmt.Fprint(w, err)
+		return
+	}
+
+	if err := a.datastore.UpdateBatch(units.BatchToSG(batch)); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+func (a *API) BatchDeleteHandler(w http.ResponseWriter, r *http.Request) {
+	batch, err := a.getBatch(r)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(w, err)
+		return
+	}
+
+	if err := a.datastore.DeleteBatch(batch.ID); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (a *API) BatchEndHandler(w http.ResponseWriter, r *http.Request) {
+	batch, err := a.getBatch(r)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(w, err)
+		return
+	}
+
+	if batch.Ended != nil {
+		w.WriteHeader(http.StatusConflict)
+		fmt.Fprintf(w, "Batch already ended: %d", batch.ID)
+		return
+	}
+
+	if err := a.datastore.EndBatch(batch.ID); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(w, err)
+		return
+	}
+
+	batch, err = a.datastore.GetBatch(batch.ID)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(w, err)
+		return
+	}
+
+	if batch.Attenuation, err = BatchAttenuation(a.datastore, batch); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(w, err)
+		return
+	}
+
+	units, err := a.deviceUnits(r, batch.DeviceID)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, err)
+		return
+	}
+
+	respondJSON(w, units.Batch(batch))
+}
+
+func (a *API) BatchMetricsHandler(w http.ResponseWriter, r *http.Request) {
+	batch, err := a.getBatch(r)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(w, err)
+		return
+	}
+
+	units, err := a.deviceUnits(r, batch.DeviceID)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, err)
+		return
+	}
+
+	metrics, err := a.datastore.GetBatchMetrics(batch)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(w, err)
+		return
+	}
+
+	setUnitsHeaders(w, units)
+	respondJSON(w, units.Metrics(metrics))
+}
+
+// BatchAttenuationHandler returns the attenuation at each metric recorded
+// during the batch
+func (a *API) BatchAttenuationHandler(w http.ResponseWriter, r *http.Request) {
+	batch, err := a.getBatch(r)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(w, err)
+		return
+	}
+
+	units, err := a.deviceUnits(r, batch.DeviceID)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, err)
+		return
+	}
+
+	og, detected, ok, err := BatchOriginalGravity(a.datastore, batch)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(w, err)
+		return
+	}
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, "Original gravity not set or detected for batch: %d", batch.ID)
+		return
+	}
+
+	metrics, err := a.datastore.GetBatchMetrics(batch)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(w, err)
+		return
+	}
+
+	setUnitsHeaders(w, units)
+	respondJSON(w, units.Attenuations(AttenuationSeries(og, detected, metrics)))
+}
+
+func (a *API) getBatch(r *http.Request) (Batch, error) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		return Batch{}, err
+	}
+	return a.datastore.GetBatch(id)
+}
+
+// validateBatch checks the batch's device exists, and that the batch neither
+// ends before it starts nor overlaps another of the device's batches, which
+// would claim the same metrics
+func (a *API) validateBatch(batch Batch) (int, error) {
+	if batch.Name == "" {
+		return http.StatusUnprocessableEntity, fmt.Errorf("Batch name is required")
+	}
+	if batch.DeviceID == "" {
+		return http.StatusUnprocessableEntity, fmt.Errorf("Batch device_id is required")
+	}
+	if _, err := a.datastore.GetDevice(batch.DeviceID); err != nil {
+		return http.StatusUnprocessableEntity, fmt.Errorf("No such device: %s", batch.DeviceID)
+	}
+	if batch.Started.IsZero() {
+		batch.Started = time.Now()
+	}
+	if batch.Ended != nil && batch.Ended.Before(batch.Started) {
+		return http.StatusUnprocessableEntity, fmt.Errorf("Batch can't end before it starts")
+	}
+
+	batches, err := a.datastore.GetDeviceBatches(batch.DeviceID)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	for _, other := range batches {
+		if other.ID == batch.ID || !batch.overlaps(other) {
+			continue
+		}
+		if other.Ended == nil {
+			return http.StatusConflict, fmt.Errorf("Device %s is already in use by batch %d", batch.DeviceID, other.ID)
+		}
+		return http.StatusConflict, fmt.Errorf("Batch overlaps batch %d on device %s", other.ID, batch.DeviceID)
+	}
+	return 0, nil
+}
+
+// AlertsHandler returns the alerts in the comma separated states, by default
+// those pending or firing
+func (a *API) AlertsHandler(w http.ResponseWriter, r *http.Request) {
+	states := []string{AlertPending, AlertFiring}
+	if state := r.URL.Query().Get("state"); state != "" {
+		states = []string{}
+		for s := range splitSet(state) {
+			states = append(states, s)
+		}
+	}
+
+	alerts, err := a.datastore.GetAlerts(states...)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(w, err)
+		return
+	}
+
+	respondJSON(w, alerts)
+}
+
+func (a *API) AlertRulesHandler(w http.ResponseWriter, r *http.Request) {
+	rules, err := a.datastore.GetAlertRules()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(w, err)
+		return
+	}
+
+	respondJSON(w, rules)
+}
+
+func (a *API) AlertRuleHandler(w http.ResponseWriter, r *http.Request) {
+	rule, err := a.getAlertRule(r)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(w, err)
+		return
+	}
+
+	respondJSON(w, rule)
+}
+
+func (a *API) AlertRuleCreateHandler(w http.ResponseWriter, r *http.Request) {
+	rule := AlertRule{}
+	if err := json.NewDecoder(r.Body).Decode(&rule); err != nil {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		fmt.Fprint(w, err)
+		return
+	}
+
+	if err := rule.Validate(); err != nil {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		fmt.Fprint(w, err)
+		return
+	}
+
+	rule, err := a.datastore.CreateAlertRule(rule)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(w, err)
+		return
+	}
+
+	respondJSON(w, rule)
+}
+
+func (a *API) AlertRuleUpdateHandler(w http.ResponseWriter, r *http.Request) {
+	rule, err := a.getAlertRule(r)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(w, err)
+		return
+	}
+
+	id := rule.ID
+	if err := json.NewDecoder(r.Body).Decode(&rule); err != nil {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		fmt.Fprint(w, err)
+		return
+	}
+	rule.ID = id
+
+	if err := rule.Validate(); err != nil {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		fmt.Fprint(w, err)
+		return
+	}
+
+	if err := a.datastore.UpdateAlertRule(rule); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+func (a *API) AlertRuleDeleteHandler(w http.ResponseWriter, r *http.Request) {
+	rule, err := a.getAlertRule(r)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(w, err)
+		return
+	}
+
+	if err := a.datastore.DeleteAlertRule(rule.ID); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (a *API) getAlertRule(r *http.Request) (AlertRule, error) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		return AlertRule{}, err
+	}
+	return a.datastore.GetAlertRule(id)
+}
+
+func (a *API) NotifiersHandler(w http.ResponseWriter, r *http.Request) {
+	notifiers, err := a.datastore.GetNotifiers()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(w, err)
+		return
+	}
+
+	respondJSON(w, notifiers)
+}
+
+func (a *API) NotifierHandler(w http.ResponseWriter, r *http.Request) {
+	notifier, err := a.getNotifier(r)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(w, err)
+		return
+	}
+
+	respondJSON(w, notifier)
+}
+
+func (a *API) NotifierCreateHandler(w http.ResponseWriter, r *http.Request) {
+	notifier := Notifier{}
+	if err := json.NewDecoder(r.Body).Decode(&notifier); err != nil {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		fmt.Fprint(w, err)
+		return
+	}
+
+	if err := notifier.Validate(); err != nil {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		fmt.Fprint(w, err)
+		return
+	}
+
+	notifier, err := a.datastore.CreateNotifier(notifier)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(w, err)
+		return
+	}
+
+	respondJSON(w, notifier)
+}
+
+func (a *API) NotifierUpdateHandler(w http.ResponseWriter, r *http.Request) {
+	notifier, err := a.getNotifier(r)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(w, err)
+		return
+	}
+
+	id := notifier.ID
+	if err := json.NewDecoder(r.Body).Decode(&notifier); err != nil {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		fmt.Fprint(w, err)
+		return
+	}
+	notifier.ID = id
+
+	if err := notifier.Validate(); err != nil {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		fmt.Fprint(w, err)
+		return
+	}
+
+	if err := a.datastore.UpdateNotifier(notifier); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+func (a *API) NotifierDeleteHandler(w http.ResponseWriter, r *http.Request) {
+	notifier, err := a.getNotifier(r)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(w, err)
+		return
+	}
+
+	if err := a.datastore.DeleteNotifier(notifier.ID); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// NotifierTestHandler sends a test notification straight away, ignoring the
+// notifier's rate limit and without retrying, returning any error
+func (a *API) NotifierTestHandler(w http.ResponseWriter, r *http.Request) {
+	notifier, err := a.getNotifier(r)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(w, err)
+		return
+	}
+
+	sender, err := NewSender(notifier)
+	if err != nil {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		fmt.Fprint(w, err)
+		return
+	}
+
+	err = sender.Send(Notification{
+		Event:   "test",
+		Title:   "Test notification from hydromonitor",
+		Message: fmt.Sprintf("Notifier %s is working", notifier.Name),
+		Created: time.Now(),
+	})
+	if err != nil {
+		w.WriteHeader(http.StatusBadGateway)
+		fmt.Fprint(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (a *API) getNotifier(r *http.Request) (Notifier, error) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		return Notifier{}, err
+	}
+	return a.datastore.GetNotifier(id)
+}
+
+// OutboxHandler returns the undelivered messages, optionally only those in
+// the state (pending or dead) to the destination
+func (a *API) OutboxHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	messages, err := a.datastore.GetOutboxMessages(query.Get("state"), query.Get("destination"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, err)
+		return
+	}
+
+	respondJSON(w, messages)
+}
+
+// OutboxPurgeHandler deletes the undelivered messages, optionally only those
+// in the state (pending or dead) to the destination
+func (a *API) OutboxPurgeHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	purged, err := a.datastore.PurgeOutboxMessages(query.Get("state"), query.Get("destination"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, err)
+		return
+	}
+
+	respondJSON(w, map[string]int64{"purged": purged})
+}
+
+// OutboxRetryHandler makes the dead messages, or those in the state given,
+// due straight away, optionally only those to the destination
+func (a *API) OutboxRetryHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	state := query.Get("state")
+	if state == "" {
+		state = OutboxDead
+	}
+
+	messages, err := a.datastore.GetOutboxMessages(state, query.Get("destination"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, err)
+		return
+	}
+
+	for _, message := range messages {
+		if err := a.outbox.Retry(message); err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprint(w, err)
+			return
+		}
+	}
+
+	respondJSON(w, map[string]int{"retried": len(messages)})
+}
+
+func (a *API) OutboxMessageHandler(w http.ResponseWriter, r *http.Request) {
+	message, err := a.getOutboxMessage(r)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(w, err)
+		return
+	}
+
+	respondJSON(w, message)
+}
+
+func (a *API) OutboxMessageDeleteHandler(w http.ResponseWriter, r *http.Request) {
+	message, err := a.getOutboxMessage(r)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(w, err)
+		return
+	}
+
+	if err := a.datastore.DeleteOutboxMessage(message.ID); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// OutboxMessageRetryHandler makes the message due straight away, reviving it
+// if dead
+func (a *API) OutboxMessageRetryHandler(w http.ResponseWriter, r *http.Request) {
+	message, err := a.getOutboxMessage(r)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(w, err)
+		return
+	}
+
+	if err := a.outbox.Retry(message); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (a *API) getOutboxMessage(r *http.Request) (OutboxMessage, error) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		return OutboxMessage{}, err
+	}
+	return a.datastore.GetOutboxMessage(id)
+}
+
+// unitsFor returns the units to present the device's readings in: the
+// gravity_units and temperature_units parameters, then the device's
+// preference, then the global default
+func (a *API) unitsFor(r *http.Request, device Device) (Units, error) {
+	params := r.URL.Query()
+	requested, err := NewUnits(params.Get("gravity_units"), params.Get("temperature_units"))
+	if err != nil {
+		return requested, err
+	}
+	preferred := Units{Gravity: device.GravityUnits, Temperature: device.TemperatureUnits}
+	return a.units.Override(preferred).Override(requested), nil
+}
+
+// deviceUnits looks up the device for unitsFor, falling back to the global
+// default for unknown devices
+func (a *API) deviceUnits(r *http.Request, id string) (Units, error) {
+	device, _ := a.datastore.GetDevice(id)
+	return a.unitsFor(r, device)
+}
+
+func setUnitsHeaders(w http.ResponseWriter, units Units) {
+	w.Header().Set("X-Gravity-Units", units.Gravity)
+	w.Header().Set("X-Temperature-Units", units.Temperature)
+}
+
+func parseMetricQuery(r *http.Request) (MetricQuery, error) {
+	params := r.URL.Query()
+	query := MetricQuery{Limit: 24}
+	var err error
+
+	if limit := params.Get("limit"); limit != "" {
+		if query.Limit, err = strconv.Atoi(limit); err != nil || query.Limit < 1 || query.Limit > 1000 {
+			return query, fmt.Errorf("Invalid limit, must be between 1 and 1000: %s", limit)
+		}
+	}
+	if from := params.Get("from"); from != "" {
+		if query.From, err = time.Parse(time.RFC3339, from); err != nil {
+			return query, fmt.Errorf("Invalid from time: %s", err)
+		}
+	}
+	if to := params.Get("to"); to != "" {
+		if query.To, err = time.Parse(time.RFC3339, to); err != nil {
+			return query, fmt.Errorf("Invalid to time: %s", err)
+		}
+	}
+	if !query.From.IsZero() && !query.To.IsZero() && !query.From.Before(query.To) {
+		return query, fmt.Errorf("Invalid time range, from must be before to")
+	}
+	if cursor := params.Get("cursor"); cursor != "" {
+		if query.Cursor, err = strconv.ParseInt(cursor, 10, 64); err != nil {
+			return query, fmt.Errorf("Invalid cursor: %s", cursor)
+		}
+	}
+	return query, nil
+}
+
+// parseInterval parses a duration of at least a second, additionally
+// accepting a number of days such as 1d
+func parseInterval(interval string) (time.Duration, error) {
+	var duration time.Duration
+	if strings.HasSuffix(interval, "d") {
+		days, err := strconv.Atoi(strings.TrimSuffix(interval, "d"))
+		if err != nil {
+			return 0, fmt.Errorf("Invalid interval: %s", interval)
+		}
+		duration = time.Duration(days) * 24 * time.Hour
+	} else {
+		var err error
+		if duration, err = time.ParseDuration(interval); err != nil {
+			return 0, fmt.Errorf("Invalid interval: %s", interval)
+		}
+	}
+
+	if duration < time.Second {
+		return 0, fmt.Errorf("Invalid interval, must be at least 1s: %s", interval)
+	}
+	return duration, nil
 }
 
 func respondJSON(w http.ResponseWriter, data interface{}) {
@@ -197,5 +1411,6 @@ func respondJSON(w http.ResponseWriter, data interface{}) {
 
 	w.Header().Set("Content-Type", "application/json")
 	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Expose-Headers", "X-Next-Cursor, X-Gravity-Units, X-Temperature-Units")
 	w.Write(payload)
 }
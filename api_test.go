@@ -0,0 +1,162 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestAPI returns an API over a new datastore, with a state reading from
+// simulated tilts
+func newTestAPI(t *testing.T) (*API, Datastore) {
+	t.Helper()
+	d := newTestDatastore(t)
+	transport, err := NewSimulatedTransport("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	events := NewEventBus()
+	state := NewState(d, transport, events, time.Second, 2, time.Hour, 2*time.Hour)
+	return NewAPI(d, state, events, Units{}, NewOutbox(d, time.Hour, 3)), d
+}
+
+func serve(a *API, method string, path string, body string) *httptest.ResponseRecorder {
+	recorder := httptest.NewRecorder()
+	a.Router.ServeHTTP(recorder, httptest.NewRequest(method, path, strings.NewReader(body)))
+	return recorder
+}
+
+func TestBatchValidation(t *testing.T) {
+	a, d := newTestAPI(t)
+	if err := d.CreateOrUpdateDevice(Device{ID: "tilt", Color: "red"}); err != nil {
+		t.Fatal(err)
+	}
+	for _, batch := range []string{
+		`{"name": "Stout", "device_id": "tilt", "started": "2020-01-01T00:00:00Z", "ended": "2020-01-15T00:00:00Z"}`,
+		`{"name": "IPA", "device_id": "tilt", "started": "2020-02-01T00:00:00Z"}`,
+	} {
+		if response := serve(a, "POST", "/api/v1/batches", batch); response.Code != http.StatusOK {
+			t.Fatalf("creating %s: %d %s", batch, response.Code, response.Body)
+		}
+	}
+
+	tests := []struct {
+		name   string
+		batch  string
+		status int
+	}{
+		{"ends before starting", `{"name": "Lager", "device_id": "tilt", "started": "2019-06-10T00:00:00Z", "ended": "2019-06-01T00:00:00Z"}`, http.StatusUnprocessableEntity},
+		{"overlaps an ended batch", `{"name": "Lager", "device_id": "tilt", "started": "2019-12-20T00:00:00Z", "ended": "2020-01-05T00:00:00Z"}`, http.StatusConflict},
+		{"within an ended batch", `{"name": "Lager", "device_id": "tilt", "started": "2020-01-02T00:00:00Z", "ended": "2020-01-03T00:00:00Z"}`, http.StatusConflict},
+		{"overlaps the active batch", `{"name": "Lager", "device_id": "tilt", "started": "2020-01-20T00:00:00Z", "ended": "2020-02-10T00:00:00Z"}`, http.StatusConflict},
+		{"second active batch", `{"name": "Lager", "device_id": "tilt"}`, http.StatusConflict},
+		{"unknown device", `{"name": "Lager", "device_id": "other"}`, http.StatusUnprocessableEntity},
+		{"between batches", `{"name": "Lager", "device_id": "tilt", "started": "2020-01-15T00:00:00Z", "ended": "2020-02-01T00:00:00Z"}`, http.StatusOK},
+	}
+	for _, test := range tests {
+		if response := serve(a, "POST", "/api/v1/batches", test.batch); response.Code != test.status {
+			t.Errorf("%s: got %d %s, want %d", test.name, response.Code, response.Body, test.status)
+		}
+	}
+
+	// Batches can be updated without conflicting with themselves
+	batches, err := d.GetDeviceBatches("tilt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, batch := range batches {
+		if batch.Name != "IPA" {
+			continue
+		}
+		path := "/api/v1/batches/" + strconv.Itoa(batch.ID)
+		if response := serve(a, "POST", path, `{"notes": "Dry hopped"}`); response.Code != http.StatusOK {
+			t.Errorf("updating: %d %s", response.Code, response.Body)
+		}
+		if response := serve(a, "POST", path, `{"started": "2020-01-10T00:00:00Z"}`); response.Code != http.StatusConflict {
+			t.Errorf("moving onto another batch: %d %s", response.Code, response.Body)
+		}
+	}
+}
+
+func TestErrorResponsesKeepPercentSigns(t *testing.T) {
+	a, _ := newTestAPI(t)
+	response := serve(a, "POST", "/api/v1/notifiers", `{"name": "hook", "type": "webhook", "url": "http://example.com", "template": "{{ 50% }}"}`)
+	if response.Code != http.StatusUnprocessableEntity || !strings.Contains(response.Body.String(), "%") || strings.Contains(response.Body.String(), "%!") {
+		t.Errorf("got %d %s", response.Code, response.Body)
+	}
+}
+
+func TestDeviceMetricsHandler(t *testing.T) {
+	a, d := newTestAPI(t)
+	if err := d.CreateOrUpdateDevice(Device{ID: "tilt", Color: "red"}); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Unix(1577880000, 0)
+	for i := 0; i < 5; i++ {
+		if err := d.CreateMetric(Metric{DeviceID: "tilt", Gravity: 1.050, Temperature: float64(60 + i), Created: start.Add(time.Duration(i) * 30 * time.Minute)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Following X-Next-Cursor visits every metric once
+	temperatures := []float64{}
+	path := "/api/v1/devices/tilt/metrics?limit=2&from=2020-01-01T12:00:00Z"
+	for page := 0; page < 5; page++ {
+		response := serve(a, "GET", path, "")
+		if response.Code != http.StatusOK {
+			t.Fatalf("%s: %d %s", path, response.Code, response.Body)
+		}
+		metrics := []Metric{}
+		if err := json.Unmarshal(response.Body.Bytes(), &metrics); err != nil {
+			t.Fatal(err)
+		}
+		for _, metric := range metrics {
+			temperatures = append(temperatures, metric.Temperature)
+		}
+		cursor := response.Header().Get("X-Next-Cursor")
+		if cursor == "" {
+			break
+		}
+		path = "/api/v1/devices/tilt/metrics?limit=2&from=2020-01-01T12:00:00Z&cursor=" + cursor
+	}
+	if fmt.Sprint(temperatures) != "[60 61 62 63 64]" {
+		t.Errorf("paged %v", temperatures)
+	}
+
+	response := serve(a, "GET", "/api/v1/devices/tilt/metrics?limit=2&from=2020-01-01T12:00:00Z&interval=1h", "")
+	buckets := []MetricBucket{}
+	if err := json.Unmarshal(response.Body.Bytes(), &buckets); err != nil {
+		t.Fatal(err)
+	}
+	if response.Code != http.StatusOK || len(buckets) != 2 || buckets[0].Count != 2 || response.Header().Get("X-Next-Cursor") != strconv.FormatInt(1577883600, 10) {
+		t.Errorf("buckets %d %+v, cursor %s", response.Code, buckets, response.Header().Get("X-Next-Cursor"))
+	}
+
+	// The latest metrics have nothing after them to page to
+	if response := serve(a, "GET", "/api/v1/devices/tilt/metrics?limit=2", ""); response.Header().Get("X-Next-Cursor") != "" {
+		t.Errorf("latest metrics have a next cursor")
+	}
+
+	for _, query := range []string{
+		"from=yesterday",
+		"to=2020-01-01",
+		"from=2020-01-02T00:00:00Z&to=2020-01-01T00:00:00Z",
+		"from=2020-01-01T00:00:00Z&to=2020-01-01T00:00:00Z",
+		"limit=0",
+		"limit=1001",
+		"cursor=next",
+		"interval=fortnight",
+		"interval=0s",
+		"interval=-1h",
+		"interval=0d",
+	} {
+		if response := serve(a, "GET", "/api/v1/devices/tilt/metrics?"+query, ""); response.Code != http.StatusBadRequest {
+			t.Errorf("%s: got %d %s", query, response.Code, response.Body)
+		}
+	}
+}
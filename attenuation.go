@@ -0,0 +1,170 @@
+package main
+
+import (
+	"database/sql"
+	"math"
+	"time"
+)
+
+const (
+	// StableReadings is how many consecutive readings must agree to detect
+	// the original gravity
+	StableReadings = 3
+	// StableGravityTolerance is how far apart stable readings may be
+	StableGravityTolerance = 0.002
+	// detectionReadings caps how many of the first readings are searched for
+	// a stable original gravity
+	detectionReadings = 48
+)
+
+// Attenuation describes how far a fermentation has progressed from its
+// original gravity to the gravity at Created
+type Attenuation struct {
+	OriginalGravity float64 `json:"original_gravity"`
+	// Detected is set when the original gravity was detected from the first
+	// stable readings rather than set on the batch
+	Detected            bool      `json:"detected"`
+	Gravity             float64   `json:"gravity"`
+	ABV                 float64   `json:"abv"`
+	ABVAlternate        float64   `json:"abv_alternate"`
+	ApparentAttenuation float64   `json:"apparent_attenuation"`
+	RealAttenuation     float64   `json:"real_attenuation"`
+	Created             time.Time `json:"created"`
+}
+
+// NewAttenuation calculates the attenuation of a metric from the original
+// gravity
+func NewAttenuation(og float64, detected bool, metric Metric) *Attenuation {
+	return &Attenuation{
+		OriginalGravity:     og,
+		Detected:            detected,
+		Gravity:             metric.Gravity,
+		ABV:                 round(ABV(og, metric.Gravity), 2),
+		ABVAlternate:        round(ABVAlternate(og, metric.Gravity), 2),
+		ApparentAttenuation: round(ApparentAttenuation(og, metric.Gravity), 1),
+		RealAttenuation:     round(RealAttenuation(og, metric.Gravity), 1),
+		Created:             metric.Created,
+	}
+}
+
+// AttenuationSeries calculates the attenuation at every metric
+func AttenuationSeries(og float64, detected bool, metrics []Metric) []*Attenuation {
+	series := make([]*Attenuation, len(metrics))
+	for i, metric := range metrics {
+		series[i] = NewAttenuation(og, detected, metric)
+	}
+	return series
+}
+
+// ABV uses the common (OG - FG) * 131.25 approximation
+func ABV(og float64, fg float64) float64 {
+	return (og - fg) * 131.25
+}
+
+// ABVAlternate uses the alternate formula, which is more accurate for strong
+// beers
+func ABVAlternate(og float64, fg float64) float64 {
+	return (76.08 * (og - fg) / (1.775 - og)) * (fg / 0.794)
+}
+
+// ApparentAttenuation is the percentage of the original gravity points that
+// have gone, uncorrected for the alcohol being lighter than water
+func ApparentAttenuation(og float64, fg float64) float64 {
+	if og <= 1 {
+		return 0
+	}
+	return (og - fg) / (og - 1) * 100
+}
+
+// RealAttenuation is the percentage of the original extract fermented, using
+// Balling's real extract approximation
+func RealAttenuation(og float64, fg float64) float64 {
+	oe := SGToPlato(og)
+	if oe <= 0 {
+		return 0
+	}
+	re := 0.1808*oe + 0.8192*SGToPlato(fg)
+	return (oe - re) / oe * 100
+}
+
+// DetectOriginalGravity averages the first StableReadings consecutive metrics
+// within StableGravityTolerance of each other, skipping the noisy readings
+// taken while the tilt settles after being dropped in
+func DetectOriginalGravity(metrics []Metric) (float64, bool) {
+	for start := 0; start+StableReadings <= len(metrics); start++ {
+		window := metrics[start : start+StableReadings]
+		min, max, sum := window[0].Gravity, window[0].Gravity, 0.0
+		for _, m := range window {
+			min = math.Min(min, m.Gravity)
+			max = math.Max(max, m.Gravity)
+			sum += m.Gravity
+		}
+		// Rounded so readings exactly the tolerance apart aren't rejected
+		// for floating point error
+		if round(max-min, 4) <= StableGravityTolerance {
+			return round(sum/StableReadings, 4), true
+		}
+	}
+	return 0, false
+}
+
+// BatchOriginalGravity returns the batch's original gravity, detecting it
+// from the first readings of the batch when it wasn't set. Detected is false
+// for explicit gravities, and ok is false if none could be detected.
+func BatchOriginalGravity(datastore Datastore, batch Batch) (og float64, detected bool, ok bool, err error) {
+	if batch.OriginalGravity != 0 {
+		return batch.OriginalGravity, false, true, nil
+	}
+
+	query := MetricQuery{From: batch.Started, Limit: detectionReadings}
+	if batch.Ended != nil {
+		query.To = *batch.Ended
+	}
+	metrics, err := datastore.GetDeviceMetrics(batch.DeviceID, query)
+	if err != nil {
+		return 0, false, false, err
+	}
+	og, ok = DetectOriginalGravity(metrics)
+	return og, true, ok, nil
+}
+
+// DeviceOriginalGravity returns the original gravity of the device's active
+// batch, or detected from the device's first readings without one
+func DeviceOriginalGravity(datastore Datastore, id string) (og float64, detected bool, ok bool, err error) {
+	batch, err := datastore.GetActiveBatch(id)
+	if err == sql.ErrNoRows {
+		batch = Batch{DeviceID: id, Started: time.Unix(0, 0)}
+	} else if err != nil {
+		return 0, false, false, err
+	}
+	return BatchOriginalGravity(datastore, batch)
+}
+
+// BatchAttenuation returns the attenuation at the batch's latest metric, or
+// nil when the batch has no metrics or its original gravity is unknown
+func BatchAttenuation(datastore Datastore, batch Batch) (*Attenuation, error) {
+	query := MetricQuery{To: time.Now(), Limit: 1}
+	if batch.Ended != nil {
+		query.To = *batch.Ended
+	}
+	metrics, err := datastore.GetDeviceMetrics(batch.DeviceID, query)
+	if err != nil || len(metrics) == 0 || metrics[0].Created.Before(batch.Started) {
+		return nil, err
+	}
+
+	og, detected, ok, err := BatchOriginalGravity(datastore, batch)
+	if err != nil || !ok {
+		return nil, err
+	}
+	return NewAttenuation(og, detected, metrics[0]), nil
+}
+
+// DeviceAttenuation returns the attenuation of the metric recorded by the
+// device, or nil when the original gravity is unknown
+func DeviceAttenuation(datastore Datastore, id string, metric Metric) (*Attenuation, error) {
+	og, detected, ok, err := DeviceOriginalGravity(datastore, id)
+	if err != nil || !ok {
+		return nil, err
+	}
+	return NewAttenuation(og, detected, metric), nil
+}
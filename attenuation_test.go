@@ -0,0 +1,105 @@
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestAttenuationFormulas(t *testing.T) {
+	tests := []struct {
+		og           float64
+		fg           float64
+		abv          float64
+		abvAlternate float64
+		apparent     float64
+		real         float64
+	}{
+		{1.050, 1.010, 5.25, 5.34, 80.0, 65.0},
+		{1.080, 1.015, 8.53, 9.10, 81.3, 66.0},
+		{1.040, 1.040, 0, 0, 0, 0},
+		{1.000, 1.000, 0, 0, 0, 0},
+	}
+	for _, test := range tests {
+		a := NewAttenuation(test.og, false, Metric{Gravity: test.fg})
+		if a.ABV != test.abv {
+			t.Errorf("OG %.3f FG %.3f: ABV %.2f, want %.2f", test.og, test.fg, a.ABV, test.abv)
+		}
+		if a.ABVAlternate != test.abvAlternate {
+			t.Errorf("OG %.3f FG %.3f: alternate ABV %.2f, want %.2f", test.og, test.fg, a.ABVAlternate, test.abvAlternate)
+		}
+		if a.ApparentAttenuation != test.apparent {
+			t.Errorf("OG %.3f FG %.3f: apparent attenuation %.1f, want %.1f", test.og, test.fg, a.ApparentAttenuation, test.apparent)
+		}
+		if math.Abs(a.RealAttenuation-test.real) > 0.5 {
+			t.Errorf("OG %.3f FG %.3f: real attenuation %.1f, want %.1f", test.og, test.fg, a.RealAttenuation, test.real)
+		}
+	}
+}
+
+func TestDetectOriginalGravity(t *testing.T) {
+	tests := []struct {
+		name     string
+		gravity  []float64
+		og       float64
+		detected bool
+	}{
+		{"too few readings", []float64{1.050, 1.050}, 0, false},
+		{"stable from the start", []float64{1.050, 1.051, 1.049, 1.040}, 1.050, true},
+		{"settling readings skipped", []float64{1.020, 1.070, 1.056, 1.055, 1.056, 1.057}, 1.0557, true},
+		{"never stable", []float64{1.060, 1.050, 1.040, 1.030, 1.020}, 0, false},
+		{"tolerance is inclusive", []float64{1.048, 1.050, 1.049}, 1.049, true},
+		{"outside the tolerance", []float64{1.047, 1.050, 1.049}, 0, false},
+	}
+	for _, test := range tests {
+		metrics := []Metric{}
+		for _, gravity := range test.gravity {
+			metrics = append(metrics, Metric{Gravity: gravity})
+		}
+		og, detected := DetectOriginalGravity(metrics)
+		if detected != test.detected || math.Abs(og-test.og) > 1e-9 {
+			t.Errorf("%s: detected %.4f %v, want %.4f %v", test.name, og, detected, test.og, test.detected)
+		}
+	}
+}
+
+func TestBatchOriginalGravity(t *testing.T) {
+	forEachDialect(t, func(t *testing.T, d Datastore) {
+		if err := d.CreateOrUpdateDevice(Device{ID: "tilt", Color: "red"}); err != nil {
+			t.Fatal(err)
+		}
+		started := time.Now().Add(-24 * time.Hour).Round(time.Second)
+		// Readings before the batch are from the previous fermentation
+		gravities := []float64{1.012, 1.012, 1.012, 1.030, 1.062, 1.061, 1.062, 1.050, 1.040}
+		for i, gravity := range gravities {
+			created := started.Add(time.Duration(i-3) * time.Hour)
+			if err := d.CreateMetric(Metric{DeviceID: "tilt", Gravity: gravity, Temperature: 68, Created: created}); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		og, detected, ok, err := BatchOriginalGravity(d, Batch{DeviceID: "tilt", Started: started, OriginalGravity: 1.058})
+		if err != nil || og != 1.058 || detected || !ok {
+			t.Errorf("explicit original gravity %.4f %v %v, %v", og, detected, ok, err)
+		}
+
+		og, detected, ok, err = BatchOriginalGravity(d, Batch{DeviceID: "tilt", Started: started})
+		if err != nil || math.Abs(og-1.0617) > 1e-9 || !detected || !ok {
+			t.Errorf("detected original gravity %.4f %v %v, %v", og, detected, ok, err)
+		}
+
+		ended := started.Add(2 * time.Hour)
+		og, detected, ok, err = BatchOriginalGravity(d, Batch{DeviceID: "tilt", Started: started, Ended: &ended})
+		if err != nil || ok {
+			t.Errorf("detected original gravity %.4f %v %v from too few readings, %v", og, detected, ok, err)
+		}
+
+		a, err := BatchAttenuation(d, Batch{DeviceID: "tilt", Started: started, OriginalGravity: 1.060})
+		if err != nil || a == nil {
+			t.Fatalf("batch attenuation %+v, %v", a, err)
+		}
+		if a.Gravity != 1.040 || a.ABV != 2.63 || a.ApparentAttenuation != 33.3 {
+			t.Errorf("batch attenuation %+v", a)
+		}
+	})
+}
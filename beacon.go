@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/currantlabs/ble"
+)
+
+const (
+	// BeaconPrefix is the Apple company ID followed by the iBeacon type and length
+	BeaconPrefix = "4c000215"
+	// BeaconLength is the size of the manufacturer data in an iBeacon advertisement
+	BeaconLength = 25
+)
+
+// Beacon is a reading decoded from a tilt iBeacon advertisement. Tilts encode
+// their color in the proximity UUID (a495bb<color>c5b14b44b5121370f02d74de, so
+// the bytes of the GATT color code swapped), the temperature in °F as the major
+// field and the gravity * 1000 as the minor field.
+type Beacon struct {
+	Color       string
+	Temperature int
+	Gravity     float64
+	TxPower     int
+}
+
+// IsTiltBeacon reports whether the manufacturer data belongs to a tilt
+func IsTiltBeacon(data []byte) bool {
+	_, err := ParseBeacon(data)
+	return err == nil
+}
+
+// ParseBeacon decodes the manufacturer data of a tilt iBeacon advertisement
+func ParseBeacon(data []byte) (*Beacon, error) {
+	if len(data) != BeaconLength {
+		return nil, fmt.Errorf("Unexpected manufacturer data length: %d", len(data))
+	}
+	if hex.EncodeToString(data[0:4]) != BeaconPrefix {
+		return nil, fmt.Errorf("Not an iBeacon advertisement")
+	}
+
+	uuid := hex.EncodeToString(data[4:20])
+	if uuid[0:4] != "a495" || uuid[8:] != TemperatureID[8:] {
+		return nil, fmt.Errorf("Not a tilt iBeacon: %s", uuid)
+	}
+	// The UUID has the color code's bytes the other way round, bb10 for 10bb
+	color, ok := colorName(uuid[6:8] + uuid[4:6])
+	if !ok {
+		return nil, fmt.Errorf("Unknown tilt color: %s", uuid[4:8])
+	}
+
+	return &Beacon{
+		Color:       color,
+		Temperature: int(binary.BigEndian.Uint16(data[20:22])),
+		Gravity:     float64(binary.BigEndian.Uint16(data[22:24])) / 1000.0,
+		TxPower:     int(int8(data[24])),
+	}, nil
+}
+
+// BeaconTransport discovers tilts and reads their metrics from iBeacon
+// advertisements, without ever connecting to them
+type BeaconTransport struct {
+	// maxAge is how old an advertisement can be before it's no longer read
+	maxAge time.Duration
+
+	mu       sync.Mutex
+	readings map[string]Metric
+}
+
+// NewBeaconTransport returns a transport using the default BLE device, reading
+// advertisements received within maxAge, so tilts gone out of range fail to be
+// read rather than repeating their last reading
+func NewBeaconTransport(maxAge time.Duration) *BeaconTransport {
+	return &BeaconTransport{maxAge: maxAge, readings: make(map[string]Metric)}
+}
+
+// Scan records the latest reading advertised by every tilt in range
+func (b *BeaconTransport) Scan(ctx context.Context, known func(string) bool, found func(*TiltClient)) error {
+	queued := map[string]bool{}
+	return ble.Scan(ctx, true, func(a ble.Advertisement) {
+		id := a.Address().String()
+		beacon, err := ParseBeacon(a.ManufacturerData())
+		if err != nil {
+			log.Debugf("[beacon] Ignoring advertisement from %s: %s", id, err)
+			return
+		}
+
+		b.mu.Lock()
+		b.readings[id] = Metric{
+			DeviceID:    id,
+			Power:       a.RSSI(),
+			Temperature: float64(beacon.Temperature),
+			Gravity:     beacon.Gravity,
+			Created:     time.Now(),
+		}
+		b.mu.Unlock()
+
+		if !known(id) && !queued[id] {
+			log.Debugf("[beacon] Found tilt: %s", id)
+			queued[id] = true
+			found(&TiltClient{Address: a.Address(), Color: beacon.Color})
+		}
+	}, func(a ble.Advertisement) bool {
+		return IsTiltBeacon(a.ManufacturerData())
+	})
+}
+
+// ReadMetrics returns the metrics from the most recent advertisement, timed
+// when it was received
+func (b *BeaconTransport) ReadMetrics(tilt *TiltClient) (Metric, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	metric, ok := b.readings[tilt.Address.String()]
+	if !ok {
+		return Metric{DeviceID: tilt.Address.String()}, fmt.Errorf("No advertisement received from tilt: %s", tilt.Address)
+	}
+	if age := time.Since(metric.Created); b.maxAge > 0 && age > b.maxAge {
+		return Metric{DeviceID: tilt.Address.String()}, fmt.Errorf("No advertisement received from tilt %s in %s", tilt.Address, age.Round(time.Second))
+	}
+	return metric, nil
+}
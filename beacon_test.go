@@ -0,0 +1,68 @@
+package main
+
+import (
+	"encoding/hex"
+	"testing"
+	"time"
+)
+
+func TestParseBeacon(t *testing.T) {
+	// Advertisements captured from tilts, which differ only in their color
+	for code, color := range map[string]string{
+		"bb10": "red",
+		"bb20": "green",
+		"bb30": "black",
+		"bb40": "purple",
+		"bb50": "orange",
+		"bb60": "blue",
+		"bb70": "yellow",
+		"bb80": "pink",
+	} {
+		data, _ := hex.DecodeString("4c000215a495" + code + "c5b14b44b5121370f02d74de0044041ac5")
+		beacon, err := ParseBeacon(data)
+		if err != nil {
+			t.Fatalf("%s: %s", color, err)
+		}
+		if beacon.Color != color || beacon.Temperature != 68 || beacon.Gravity != 1.050 || beacon.TxPower != -59 {
+			t.Errorf("%s: got %+v", color, beacon)
+		}
+		if !IsTiltBeacon(data) {
+			t.Errorf("%s: not a tilt beacon", color)
+		}
+	}
+}
+
+func TestParseBeaconRejects(t *testing.T) {
+	for name, payload := range map[string]string{
+		"short":         "4c000215a495bb10c5b14b44b5121370f02d74de0044041a",
+		"not ibeacon":   "4c000815a495bb10c5b14b44b5121370f02d74de0044041ac5",
+		"other uuid":    "4c000215e2c56db5dffb48d2b060d0f5a71096e00044041ac5",
+		"unknown color": "4c000215a495bb90c5b14b44b5121370f02d74de0044041ac5",
+		"gatt order":    "4c000215a49510bbc5b14b44b5121370f02d74de0044041ac5",
+	} {
+		data, _ := hex.DecodeString(payload)
+		if _, err := ParseBeacon(data); err == nil {
+			t.Errorf("%s: parsed %s", name, payload)
+		}
+	}
+}
+
+func TestBeaconTransportReadMetrics(t *testing.T) {
+	b := NewBeaconTransport(5 * time.Minute)
+	fresh, stale := testTilt(1), testTilt(2)
+	received := time.Now().Add(-time.Minute)
+	b.readings[fresh.Address.String()] = Metric{DeviceID: fresh.Address.String(), Gravity: 1.050, Created: received}
+	b.readings[stale.Address.String()] = Metric{DeviceID: stale.Address.String(), Gravity: 1.050, Created: time.Now().Add(-time.Hour)}
+
+	metric, err := b.ReadMetrics(fresh)
+	if err != nil || metric.Gravity != 1.050 || !metric.Created.Equal(received) {
+		t.Errorf("fresh reading %+v, %v", metric, err)
+	}
+	// Tilts gone out of range don't repeat their last reading
+	if metric, err := b.ReadMetrics(stale); err == nil {
+		t.Errorf("stale reading %+v", metric)
+	}
+	if metric, err := b.ReadMetrics(testTilt(3)); err == nil {
+		t.Errorf("unadvertised reading %+v", metric)
+	}
+}
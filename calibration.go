@@ -0,0 +1,165 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"time"
+)
+
+// MaxCalibrationDegree caps the polynomial fitted through calibration points
+const MaxCalibrationDegree = 2
+
+// CalibrationPoint pairs a raw gravity reading with the actual gravity
+// measured by hydrometer or refractometer at the same time
+type CalibrationPoint struct {
+	ID       int       `json:"id" db:"id"`
+	DeviceID string    `json:"-" db:"device_id"`
+	Raw      float64   `json:"raw" db:"raw"`
+	Actual   float64   `json:"actual" db:"actual"`
+	Fitted   float64   `json:"fitted" db:"-"`
+	Created  time.Time `json:"created" db:"created"`
+}
+
+// Calibration corrects the readings of a device. With calibration points, a
+// polynomial of up to MaxCalibrationDegree is fitted through the gravity
+// error (actual - raw) at each point; otherwise GravityOffset is added.
+type Calibration struct {
+	GravityOffset     float64            `json:"gravity_offset"`
+	TemperatureOffset float64            `json:"temperature_offset"`
+	Points            []CalibrationPoint `json:"points"`
+	// Coefficients of the gravity error polynomial in (raw - 1), lowest
+	// order first
+	Coefficients []float64 `json:"coefficients"`
+}
+
+// NewCalibration fits the device's calibration points
+func NewCalibration(device Device, points []CalibrationPoint) (Calibration, error) {
+	c := Calibration{
+		GravityOffset:     device.GravityOffset,
+		TemperatureOffset: device.TemperatureOffset,
+		Points:            points,
+		Coefficients:      []float64{},
+	}
+	if len(points) == 0 {
+		return c, nil
+	}
+
+	xs := make([]float64, len(points))
+	ys := make([]float64, len(points))
+	distinct := map[float64]bool{}
+	for i, p := range points {
+		xs[i] = p.Raw - 1
+		ys[i] = p.Actual - p.Raw
+		distinct[math.Round(p.Raw*10000)] = true
+	}
+
+	// Repeated raw readings are averaged, so only distinct ones add a degree
+	degree := len(distinct) - 1
+	if degree > MaxCalibrationDegree {
+		degree = MaxCalibrationDegree
+	}
+	coefficients, err := fitPolynomial(xs, ys, degree)
+	if err != nil {
+		return c, err
+	}
+	c.Coefficients = coefficients
+
+	for i := range c.Points {
+		c.Points[i].Fitted = c.Gravity(c.Points[i].Raw)
+	}
+	return c, nil
+}
+
+// LoadCalibration fits the calibration stored for the device
+func LoadCalibration(datastore Datastore, deviceID string) (Calibration, error) {
+	device, err := datastore.GetDevice(deviceID)
+	if err != nil {
+		return Calibration{}, err
+	}
+	points, err := datastore.GetCalibrationPoints(deviceID)
+	if err != nil {
+		return Calibration{}, err
+	}
+	return NewCalibration(device, points)
+}
+
+// Gravity returns the corrected gravity for a raw reading
+func (c Calibration) Gravity(raw float64) float64 {
+	correction := c.GravityOffset
+	if len(c.Coefficients) > 0 {
+		correction = 0
+		for i, coefficient := range c.Coefficients {
+			correction += coefficient * math.Pow(raw-1, float64(i))
+		}
+	}
+	return math.Round((raw+correction)*10000) / 10000
+}
+
+// Temperature returns the corrected temperature for a raw reading, to a
+// tenth of a degree so fractional offsets aren't lost
+func (c Calibration) Temperature(raw float64) float64 {
+	return math.Round((raw+c.TemperatureOffset)*10) / 10
+}
+
+// Apply corrects the metric, keeping its raw readings
+func (c Calibration) Apply(metric Metric) Metric {
+	metric.RawGravity = metric.Gravity
+	metric.RawTemperature = metric.Temperature
+	metric.Gravity = c.Gravity(metric.RawGravity)
+	metric.Temperature = c.Temperature(metric.RawTemperature)
+	return metric
+}
+
+// fitPolynomial returns the least squares coefficients, lowest order first,
+// of the polynomial of the given degree through the points
+func fitPolynomial(xs []float64, ys []float64, degree int) ([]float64, error) {
+	n := degree + 1
+	if len(xs) < n {
+		return nil, fmt.Errorf("At least %d points are needed to fit degree %d", n, degree)
+	}
+
+	// Build the normal equations as an augmented matrix
+	matrix := make([][]float64, n)
+	for row := range matrix {
+		matrix[row] = make([]float64, n+1)
+		for col := 0; col < n; col++ {
+			for _, x := range xs {
+				matrix[row][col] += math.Pow(x, float64(row+col))
+			}
+		}
+		for i, x := range xs {
+			matrix[row][n] += ys[i] * math.Pow(x, float64(row))
+		}
+	}
+
+	// Gaussian elimination with partial pivoting
+	for col := 0; col < n; col++ {
+		pivot := col
+		for row := col + 1; row < n; row++ {
+			if math.Abs(matrix[row][col]) > math.Abs(matrix[pivot][col]) {
+				pivot = row
+			}
+		}
+		if math.Abs(matrix[pivot][col]) < 1e-18 {
+			return nil, fmt.Errorf("Calibration points do not determine a unique fit")
+		}
+		matrix[col], matrix[pivot] = matrix[pivot], matrix[col]
+
+		for row := col + 1; row < n; row++ {
+			factor := matrix[row][col] / matrix[col][col]
+			for k := col; k <= n; k++ {
+				matrix[row][k] -= factor * matrix[col][k]
+			}
+		}
+	}
+
+	coefficients := make([]float64, n)
+	for row := n - 1; row >= 0; row-- {
+		sum := matrix[row][n]
+		for col := row + 1; col < n; col++ {
+			sum -= matrix[row][col] * coefficients[col]
+		}
+		coefficients[row] = sum / matrix[row][row]
+	}
+	return coefficients, nil
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestFitPolynomial(t *testing.T) {
+	tests := []struct {
+		name   string
+		xs     []float64
+		ys     []float64
+		degree int
+		want   []float64
+	}{
+		{"constant", []float64{1, 2, 3}, []float64{2, 4, 6}, 0, []float64{4}},
+		{"line", []float64{0, 1, 2}, []float64{1, 3, 5}, 1, []float64{1, 2}},
+		{"line through noise", []float64{0, 1, 2, 3}, []float64{0, 1.5, 1.5, 3}, 1, []float64{0.15, 0.9}},
+		{"quadratic", []float64{-1, 0, 1, 2}, []float64{6, 3, 2, 3}, 2, []float64{3, -2, 1}},
+	}
+	for _, test := range tests {
+		got, err := fitPolynomial(test.xs, test.ys, test.degree)
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+		if len(got) != len(test.want) {
+			t.Errorf("%s: got coefficients %v, want %v", test.name, got, test.want)
+			continue
+		}
+		for i := range got {
+			if math.Abs(got[i]-test.want[i]) > 1e-9 {
+				t.Errorf("%s: got coefficients %v, want %v", test.name, got, test.want)
+				break
+			}
+		}
+	}
+}
+
+func TestFitPolynomialRejectsUnderdetermined(t *testing.T) {
+	if _, err := fitPolynomial([]float64{1}, []float64{1}, 1); err == nil {
+		t.Error("Fitting a line through one point succeeded")
+	}
+	if _, err := fitPolynomial([]float64{1, 1}, []float64{1, 2}, 1); err == nil {
+		t.Error("Fitting a line through one repeated x succeeded")
+	}
+}
+
+func TestNewCalibration(t *testing.T) {
+	device := Device{GravityOffset: 0.003, TemperatureOffset: -1.5}
+	tests := []struct {
+		name         string
+		points       [][2]float64
+		coefficients int
+		// gravity maps raw readings to their expected corrections
+		gravity map[float64]float64
+	}{
+		{
+			name:   "no points uses the offset",
+			points: nil,
+			gravity: map[float64]float64{
+				1.050: 1.053,
+				1.010: 1.013,
+			},
+		},
+		{
+			name:         "one point shifts every reading",
+			points:       [][2]float64{{1.050, 1.048}},
+			coefficients: 1,
+			gravity: map[float64]float64{
+				1.050: 1.048,
+				1.010: 1.008,
+			},
+		},
+		{
+			name:         "two points fit a line",
+			points:       [][2]float64{{1.010, 1.010}, {1.050, 1.054}},
+			coefficients: 2,
+			gravity: map[float64]float64{
+				1.010: 1.010,
+				1.030: 1.032,
+				1.050: 1.054,
+			},
+		},
+		{
+			name:         "three points fit a quadratic",
+			points:       [][2]float64{{1.000, 1.000}, {1.020, 1.022}, {1.040, 1.048}},
+			coefficients: 3,
+			gravity: map[float64]float64{
+				1.000: 1.000,
+				1.020: 1.022,
+				1.040: 1.048,
+			},
+		},
+		{
+			name:         "more points are capped at a quadratic",
+			points:       [][2]float64{{1.000, 1.000}, {1.010, 1.011}, {1.020, 1.022}, {1.030, 1.033}, {1.040, 1.044}},
+			coefficients: MaxCalibrationDegree + 1,
+			gravity: map[float64]float64{
+				1.000: 1.000,
+				1.020: 1.022,
+				1.040: 1.044,
+			},
+		},
+		{
+			name:         "repeated raw readings are averaged",
+			points:       [][2]float64{{1.050, 1.046}, {1.050, 1.048}},
+			coefficients: 1,
+			gravity: map[float64]float64{
+				1.050: 1.047,
+				1.010: 1.007,
+			},
+		},
+		{
+			name:         "repeated raw readings only add one degree",
+			points:       [][2]float64{{1.010, 1.010}, {1.010, 1.012}, {1.050, 1.055}},
+			coefficients: 2,
+			gravity: map[float64]float64{
+				1.010: 1.011,
+				1.050: 1.055,
+			},
+		},
+	}
+	for _, test := range tests {
+		points := []CalibrationPoint{}
+		for _, p := range test.points {
+			points = append(points, CalibrationPoint{Raw: p[0], Actual: p[1]})
+		}
+		c, err := NewCalibration(device, points)
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+		if len(c.Coefficients) != test.coefficients {
+			t.Errorf("%s: got %d coefficients, want %d", test.name, len(c.Coefficients), test.coefficients)
+		}
+		for raw, want := range test.gravity {
+			if got := c.Gravity(raw); math.Abs(got-want) > 0.00011 {
+				t.Errorf("%s: %.3f corrected to %.4f, want %.4f", test.name, raw, got, want)
+			}
+		}
+		for _, p := range c.Points {
+			if p.Fitted != c.Gravity(p.Raw) {
+				t.Errorf("%s: point %.3f fitted as %.4f, want %.4f", test.name, p.Raw, p.Fitted, c.Gravity(p.Raw))
+			}
+		}
+		if got := c.Temperature(68); got != 66.5 {
+			t.Errorf("%s: 68°F corrected to %.1f, want 66.5", test.name, got)
+		}
+	}
+}
+
+func TestCalibrationApply(t *testing.T) {
+	tests := []struct {
+		name        string
+		calibration Calibration
+		metric      Metric
+		gravity     float64
+		temperature float64
+	}{
+		{
+			name:        "uncalibrated",
+			calibration: Calibration{},
+			metric:      Metric{Gravity: 1.050, Temperature: 68},
+			gravity:     1.050,
+			temperature: 68,
+		},
+		{
+			name:        "offsets",
+			calibration: Calibration{GravityOffset: -0.002, TemperatureOffset: 0.4},
+			metric:      Metric{Gravity: 1.050, Temperature: 68},
+			gravity:     1.048,
+			temperature: 68.4,
+		},
+		{
+			name:        "coefficients replace the gravity offset",
+			calibration: Calibration{GravityOffset: 0.010, Coefficients: []float64{0.001}},
+			metric:      Metric{Gravity: 1.050, Temperature: 68},
+			gravity:     1.051,
+			temperature: 68,
+		},
+	}
+	for _, test := range tests {
+		got := test.calibration.Apply(test.metric)
+		if math.Abs(got.Gravity-test.gravity) > 1e-9 {
+			t.Errorf("%s: gravity %.4f, want %.4f", test.name, got.Gravity, test.gravity)
+		}
+		if math.Abs(got.Temperature-test.temperature) > 1e-9 {
+			t.Errorf("%s: temperature %.1f, want %.1f", test.name, got.Temperature, test.temperature)
+		}
+		if got.RawGravity != test.metric.Gravity || got.RawTemperature != test.metric.Temperature {
+			t.Errorf("%s: raw readings %.4f and %.1f, want %.4f and %.1f",
+				test.name, got.RawGravity, got.RawTemperature, test.metric.Gravity, test.metric.Temperature)
+		}
+	}
+}
@@ -2,104 +2,265 @@ package main
 
 import (
 	_ "database/sql"
+	"fmt"
+	"math"
+	"strings"
 	"time"
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/jmoiron/sqlx"
-	_ "github.com/mattn/go-sqlite3"
 )
 
-type Datastore struct {
-	db       *sqlx.DB
-	filename string
+// Datastore persists devices, their metrics and batches
+type Datastore interface {
+	Close()
+	SchemaVersion() (int, error)
+	Migrate(dryRun bool) ([]Migration, error)
+
+	GetDevices() ([]Device, error)
+	GetDevicesWithMetrics() ([]Device, error)
+	GetDevice(id string) (Device, error)
+	CreateOrUpdateDevice(device Device) error
+	UpdateDevice(device Device) error
+	DeleteDevice(id string) error
+	SetDeviceError(id string, errorMsg string) error
+	DisableDevice(id string, reason string) error
+	SetDeviceCalibration(id string, gravityOffset float64, temperatureOffset float64) error
+	SetDeviceStage(id string, fermentation Fermentation) error
+	GetCalibrationPoints(deviceID string) ([]CalibrationPoint, error)
+	CreateCalibrationPoint(point CalibrationPoint) (CalibrationPoint, error)
+	DeleteCalibrationPoint(deviceID string, id int) error
+
+	CreateMetric(metric Metric) error
+	GetDeviceMetrics(id string, query MetricQuery) ([]Metric, error)
+	GetDeviceMetricBuckets(id string, query MetricQuery, interval time.Duration) ([]MetricBucket, error)
+	GetDeviceLatestMetrics(id string) (Metric, error)
+	GetDeviceMetricsBetween(id string, from time.Time, to time.Time) ([]Metric, error)
+	ApplyRetention(policy RetentionPolicy, now time.Time) (RetentionReport, error)
+
+	GetBatches() ([]Batch, error)
+	GetDeviceBatches(deviceID string) ([]Batch, error)
+	GetBatch(id int) (Batch, error)
+	GetActiveBatch(deviceID string) (Batch, error)
+	CreateBatch(batch Batch) (Batch, error)
+	UpdateBatch(batch Batch) error
+	EndBatch(id int) error
+	DeleteBatch(id int) error
+	GetBatchMetrics(batch Batch) ([]Metric, error)
+
+	GetAlertRules() ([]AlertRule, error)
+	GetAlertRule(id int) (AlertRule, error)
+	CreateAlertRule(rule AlertRule) (AlertRule, error)
+	UpdateAlertRule(rule AlertRule) error
+	DeleteAlertRule(id int) error
+	GetAlerts(states ...string) ([]Alert, error)
+	GetOpenAlert(ruleID int, deviceID string) (Alert, error)
+	CreateAlert(alert Alert) (Alert, error)
+	UpdateAlert(alert Alert) error
+	DeleteAlert(id int) error
+
+	GetNotifiers() ([]Notifier, error)
+	GetNotifier(id int) (Notifier, error)
+	CreateNotifier(notifier Notifier) (Notifier, error)
+	UpdateNotifier(notifier Notifier) error
+	DeleteNotifier(id int) error
+
+	CreateOutboxMessage(message OutboxMessage) (OutboxMessage, error)
+	GetOutboxMessages(state string, destination string) ([]OutboxMessage, error)
+	GetOutboxMessage(id int) (OutboxMessage, error)
+	UpdateOutboxMessage(message OutboxMessage) error
+	DeleteOutboxMessage(id int) error
+	PurgeOutboxMessages(state string, destination string) (int64, error)
+}
+
+// SQLDatastore implements Datastore on SQLite or PostgreSQL
+type SQLDatastore struct {
+	db      *sqlx.DB
+	dialect dialect
 }
 
 type Device struct {
-	ID           string    `json:"id" db:"id"`
-	Name         string    `json:"name" db:"name"`
-	Color        string    `json:"color" db:"color"`
-	Endpoint     string    `json:"endpoint" db:"endpoint"`
-	Disabled     bool      `json:"disabled" db:"disabled"`
-	Error        string    `json:"error" db:"error"`
-	LatestMetric Metric    `json:"latest_metrics" db:"latest"`
-	Created      time.Time `json:"created" db:"created"`
-	Updated      time.Time `json:"updated" db:"updated"`
+	ID                string       `json:"id" db:"id"`
+	Name              string       `json:"name" db:"name"`
+	Color             string       `json:"color" db:"color"`
+	Endpoint          string       `json:"endpoint" db:"endpoint"`
+	EndpointFormat    string       `json:"endpoint_format" db:"endpoint_format"`
+	PollInterval      int          `json:"poll_interval" db:"poll_interval"`
+	Disabled          bool         `json:"disabled" db:"disabled"`
+	Error             string       `json:"error" db:"error"`
+	GravityOffset     float64      `json:"gravity_offset" db:"gravity_offset"`
+	TemperatureOffset float64      `json:"temperature_offset" db:"temperature_offset"`
+	GravityUnits      string       `json:"gravity_units" db:"gravity_units"`
+	TemperatureUnits  string       `json:"temperature_units" db:"temperature_units"`
+	Stage             string       `json:"stage" db:"stage"`
+	Stalled           bool         `json:"stalled" db:"stalled"`
+	TerminalGravity   bool         `json:"terminal_gravity" db:"terminal_gravity"`
+	LatestMetric      Metric       `json:"latest_metrics" db:"latest"`
+	Attenuation       *Attenuation `json:"attenuation,omitempty" db:"-"`
+	Created           time.Time    `json:"created" db:"created"`
+	Updated           time.Time    `json:"updated" db:"updated"`
 }
 
 type Metric struct {
-	ID          int       `json:"-" db:"id"`
-	DeviceID    string    `json:"-" db:"device_id"`
-	Power       int       `json:"power" db:"power"`
-	Battery     int       `json:"battery" db:"battery"`
-	Temperature int       `json:"temperature" db:"temperature"`
-	Gravity     float64   `json:"gravity" db:"gravity"`
-	Created     time.Time `json:"created" db:"created"`
+	ID             int       `json:"-" db:"id"`
+	DeviceID       string    `json:"-" db:"device_id"`
+	Power          int       `json:"power" db:"power"`
+	Battery        int       `json:"battery" db:"battery"`
+	Temperature    float64   `json:"temperature" db:"temperature"`
+	Gravity        float64   `json:"gravity" db:"gravity"`
+	RawTemperature float64   `json:"raw_temperature" db:"raw_temperature"`
+	RawGravity     float64   `json:"raw_gravity" db:"raw_gravity"`
+	Created        time.Time `json:"created" db:"created"`
+}
+
+// MetricQuery filters and pages the metrics of a device
+type MetricQuery struct {
+	From   time.Time
+	To     time.Time
+	Cursor int64
+	Limit  int
 }
 
-func NewDatastore(filename string) *Datastore {
-	db, err := sqlx.Open("sqlite3", filename)
+// MetricBucket summarises the metrics recorded during one interval
+type MetricBucket struct {
+	Bucket         int64     `json:"-" db:"bucket"`
+	Start          time.Time `json:"start" db:"-"`
+	Count          int       `json:"count" db:"count"`
+	MinGravity     float64   `json:"min_gravity" db:"min_gravity"`
+	MaxGravity     float64   `json:"max_gravity" db:"max_gravity"`
+	AvgGravity     float64   `json:"avg_gravity" db:"avg_gravity"`
+	MinTemperature float64   `json:"min_temperature" db:"min_temperature"`
+	MaxTemperature float64   `json:"max_temperature" db:"max_temperature"`
+	AvgTemperature float64   `json:"avg_temperature" db:"avg_temperature"`
+}
+
+// Batch is a single fermentation tracked by a device between its start and
+// end. A device can only be assigned to one active (unended) batch at a time.
+type Batch struct {
+	ID              int        `json:"id" db:"id"`
+	Name            string     `json:"name" db:"name"`
+	Style           string     `json:"style" db:"style"`
+	DeviceID        string     `json:"device_id" db:"device_id"`
+	Started         time.Time  `json:"started" db:"started"`
+	Ended           *time.Time `json:"ended" db:"ended"`
+	OriginalGravity float64    `json:"original_gravity" db:"original_gravity"`
+	TargetGravity   float64    `json:"target_gravity" db:"target_gravity"`
+	Notes           string     `json:"notes" db:"notes"`
+	Created         time.Time  `json:"created" db:"created"`
+	Updated         time.Time  `json:"updated" db:"updated"`
+	// Attenuation is calculated at the batch's latest metric, not stored
+	Attenuation *Attenuation `json:"attenuation,omitempty" db:"-"`
+}
+
+// overlaps reports whether the batches share any time, batches not yet ended
+// running on forever
+func (b Batch) overlaps(other Batch) bool {
+	startsBefore := other.Ended == nil || b.Started.Before(*other.Ended)
+	endsAfter := b.Ended == nil || other.Started.Before(*b.Ended)
+	return startsBefore && endsAfter
+}
+
+// latest reports whether the query has no starting point, in which case the
+// most recent results are returned
+func (q MetricQuery) latest() bool {
+	return q.From.IsZero() && q.Cursor == 0
+}
+
+// where builds the conditions selecting the device's metrics within the query,
+// comparing cursor against the given column expression
+func (q MetricQuery) where(id string, cursor string) (string, []interface{}) {
+	where := "device_id=?"
+	args := []interface{}{id}
+	if !q.From.IsZero() {
+		where += " AND created>=?"
+		// Stored timestamps are in local time, so compare like for like
+		args = append(args, q.From.Local())
+	}
+	if !q.To.IsZero() {
+		where += " AND created<?"
+		args = append(args, q.To.Local())
+	}
+	if q.Cursor != 0 {
+		where += " AND " + cursor + ">?"
+		args = append(args, q.Cursor)
+	}
+	return where, args
+}
+
+// NewDatastore opens the database, bringing its schema up to date. The source
+// is either the path of a SQLite database or a postgres:// connection URL.
+func NewDatastore(source string) Datastore {
+	d, err := OpenDatastore(source)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	query := `
-	CREATE TABLE IF NOT EXISTS device (
-	id VARCHAR(255) PRIMARY KEY,
-	name VARCHAR(255),
-	color VARCHAR(50),
-	endpoint TEXT,
-	disabled BOOLEAN,
-	error TEXT,
-	created TIMESTAMP,
-	updated TIMESTAMP
-	);
-	CREATE TABLE IF NOT EXISTS metric (
-	id INTEGER PRIMARY KEY,
-	device_id VARCHAR(255) NOT NULL,
-	power INTEGER,
-	battery INTEGER,
-	temperature INTEGER,
-	gravity REAL,
-	created TIMESTAMP
-	);
-	`
-	db.MustExec(query)
+	applied, err := d.Migrate(false)
+	if err != nil {
+		log.Fatalf("Error migrating database: %s", err)
+	}
+	for _, m := range applied {
+		log.Infof("[datastore] Applied migration %d: %s", m.Version, m.Description)
+	}
+
+	return d
+}
+
+// OpenDatastore opens the database without touching its schema
+func OpenDatastore(source string) (Datastore, error) {
+	var dialect dialect = sqliteDialect{}
+	if strings.HasPrefix(source, "postgres://") || strings.HasPrefix(source, "postgresql://") {
+		dialect = postgresDialect{}
+	}
 
-	return &Datastore{
-		db:       db,
-		filename: filename,
+	db, err := dialect.open(source)
+	if err != nil {
+		return nil, err
 	}
+
+	return &SQLDatastore{
+		db:      db,
+		dialect: dialect,
+	}, nil
 }
 
-func (d *Datastore) Close() {
+func (d *SQLDatastore) Close() {
 	d.db.Close()
 }
 
-func (d *Datastore) GetDevices() ([]Device, error) {
+func (d *SQLDatastore) GetDevices() ([]Device, error) {
+	defer observeQuery("GetDevices", time.Now())
 	devices := []Device{}
-	if err := d.db.Select(&devices, "SELECT * FROM device"); err != nil {
+	if err := d.db.Select(&devices, d.db.Rebind("SELECT * FROM device")); err != nil {
 		return devices, err
 	}
 	return devices, nil
 }
 
-func (d *Datastore) GetDevicesWithMetrics() ([]Device, error) {
+func (d *SQLDatastore) GetDevicesWithMetrics() ([]Device, error) {
+	defer observeQuery("GetDevicesWithMetrics", time.Now())
 	query := `
 	SELECT d.*,
 	m1.power AS "latest.power",
 	m1.battery AS "latest.battery",
 	m1.temperature AS "latest.temperature",
 	m1.gravity AS "latest.gravity",
+	m1.raw_temperature AS "latest.raw_temperature",
+	m1.raw_gravity AS "latest.raw_gravity",
 	m1.created AS "latest.created"
 	FROM device d
-  	JOIN metric m1 ON (d.id = m1.device_id)
-  	LEFT OUTER JOIN metric m2 ON (d.id = m2.device_id AND
-    (m1.created < m2.created OR m1.created = m2.created AND m1.id < m2.id))
-    WHERE m2.id IS NULL;
+	JOIN metric m1 ON m1.id = (
+	SELECT m2.id FROM metric m2 WHERE m2.device_id = d.id
+	ORDER BY m2.created DESC, m2.id DESC LIMIT 1
+	);
 	`
 
 	devices := []Device{}
 	rows, err := d.db.Queryx(query)
+	if err != nil {
+		return devices, err
+	}
+	defer rows.Close()
 	for rows.Next() {
 		device := Device{}
 		if err := rows.StructScan(&device); err != nil {
@@ -108,18 +269,20 @@ func (d *Datastore) GetDevicesWithMetrics() ([]Device, error) {
 
 		devices = append(devices, device)
 	}
-	return devices, err
+	return devices, rows.Err()
 }
 
-func (d *Datastore) GetDevice(id string) (Device, error) {
+func (d *SQLDatastore) GetDevice(id string) (Device, error) {
+	defer observeQuery("GetDevice", time.Now())
 	device := Device{}
-	err := d.db.Get(&device, "SELECT * FROM device WHERE id=$1", id)
+	err := d.db.Get(&device, d.db.Rebind("SELECT * FROM device WHERE id=?"), id)
 	return device, err
 }
 
-func (d *Datastore) CreateOrUpdateDevice(device Device) error {
-	statement, _ := d.db.Prepare("INSERT OR IGNORE INTO device VALUES (?,?,?,?,?,?,?,?)")
-	_, err := statement.Exec(
+func (d *SQLDatastore) CreateOrUpdateDevice(device Device) error {
+	defer observeQuery("CreateOrUpdateDevice", time.Now())
+	_, err := d.db.Exec(
+		d.db.Rebind(d.dialect.insertIgnore("INSERT INTO device (id, name, color, endpoint, disabled, error, created, updated) VALUES (?,?,?,?,?,?,?,?)")),
 		device.ID,
 		device.Name,
 		device.Color,
@@ -136,54 +299,608 @@ func (d *Datastore) CreateOrUpdateDevice(device Device) error {
 	return d.UpdateDevice(device)
 }
 
-func (d *Datastore) UpdateDevice(device Device) error {
-	statement, _ := d.db.Prepare("UPDATE device SET name=?, endpoint=?, disabled=?, updated=? WHERE id=?")
-	_, err := statement.Exec(
+func (d *SQLDatastore) UpdateDevice(device Device) error {
+	defer observeQuery("UpdateDevice", time.Now())
+	_, err := d.db.Exec(
+		d.db.Rebind("UPDATE device SET name=?, endpoint=?, endpoint_format=?, poll_interval=?, disabled=?, gravity_units=?, temperature_units=?, updated=? WHERE id=?"),
 		device.Name,
 		device.Endpoint,
+		device.EndpointFormat,
+		device.PollInterval,
 		device.Disabled,
+		device.GravityUnits,
+		device.TemperatureUnits,
 		time.Now(),
 		device.ID,
 	)
 	return err
 }
 
-func (d *Datastore) DeleteDevice(id string) error {
-	_, err := d.db.Exec("DELETE FROM device WHERE id=$1", id)
+func (d *SQLDatastore) DeleteDevice(id string) error {
+	defer observeQuery("DeleteDevice", time.Now())
+	_, err := d.db.Exec(d.db.Rebind("DELETE FROM device WHERE id=?"), id)
+	return err
+}
+
+func (d *SQLDatastore) SetDeviceError(id string, errorMsg string) error {
+	defer observeQuery("SetDeviceError", time.Now())
+	_, err := d.db.Exec(d.db.Rebind("UPDATE device SET error=? WHERE id=?"), errorMsg, id)
 	return err
 }
 
-func (d *Datastore) SetDeviceError(id string, errorMsg string) error {
-	_, err := d.db.Exec("UPDATE device SET error=$1 WHERE id=$2", errorMsg, id)
+func (d *SQLDatastore) DisableDevice(id string, reason string) error {
+	defer observeQuery("DisableDevice", time.Now())
+	_, err := d.db.Exec(d.db.Rebind("UPDATE device SET disabled=?, error=?, updated=? WHERE id=?"), true, reason, time.Now(), id)
 	return err
 }
 
-func (d *Datastore) CreateMetric(metric Metric) error {
-	statement, _ := d.db.Prepare("INSERT INTO metric (device_id, power, battery, temperature, gravity, created) VALUES (?,?,?,?,?,?)")
-	_, err := statement.Exec(
+func (d *SQLDatastore) SetDeviceCalibration(id string, gravityOffset float64, temperatureOffset float64) error {
+	defer observeQuery("SetDeviceCalibration", time.Now())
+	_, err := d.db.Exec(d.db.Rebind("UPDATE device SET gravity_offset=?, temperature_offset=? WHERE id=?"), gravityOffset, temperatureOffset, id)
+	return err
+}
+
+func (d *SQLDatastore) SetDeviceStage(id string, fermentation Fermentation) error {
+	defer observeQuery("SetDeviceStage", time.Now())
+	_, err := d.db.Exec(
+		d.db.Rebind("UPDATE device SET stage=?, stalled=?, terminal_gravity=? WHERE id=?"),
+		fermentation.Stage,
+		fermentation.Stalled,
+		fermentation.TerminalGravity,
+		id,
+	)
+	return err
+}
+
+func (d *SQLDatastore) GetCalibrationPoints(deviceID string) ([]CalibrationPoint, error) {
+	defer observeQuery("GetCalibrationPoints", time.Now())
+	points := []CalibrationPoint{}
+	err := d.db.Select(&points, d.db.Rebind("SELECT * FROM calibration_point WHERE device_id=? ORDER BY raw ASC"), deviceID)
+	return points, err
+}
+
+func (d *SQLDatastore) CreateCalibrationPoint(point CalibrationPoint) (CalibrationPoint, error) {
+	defer observeQuery("CreateCalibrationPoint", time.Now())
+	point.Created = time.Now()
+	id, err := d.dialect.insertID(
+		d.db,
+		"INSERT INTO calibration_point (device_id, raw, actual, created) VALUES (?,?,?,?)",
+		point.DeviceID,
+		point.Raw,
+		point.Actual,
+		point.Created,
+	)
+	point.ID = int(id)
+	return point, err
+}
+
+func (d *SQLDatastore) DeleteCalibrationPoint(deviceID string, id int) error {
+	defer observeQuery("DeleteCalibrationPoint", time.Now())
+	_, err := d.db.Exec(d.db.Rebind("DELETE FROM calibration_point WHERE device_id=? AND id=?"), deviceID, id)
+	return err
+}
+
+func (d *SQLDatastore) CreateMetric(metric Metric) error {
+	defer observeQuery("CreateMetric", time.Now())
+	if metric.Created.IsZero() {
+		metric.Created = time.Now()
+	}
+	// Metrics stored without calibration are their own raw readings
+	if metric.RawGravity == 0 {
+		metric.RawGravity = metric.Gravity
+		metric.RawTemperature = metric.Temperature
+	}
+
+	_, err := d.db.Exec(
+		d.db.Rebind("INSERT INTO metric (device_id, power, battery, temperature, gravity, raw_temperature, raw_gravity, created) VALUES (?,?,?,?,?,?,?,?)"),
 		metric.DeviceID,
 		metric.Power,
 		metric.Battery,
 		metric.Temperature,
 		metric.Gravity,
-		time.Now(),
+		metric.RawTemperature,
+		metric.RawGravity,
+		metric.Created,
 	)
 	if err != nil {
 		return err
 	}
 
-	_, err = d.db.Exec("UPDATE device SET updated=$1 WHERE id=$2", time.Now(), metric.DeviceID)
+	_, err = d.db.Exec(d.db.Rebind("UPDATE device SET updated=? WHERE id=?"), time.Now(), metric.DeviceID)
 	return err
 }
 
-func (d *Datastore) GetDeviceMetrics(id string, limit string) ([]Metric, error) {
+// GetDeviceMetrics returns up to query.Limit metrics in ascending order. Without
+// a From time or Cursor to start at, the most recent metrics are returned.
+func (d *SQLDatastore) GetDeviceMetrics(id string, query MetricQuery) ([]Metric, error) {
+	defer observeQuery("GetDeviceMetrics", time.Now())
 	metrics := []Metric{}
-	err := d.db.Select(&metrics, "SELECT * FROM metric WHERE device_id=$1 ORDER BY created ASC LIMIT $2", id, limit)
+	where, args := query.where(id, "id")
+	args = append(args, query.Limit)
+
+	if query.latest() {
+		err := d.db.Select(&metrics, d.db.Rebind("SELECT * FROM (SELECT * FROM metric WHERE "+where+" ORDER BY id DESC LIMIT ?) AS m ORDER BY id ASC"), args...)
+		return metrics, err
+	}
+	err := d.db.Select(&metrics, d.db.Rebind("SELECT * FROM metric WHERE "+where+" ORDER BY id ASC LIMIT ?"), args...)
 	return metrics, err
 }
 
-func (d *Datastore) GetDeviceLatestMetrics(id string) (Metric, error) {
+// GetDeviceMetricBuckets summarises the device's metrics over buckets of the
+// given interval, aligned to the unix epoch, paging like GetDeviceMetrics with
+// the bucket start (in unix seconds) as the cursor. Whole hour and day
+// intervals include the aggregates of readings compacted by ApplyRetention.
+func (d *SQLDatastore) GetDeviceMetricBuckets(id string, query MetricQuery, interval time.Duration) ([]MetricBucket, error) {
+	defer observeQuery("GetDeviceMetricBuckets", time.Now())
+	buckets := []MetricBucket{}
+	seconds := int64(interval / time.Second)
+	if seconds < 1 {
+		return buckets, fmt.Errorf("Interval must be at least one second")
+	}
+
+	readings := `
+	SELECT ` + d.dialect.epoch("created") + ` AS bucket, 1 AS count,
+	gravity AS min_gravity, gravity AS max_gravity, gravity AS avg_gravity,
+	temperature AS min_temperature, temperature AS max_temperature, temperature AS avg_temperature
+	FROM metric WHERE device_id=?`
+	args := []interface{}{id}
+	if seconds%3600 == 0 {
+		readings += " UNION ALL SELECT " + aggregateColumns + " FROM metric_hourly WHERE device_id=?"
+		args = append(args, id)
+	}
+	if seconds%86400 == 0 {
+		// Daily aggregates only cover the days whose hourly ones were pruned
+		readings += " UNION ALL SELECT " + aggregateColumns + " FROM metric_daily WHERE device_id=? AND bucket + 86400 <= (SELECT COALESCE(MIN(bucket), ?) FROM metric_hourly WHERE device_id=?)"
+		args = append(args, id, int64(math.MaxInt64-86400), id)
+	}
+
+	bucket := fmt.Sprintf("(bucket / %d) * %d", seconds, seconds)
+	where := "1=1"
+	if !query.From.IsZero() {
+		where += " AND bucket>=?"
+		args = append(args, query.From.Unix())
+	}
+	if !query.To.IsZero() {
+		where += " AND bucket<?"
+		args = append(args, query.To.Unix())
+	}
+	if query.Cursor != 0 {
+		where += " AND " + bucket + ">?"
+		args = append(args, query.Cursor)
+	}
+	args = append(args, query.Limit)
+
+	selectBuckets := `
+	SELECT ` + bucket + ` AS bucket,
+	SUM(count) AS count,
+	MIN(min_gravity) AS min_gravity,
+	MAX(max_gravity) AS max_gravity,
+	SUM(avg_gravity * count) * 1.0 / SUM(count) AS avg_gravity,
+	MIN(min_temperature) AS min_temperature,
+	MAX(max_temperature) AS max_temperature,
+	SUM(avg_temperature * count) * 1.0 / SUM(count) AS avg_temperature
+	FROM (` + readings + `) AS readings WHERE ` + where + ` GROUP BY ` + bucket
+
+	var err error
+	if query.latest() {
+		err = d.db.Select(&buckets, d.db.Rebind("SELECT * FROM ("+selectBuckets+" ORDER BY bucket DESC LIMIT ?) AS b ORDER BY bucket ASC"), args...)
+	} else {
+		err = d.db.Select(&buckets, d.db.Rebind(selectBuckets+" ORDER BY bucket ASC LIMIT ?"), args...)
+	}
+	for i := range buckets {
+		buckets[i].Start = time.Unix(buckets[i].Bucket, 0)
+	}
+	return buckets, err
+}
+
+func (d *SQLDatastore) GetDeviceLatestMetrics(id string) (Metric, error) {
+	defer observeQuery("GetDeviceLatestMetrics", time.Now())
 	metric := Metric{}
-	err := d.db.Get(&metric, "SELECT * FROM metric WHERE device_id=$1 ORDER BY created ASC LIMIT 1", id)
+	err := d.db.Get(&metric, d.db.Rebind("SELECT * FROM metric WHERE device_id=? ORDER BY created DESC LIMIT 1"), id)
 	return metric, err
 }
+
+func (d *SQLDatastore) GetDeviceMetricsBetween(id string, from time.Time, to time.Time) ([]Metric, error) {
+	defer observeQuery("GetDeviceMetricsBetween", time.Now())
+	metrics := []Metric{}
+	err := d.db.Select(&metrics, d.db.Rebind("SELECT * FROM metric WHERE device_id=? AND created>=? AND created<=? ORDER BY created ASC"), id, from.Local(), to.Local())
+	return metrics, err
+}
+
+func (d *SQLDatastore) GetBatches() ([]Batch, error) {
+	defer observeQuery("GetBatches", time.Now())
+	batches := []Batch{}
+	err := d.db.Select(&batches, d.db.Rebind("SELECT * FROM batch ORDER BY started DESC"))
+	return batches, err
+}
+
+func (d *SQLDatastore) GetDeviceBatches(deviceID string) ([]Batch, error) {
+	defer observeQuery("GetDeviceBatches", time.Now())
+	batches := []Batch{}
+	err := d.db.Select(&batches, d.db.Rebind("SELECT * FROM batch WHERE device_id=? ORDER BY started DESC"), deviceID)
+	return batches, err
+}
+
+func (d *SQLDatastore) GetBatch(id int) (Batch, error) {
+	defer observeQuery("GetBatch", time.Now())
+	batch := Batch{}
+	err := d.db.Get(&batch, d.db.Rebind("SELECT * FROM batch WHERE id=?"), id)
+	return batch, err
+}
+
+// GetActiveBatch returns the unended batch the device is assigned to
+func (d *SQLDatastore) GetActiveBatch(deviceID string) (Batch, error) {
+	defer observeQuery("GetActiveBatch", time.Now())
+	batch := Batch{}
+	err := d.db.Get(&batch, d.db.Rebind("SELECT * FROM batch WHERE device_id=? AND ended IS NULL ORDER BY started DESC LIMIT 1"), deviceID)
+	return batch, err
+}
+
+func (d *SQLDatastore) CreateBatch(batch Batch) (Batch, error) {
+	defer observeQuery("CreateBatch", time.Now())
+	if batch.Started.IsZero() {
+		batch.Started = time.Now()
+	}
+	batch.Created = time.Now()
+	batch.Updated = batch.Created
+
+	id, err := d.dialect.insertID(
+		d.db,
+		"INSERT INTO batch (name, style, device_id, started, ended, original_gravity, target_gravity, notes, created, updated) VALUES (?,?,?,?,?,?,?,?,?,?)",
+		batch.Name,
+		batch.Style,
+		batch.DeviceID,
+		batch.Started,
+		batch.Ended,
+		batch.OriginalGravity,
+		batch.TargetGravity,
+		batch.Notes,
+		batch.Created,
+		batch.Updated,
+	)
+	batch.ID = int(id)
+	return batch, err
+}
+
+func (d *SQLDatastore) UpdateBatch(batch Batch) error {
+	defer observeQuery("UpdateBatch", time.Now())
+	_, err := d.db.Exec(
+		d.db.Rebind("UPDATE batch SET name=?, style=?, device_id=?, started=?, ended=?, original_gravity=?, target_gravity=?, notes=?, updated=? WHERE id=?"),
+		batch.Name,
+		batch.Style,
+		batch.DeviceID,
+		batch.Started,
+		batch.Ended,
+		batch.OriginalGravity,
+		batch.TargetGravity,
+		batch.Notes,
+		time.Now(),
+		batch.ID,
+	)
+	return err
+}
+
+// EndBatch closes the batch, freeing its device for the next one
+func (d *SQLDatastore) EndBatch(id int) error {
+	defer observeQuery("EndBatch", time.Now())
+	now := time.Now()
+	_, err := d.db.Exec(d.db.Rebind("UPDATE batch SET ended=?, updated=? WHERE id=? AND ended IS NULL"), now, now, id)
+	return err
+}
+
+func (d *SQLDatastore) DeleteBatch(id int) error {
+	defer observeQuery("DeleteBatch", time.Now())
+	_, err := d.db.Exec(d.db.Rebind("DELETE FROM batch WHERE id=?"), id)
+	return err
+}
+
+// GetBatchMetrics returns the metrics recorded by the batch's device while
+// the batch was active
+func (d *SQLDatastore) GetBatchMetrics(batch Batch) ([]Metric, error) {
+	defer observeQuery("GetBatchMetrics", time.Now())
+	to := time.Now()
+	if batch.Ended != nil {
+		to = *batch.Ended
+	}
+	return d.GetDeviceMetricsBetween(batch.DeviceID, batch.Started, to)
+}
+
+func (d *SQLDatastore) GetAlertRules() ([]AlertRule, error) {
+	defer observeQuery("GetAlertRules", time.Now())
+	rules := []AlertRule{}
+	err := d.db.Select(&rules, "SELECT * FROM alert_rule ORDER BY id ASC")
+	return rules, err
+}
+
+func (d *SQLDatastore) GetAlertRule(id int) (AlertRule, error) {
+	defer observeQuery("GetAlertRule", time.Now())
+	rule := AlertRule{}
+	err := d.db.Get(&rule, d.db.Rebind("SELECT * FROM alert_rule WHERE id=?"), id)
+	return rule, err
+}
+
+func (d *SQLDatastore) CreateAlertRule(rule AlertRule) (AlertRule, error) {
+	defer observeQuery("CreateAlertRule", time.Now())
+	rule.Created = time.Now()
+	rule.Updated = rule.Created
+
+	id, err := d.dialect.insertID(
+		d.db,
+		"INSERT INTO alert_rule (name, metric, comparator, threshold, hysteresis, duration, device_id, batch_id, disabled, created, updated) VALUES (?,?,?,?,?,?,?,?,?,?,?)",
+		rule.Name,
+		rule.Metric,
+		rule.Comparator,
+		rule.Threshold,
+		rule.Hysteresis,
+		rule.Duration,
+		rule.DeviceID,
+		rule.BatchID,
+		rule.Disabled,
+		rule.Created,
+		rule.Updated,
+	)
+	rule.ID = int(id)
+	return rule, err
+}
+
+func (d *SQLDatastore) UpdateAlertRule(rule AlertRule) error {
+	defer observeQuery("UpdateAlertRule", time.Now())
+	_, err := d.db.Exec(
+		d.db.Rebind("UPDATE alert_rule SET name=?, metric=?, comparator=?, threshold=?, hysteresis=?, duration=?, device_id=?, batch_id=?, disabled=?, updated=? WHERE id=?"),
+		rule.Name,
+		rule.Metric,
+		rule.Comparator,
+		rule.Threshold,
+		rule.Hysteresis,
+		rule.Duration,
+		rule.DeviceID,
+		rule.BatchID,
+		rule.Disabled,
+		time.Now(),
+		rule.ID,
+	)
+	return err
+}
+
+// DeleteAlertRule removes the rule along with its alerts
+func (d *SQLDatastore) DeleteAlertRule(id int) error {
+	defer observeQuery("DeleteAlertRule", time.Now())
+	tx, err := d.db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(tx.Rebind("DELETE FROM alert WHERE rule_id=?"), id); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(tx.Rebind("DELETE FROM alert_rule WHERE id=?"), id); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// GetAlerts returns the alerts in any of the states, most recent first
+func (d *SQLDatastore) GetAlerts(states ...string) ([]Alert, error) {
+	defer observeQuery("GetAlerts", time.Now())
+	alerts := []Alert{}
+	query, args, err := sqlx.In("SELECT * FROM alert WHERE state IN (?) ORDER BY started DESC", states)
+	if err != nil {
+		return alerts, err
+	}
+	err = d.db.Select(&alerts, d.db.Rebind(query), args...)
+	return alerts, err
+}
+
+// GetOpenAlert returns the rule's pending or firing alert for the device
+func (d *SQLDatastore) GetOpenAlert(ruleID int, deviceID string) (Alert, error) {
+	defer observeQuery("GetOpenAlert", time.Now())
+	alert := Alert{}
+	err := d.db.Get(
+		&alert,
+		d.db.Rebind("SELECT * FROM alert WHERE rule_id=? AND device_id=? AND state IN (?,?) ORDER BY id DESC LIMIT 1"),
+		ruleID, deviceID, AlertPending, AlertFiring,
+	)
+	return alert, err
+}
+
+func (d *SQLDatastore) CreateAlert(alert Alert) (Alert, error) {
+	defer observeQuery("CreateAlert", time.Now())
+	id, err := d.dialect.insertID(
+		d.db,
+		"INSERT INTO alert (rule_id, device_id, state, value, started, fired, resolved, updated) VALUES (?,?,?,?,?,?,?,?)",
+		alert.RuleID,
+		alert.DeviceID,
+		alert.State,
+		alert.Value,
+		alert.Started,
+		alert.Fired,
+		alert.Resolved,
+		alert.Updated,
+	)
+	alert.ID = int(id)
+	return alert, err
+}
+
+func (d *SQLDatastore) UpdateAlert(alert Alert) error {
+	defer observeQuery("UpdateAlert", time.Now())
+	_, err := d.db.Exec(
+		d.db.Rebind("UPDATE alert SET state=?, value=?, fired=?, resolved=?, updated=? WHERE id=?"),
+		alert.State,
+		alert.Value,
+		alert.Fired,
+		alert.Resolved,
+		alert.Updated,
+		alert.ID,
+	)
+	return err
+}
+
+func (d *SQLDatastore) DeleteAlert(id int) error {
+	defer observeQuery("DeleteAlert", time.Now())
+	_, err := d.db.Exec(d.db.Rebind("DELETE FROM alert WHERE id=?"), id)
+	return err
+}
+
+func (d *SQLDatastore) GetNotifiers() ([]Notifier, error) {
+	defer observeQuery("GetNotifiers", time.Now())
+	notifiers := []Notifier{}
+	err := d.db.Select(&notifiers, "SELECT * FROM notifier ORDER BY id ASC")
+	return notifiers, err
+}
+
+func (d *SQLDatastore) GetNotifier(id int) (Notifier, error) {
+	defer observeQuery("GetNotifier", time.Now())
+	notifier := Notifier{}
+	err := d.db.Get(&notifier, d.db.Rebind("SELECT * FROM notifier WHERE id=?"), id)
+	return notifier, err
+}
+
+func (d *SQLDatastore) CreateNotifier(notifier Notifier) (Notifier, error) {
+	defer observeQuery("CreateNotifier", time.Now())
+	notifier.Created = time.Now()
+	notifier.Updated = notifier.Created
+
+	id, err := d.dialect.insertID(
+		d.db,
+		"INSERT INTO notifier (name, type, url, template, to_address, from_address, events, rate_limit, disabled, created, updated) VALUES (?,?,?,?,?,?,?,?,?,?,?)",
+		notifier.Name,
+		notifier.Type,
+		notifier.URL,
+		notifier.Template,
+		notifier.To,
+		notifier.From,
+		notifier.Events,
+		notifier.RateLimit,
+		notifier.Disabled,
+		notifier.Created,
+		notifier.Updated,
+	)
+	notifier.ID = int(id)
+	return notifier, err
+}
+
+func (d *SQLDatastore) UpdateNotifier(notifier Notifier) error {
+	defer observeQuery("UpdateNotifier", time.Now())
+	_, err := d.db.Exec(
+		d.db.Rebind("UPDATE notifier SET name=?, type=?, url=?, template=?, to_address=?, from_address=?, events=?, rate_limit=?, disabled=?, updated=? WHERE id=?"),
+		notifier.Name,
+		notifier.Type,
+		notifier.URL,
+		notifier.Template,
+		notifier.To,
+		notifier.From,
+		notifier.Events,
+		notifier.RateLimit,
+		notifier.Disabled,
+		time.Now(),
+		notifier.ID,
+	)
+	return err
+}
+
+func (d *SQLDatastore) DeleteNotifier(id int) error {
+	defer observeQuery("DeleteNotifier", time.Now())
+	_, err := d.db.Exec(d.db.Rebind("DELETE FROM notifier WHERE id=?"), id)
+	return err
+}
+
+func (d *SQLDatastore) CreateOutboxMessage(message OutboxMessage) (OutboxMessage, error) {
+	defer observeQuery("CreateOutboxMessage", time.Now())
+	message.Created = time.Now()
+	if message.NextAttempt.IsZero() {
+		message.NextAttempt = message.Created
+	}
+
+	id, err := d.dialect.insertID(
+		d.db,
+		"INSERT INTO outbox (kind, destination, url, content_type, headers, body, attempts, error, dead, next_attempt, created) VALUES (?,?,?,?,?,?,?,?,?,?,?)",
+		message.Kind,
+		message.Destination,
+		message.URL,
+		message.ContentType,
+		message.Headers,
+		message.Body,
+		message.Attempts,
+		message.Error,
+		message.Dead,
+		message.NextAttempt,
+		message.Created,
+	)
+	message.ID = int(id)
+	return message, err
+}
+
+// outboxWhere selects the messages in the state (pending or dead) to the
+// destination, either being empty for any
+func outboxWhere(state string, destination string) (string, []interface{}, error) {
+	where := "1=1"
+	args := []interface{}{}
+	switch state {
+	case "":
+	case OutboxPending, OutboxDead:
+		where += " AND dead=?"
+		args = append(args, state == OutboxDead)
+	default:
+		return "", nil, fmt.Errorf("Unknown outbox state: %s", state)
+	}
+	if destination != "" {
+		where += " AND destination=?"
+		args = append(args, destination)
+	}
+	return where, args, nil
+}
+
+// GetOutboxMessages returns the undelivered messages in the state to the
+// destination, either being empty for any, oldest first
+func (d *SQLDatastore) GetOutboxMessages(state string, destination string) ([]OutboxMessage, error) {
+	defer observeQuery("GetOutboxMessages", time.Now())
+	messages := []OutboxMessage{}
+	where, args, err := outboxWhere(state, destination)
+	if err != nil {
+		return messages, err
+	}
+	err = d.db.Select(&messages, d.db.Rebind("SELECT * FROM outbox WHERE "+where+" ORDER BY id ASC"), args...)
+	return messages, err
+}
+
+func (d *SQLDatastore) GetOutboxMessage(id int) (OutboxMessage, error) {
+	defer observeQuery("GetOutboxMessage", time.Now())
+	message := OutboxMessage{}
+	err := d.db.Get(&message, d.db.Rebind("SELECT * FROM outbox WHERE id=?"), id)
+	return message, err
+}
+
+func (d *SQLDatastore) UpdateOutboxMessage(message OutboxMessage) error {
+	defer observeQuery("UpdateOutboxMessage", time.Now())
+	_, err := d.db.Exec(
+		d.db.Rebind("UPDATE outbox SET attempts=?, error=?, dead=?, next_attempt=? WHERE id=?"),
+		message.Attempts,
+		message.Error,
+		message.Dead,
+		message.NextAttempt,
+		message.ID,
+	)
+	return err
+}
+
+func (d *SQLDatastore) DeleteOutboxMessage(id int) error {
+	defer observeQuery("DeleteOutboxMessage", time.Now())
+	_, err := d.db.Exec(d.db.Rebind("DELETE FROM outbox WHERE id=?"), id)
+	return err
+}
+
+// PurgeOutboxMessages deletes the messages in the state to the destination,
+// either being empty for any, returning how many were deleted
+func (d *SQLDatastore) PurgeOutboxMessages(state string, destination string) (int64, error) {
+	defer observeQuery("PurgeOutboxMessages", time.Now())
+	where, args, err := outboxWhere(state, destination)
+	if err != nil {
+		return 0, err
+	}
+	result, err := d.db.Exec(d.db.Rebind("DELETE FROM outbox WHERE "+where), args...)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
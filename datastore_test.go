@@ -0,0 +1,584 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	embeddedpostgres "github.com/fergusstrange/embedded-postgres"
+)
+
+// testPostgres is the server the PostgreSQL half of the dialect tests runs
+// against, started on first use
+var testPostgres struct {
+	once    sync.Once
+	source  string
+	err     error
+	server  *embeddedpostgres.EmbeddedPostgres
+	runtime string
+}
+
+// postgresSource returns the connection URL of HYDROMONITOR_TEST_POSTGRES, or
+// else of an embedded server started for the tests. The embedded server's
+// binaries are downloaded on first use, and like any PostgreSQL server it
+// refuses to run as root.
+func postgresSource() (string, error) {
+	testPostgres.once.Do(func() {
+		if source := os.Getenv("HYDROMONITOR_TEST_POSTGRES"); source != "" {
+			testPostgres.source = source
+			return
+		}
+
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			testPostgres.err = err
+			return
+		}
+		port := uint32(listener.Addr().(*net.TCPAddr).Port)
+		listener.Close()
+
+		if testPostgres.runtime, err = ioutil.TempDir("", "hydromonitor-postgres"); err != nil {
+			testPostgres.err = err
+			return
+		}
+		output := &bytes.Buffer{}
+		config := embeddedpostgres.DefaultConfig().
+			Port(port).
+			RuntimePath(testPostgres.runtime).
+			Logger(output)
+		testPostgres.server = embeddedpostgres.NewDatabase(config)
+		if err := testPostgres.server.Start(); err != nil {
+			testPostgres.server = nil
+			testPostgres.err = fmt.Errorf("Starting embedded PostgreSQL: %s\n%s", err, output)
+			return
+		}
+		testPostgres.source = config.GetConnectionURL() + "?sslmode=disable"
+	})
+	return testPostgres.source, testPostgres.err
+}
+
+func TestMain(m *testing.M) {
+	code := m.Run()
+	if testPostgres.server != nil {
+		testPostgres.server.Stop()
+	}
+	if testPostgres.runtime != "" {
+		os.RemoveAll(testPostgres.runtime)
+	}
+	os.Exit(code)
+}
+
+// forEachDialect runs the test against a new, migrated SQLite database, and
+// against PostgreSQL, each test getting a schema of its own there. Setting
+// HYDROMONITOR_TEST_POSTGRES to a connection URL uses that server rather than
+// an embedded one, or to off leaves PostgreSQL out.
+func forEachDialect(t *testing.T, test func(t *testing.T, d Datastore)) {
+	t.Run("sqlite", func(t *testing.T) {
+		test(t, newTestDatastore(t))
+	})
+	t.Run("postgres", func(t *testing.T) {
+		if os.Getenv("HYDROMONITOR_TEST_POSTGRES") == "off" {
+			t.Skip("HYDROMONITOR_TEST_POSTGRES is off")
+		}
+		source, err := postgresSource()
+		if err != nil {
+			t.Fatal(err)
+		}
+		admin, err := OpenDatastore(source)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer admin.Close()
+		schema := fmt.Sprintf("test_%d", time.Now().UnixNano())
+		if _, err := admin.(*SQLDatastore).db.Exec("CREATE SCHEMA " + schema); err != nil {
+			t.Fatal(err)
+		}
+		defer admin.(*SQLDatastore).db.Exec("DROP SCHEMA " + schema + " CASCADE")
+
+		separator := "?"
+		if strings.Contains(source, "?") {
+			separator = "&"
+		}
+		d := openTestDatastore(t, source+separator+"search_path="+schema)
+		test(t, d)
+	})
+}
+
+// newTestDatastore returns a datastore on a new, migrated SQLite database
+func newTestDatastore(t *testing.T) Datastore {
+	t.Helper()
+	return openTestDatastore(t, filepath.Join(t.TempDir(), "test.sql"))
+}
+
+func openTestDatastore(t *testing.T, source string) Datastore {
+	t.Helper()
+	d, err := OpenDatastore(source)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(d.Close)
+	if _, err := d.Migrate(false); err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+func TestDatastoreDevices(t *testing.T) {
+	forEachDialect(t, func(t *testing.T, d Datastore) {
+		if err := d.CreateOrUpdateDevice(Device{ID: "tilt", Color: "red"}); err != nil {
+			t.Fatal(err)
+		}
+		// Devices found again are left as they are
+		if err := d.CreateOrUpdateDevice(Device{ID: "tilt", Color: "red"}); err != nil {
+			t.Fatal(err)
+		}
+
+		device, err := d.GetDevice("tilt")
+		if err != nil {
+			t.Fatal(err)
+		}
+		device.Name = "Stout"
+		device.Endpoint = "http://example.com/log"
+		device.EndpointFormat = ForwardBrewfather
+		device.PollInterval = 900
+		device.GravityUnits = "plato"
+		if err := d.UpdateDevice(device); err != nil {
+			t.Fatal(err)
+		}
+		if err := d.SetDeviceError("tilt", "timeout"); err != nil {
+			t.Fatal(err)
+		}
+
+		device, err = d.GetDevice("tilt")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if device.Name != "Stout" || device.Color != "red" || device.Endpoint != "http://example.com/log" ||
+			device.EndpointFormat != ForwardBrewfather || device.PollInterval != 900 || device.GravityUnits != "plato" ||
+			device.Error != "timeout" || device.Disabled {
+			t.Errorf("got %+v", device)
+		}
+
+		if err := d.DisableDevice("tilt", "failing"); err != nil {
+			t.Fatal(err)
+		}
+		devices, err := d.GetDevices()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(devices) != 1 || !devices[0].Disabled || devices[0].Error != "failing" {
+			t.Errorf("got %+v", devices)
+		}
+
+		if err := d.DeleteDevice("tilt"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := d.GetDevice("tilt"); err != sql.ErrNoRows {
+			t.Errorf("deleted device: %v", err)
+		}
+	})
+}
+
+func TestDatastoreMetrics(t *testing.T) {
+	forEachDialect(t, func(t *testing.T, d Datastore) {
+		if err := d.CreateOrUpdateDevice(Device{ID: "tilt", Color: "red"}); err != nil {
+			t.Fatal(err)
+		}
+		start := time.Date(2020, 1, 1, 12, 0, 0, 0, time.Local)
+		for i := 0; i < 5; i++ {
+			metric := Metric{
+				DeviceID:    "tilt",
+				Power:       -70,
+				Battery:     90,
+				Temperature: 66.5 + float64(i),
+				Gravity:     1.050 - 0.005*float64(i),
+				Created:     start.Add(time.Duration(i) * time.Hour),
+			}
+			if err := d.CreateMetric(metric); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		latest, err := d.GetDeviceLatestMetrics("tilt")
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Fractional temperatures are kept, and stored as their raw readings
+		if latest.Temperature != 70.5 || latest.RawTemperature != 70.5 || latest.Gravity != 1.030 || !latest.Created.Equal(start.Add(4*time.Hour)) {
+			t.Errorf("latest %+v", latest)
+		}
+
+		devices, err := d.GetDevicesWithMetrics()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(devices) != 1 || devices[0].LatestMetric.Temperature != 70.5 {
+			t.Errorf("devices with metrics %+v", devices)
+		}
+
+		// Pages from the start
+		query := MetricQuery{From: start, Limit: 2}
+		seen := []float64{}
+		for {
+			metrics, err := d.GetDeviceMetrics("tilt", query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, metric := range metrics {
+				seen = append(seen, metric.Temperature)
+			}
+			if len(metrics) < query.Limit {
+				break
+			}
+			query.Cursor = int64(metrics[len(metrics)-1].ID)
+		}
+		if fmt.Sprint(seen) != "[66.5 67.5 68.5 69.5 70.5]" {
+			t.Errorf("paged %v", seen)
+		}
+
+		between, err := d.GetDeviceMetricsBetween("tilt", start.Add(time.Hour), start.Add(3*time.Hour))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(between) != 3 || between[0].Temperature != 67.5 {
+			t.Errorf("between %+v", between)
+		}
+
+		buckets, err := d.GetDeviceMetricBuckets("tilt", MetricQuery{From: start, To: start.Add(5 * time.Hour), Limit: 10}, 2*time.Hour)
+		if err != nil {
+			t.Fatal(err)
+		}
+		count := 0
+		for _, bucket := range buckets {
+			count += bucket.Count
+		}
+		if count != 5 {
+			t.Errorf("buckets hold %d metrics: %+v", count, buckets)
+		}
+	})
+}
+
+func TestDatastoreMetricCursor(t *testing.T) {
+	forEachDialect(t, func(t *testing.T, d Datastore) {
+		if err := d.CreateOrUpdateDevice(Device{ID: "tilt", Color: "red"}); err != nil {
+			t.Fatal(err)
+		}
+		start := time.Date(2020, 1, 1, 12, 0, 0, 0, time.Local)
+		for i := 0; i < 7; i++ {
+			// Readings sharing a time still page by id without repeats
+			created := start.Add(time.Duration(i/2) * time.Minute)
+			if err := d.CreateMetric(Metric{DeviceID: "tilt", Gravity: 1.050, Temperature: float64(60 + i), Created: created}); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		seen := []float64{}
+		query := MetricQuery{From: start, To: start.Add(3 * time.Minute), Limit: 2}
+		for page := 0; page < 10; page++ {
+			metrics, err := d.GetDeviceMetrics("tilt", query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, metric := range metrics {
+				seen = append(seen, metric.Temperature)
+			}
+			if len(metrics) < query.Limit {
+				break
+			}
+			query.Cursor = int64(metrics[len(metrics)-1].ID)
+		}
+		// The range stops before the readings at its end
+		if fmt.Sprint(seen) != "[60 61 62 63 64 65]" {
+			t.Errorf("paged %v", seen)
+		}
+
+		// Without a starting point the latest are returned, oldest first
+		latest, err := d.GetDeviceMetrics("tilt", MetricQuery{Limit: 3})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(latest) != 3 || latest[0].Temperature != 64 || latest[2].Temperature != 66 {
+			t.Errorf("latest %+v", latest)
+		}
+	})
+}
+
+func TestDatastoreMetricBuckets(t *testing.T) {
+	forEachDialect(t, func(t *testing.T, d Datastore) {
+		if err := d.CreateOrUpdateDevice(Device{ID: "tilt", Color: "red"}); err != nil {
+			t.Fatal(err)
+		}
+		start := time.Unix(1577880000, 0) // 2020-01-01T12:00:00Z, on an hour
+		readings := []struct {
+			offset      time.Duration
+			gravity     float64
+			temperature float64
+		}{
+			{0, 1.050, 66},
+			{20 * time.Minute, 1.048, 68},
+			{59*time.Minute + 59*time.Second, 1.046, 70},
+			{time.Hour, 1.044, 64},
+			{3*time.Hour + 30*time.Minute, 1.040, 65},
+		}
+		for _, reading := range readings {
+			metric := Metric{DeviceID: "tilt", Gravity: reading.gravity, Temperature: reading.temperature, Created: start.Add(reading.offset)}
+			if err := d.CreateMetric(metric); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		query := MetricQuery{From: start, To: start.Add(4 * time.Hour), Limit: 10}
+		buckets, err := d.GetDeviceMetricBuckets("tilt", query, time.Hour)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(buckets) != 3 {
+			t.Fatalf("got %d buckets: %+v", len(buckets), buckets)
+		}
+		first := buckets[0]
+		if !first.Start.Equal(start) || first.Count != 3 || first.MinGravity != 1.046 || first.MaxGravity != 1.050 ||
+			math.Abs(first.AvgGravity-1.048) > 1e-9 || first.MinTemperature != 66 || first.MaxTemperature != 70 || first.AvgTemperature != 68 {
+			t.Errorf("first bucket %+v", first)
+		}
+		// A reading on the hour starts the next bucket, and empty hours are left out
+		if !buckets[1].Start.Equal(start.Add(time.Hour)) || buckets[1].Count != 1 || !buckets[2].Start.Equal(start.Add(3*time.Hour)) {
+			t.Errorf("buckets %+v", buckets)
+		}
+
+		// Buckets page from the cursor of the last one
+		query.Limit = 2
+		page, err := d.GetDeviceMetricBuckets("tilt", query, time.Hour)
+		if err != nil || len(page) != 2 {
+			t.Fatalf("first page %+v, %v", page, err)
+		}
+		query.Cursor = page[1].Bucket
+		page, err = d.GetDeviceMetricBuckets("tilt", query, time.Hour)
+		if err != nil || len(page) != 1 || !page[0].Start.Equal(start.Add(3*time.Hour)) {
+			t.Errorf("second page %+v, %v", page, err)
+		}
+
+		if _, err := d.GetDeviceMetricBuckets("tilt", query, time.Millisecond); err == nil {
+			t.Error("accepted an interval under a second")
+		}
+	})
+}
+
+func TestDatastoreConcurrentWriters(t *testing.T) {
+	forEachDialect(t, func(t *testing.T, d Datastore) {
+		if err := d.CreateOrUpdateDevice(Device{ID: "tilt", Color: "red"}); err != nil {
+			t.Fatal(err)
+		}
+
+		wg := sync.WaitGroup{}
+		errs := make(chan error, 200)
+		for i := 0; i < 20; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				for j := 0; j < 10; j++ {
+					errs <- d.CreateMetric(Metric{DeviceID: "tilt", Gravity: 1.050, Temperature: float64(i)})
+					if _, err := d.GetDevice("tilt"); err != nil {
+						errs <- err
+					}
+				}
+			}(i)
+		}
+		wg.Wait()
+		close(errs)
+		for err := range errs {
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		metrics, err := d.GetDeviceMetrics("tilt", MetricQuery{From: time.Unix(0, 0), Limit: 1000})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(metrics) != 200 {
+			t.Errorf("stored %d metrics, want 200", len(metrics))
+		}
+	})
+}
+
+func TestDatastoreBatches(t *testing.T) {
+	forEachDialect(t, func(t *testing.T, d Datastore) {
+		if err := d.CreateOrUpdateDevice(Device{ID: "tilt", Color: "red"}); err != nil {
+			t.Fatal(err)
+		}
+		started := time.Now().Add(-2 * time.Hour).Round(time.Second)
+		batch, err := d.CreateBatch(Batch{Name: "IPA", DeviceID: "tilt", Started: started, OriginalGravity: 1.060})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if batch.ID == 0 {
+			t.Fatal("batch has no id")
+		}
+		if err := d.CreateMetric(Metric{DeviceID: "tilt", Gravity: 1.040, Temperature: 68, Created: started.Add(time.Hour)}); err != nil {
+			t.Fatal(err)
+		}
+
+		active, err := d.GetActiveBatch("tilt")
+		if err != nil || active.ID != batch.ID || active.Name != "IPA" {
+			t.Fatalf("active batch %+v, %v", active, err)
+		}
+		metrics, err := d.GetBatchMetrics(active)
+		if err != nil || len(metrics) != 1 {
+			t.Errorf("batch metrics %+v, %v", metrics, err)
+		}
+
+		if err := d.EndBatch(batch.ID); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := d.GetActiveBatch("tilt"); err != sql.ErrNoRows {
+			t.Errorf("ended batch still active: %v", err)
+		}
+		ended, err := d.GetBatch(batch.ID)
+		if err != nil || ended.Ended == nil {
+			t.Errorf("ended batch %+v, %v", ended, err)
+		}
+
+		if err := d.DeleteBatch(batch.ID); err != nil {
+			t.Fatal(err)
+		}
+		if batches, err := d.GetBatches(); err != nil || len(batches) != 0 {
+			t.Errorf("batches %+v, %v", batches, err)
+		}
+	})
+}
+
+func TestDatastoreAlertsAndNotifiers(t *testing.T) {
+	forEachDialect(t, func(t *testing.T, d Datastore) {
+		rule, err := d.CreateAlertRule(AlertRule{Name: "Hot", Metric: "temperature", Comparator: ">", Threshold: 72.5, Duration: 60})
+		if err != nil {
+			t.Fatal(err)
+		}
+		alert, err := d.CreateAlert(Alert{RuleID: rule.ID, DeviceID: "tilt", State: "pending", Value: 73.5, Started: time.Now()})
+		if err != nil {
+			t.Fatal(err)
+		}
+		open, err := d.GetOpenAlert(rule.ID, "tilt")
+		if err != nil || open.ID != alert.ID || open.Value != 73.5 {
+			t.Errorf("open alert %+v, %v", open, err)
+		}
+		// Deleting the rule takes its alerts with it
+		if err := d.DeleteAlertRule(rule.ID); err != nil {
+			t.Fatal(err)
+		}
+		if alerts, err := d.GetAlerts("pending", "firing", "resolved"); err != nil || len(alerts) != 0 {
+			t.Errorf("alerts %+v, %v", alerts, err)
+		}
+
+		notifier, err := d.CreateNotifier(Notifier{Name: "Phone", Type: "ntfy", URL: "https://ntfy.sh/brewing", RateLimit: 60})
+		if err != nil {
+			t.Fatal(err)
+		}
+		notifier.Disabled = true
+		if err := d.UpdateNotifier(notifier); err != nil {
+			t.Fatal(err)
+		}
+		if got, err := d.GetNotifier(notifier.ID); err != nil || !got.Disabled || got.URL != notifier.URL || got.RateLimit != 60 {
+			t.Errorf("notifier %+v, %v", got, err)
+		}
+	})
+}
+
+func TestDatastoreOutbox(t *testing.T) {
+	forEachDialect(t, func(t *testing.T, d Datastore) {
+		for _, destination := range []string{"a", "b", "a"} {
+			if _, err := d.CreateOutboxMessage(OutboxMessage{Kind: OutboxHTTP, Destination: destination, URL: "http://example.com", Body: destination, Created: time.Now()}); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		messages, err := d.GetOutboxMessages("", "a")
+		if err != nil || len(messages) != 2 || messages[0].ID >= messages[1].ID {
+			t.Fatalf("messages to a %+v, %v", messages, err)
+		}
+		messages[0].Dead = true
+		messages[0].Attempts = 3
+		messages[0].Error = "refused"
+		if err := d.UpdateOutboxMessage(messages[0]); err != nil {
+			t.Fatal(err)
+		}
+
+		dead, err := d.GetOutboxMessages(OutboxDead, "")
+		if err != nil || len(dead) != 1 || dead[0].Attempts != 3 || dead[0].Error != "refused" {
+			t.Errorf("dead messages %+v, %v", dead, err)
+		}
+		if pending, err := d.GetOutboxMessages(OutboxPending, ""); err != nil || len(pending) != 2 {
+			t.Errorf("pending messages %+v, %v", pending, err)
+		}
+		if _, err := d.GetOutboxMessages("unknown", ""); err == nil {
+			t.Error("unknown state accepted")
+		}
+
+		purged, err := d.PurgeOutboxMessages(OutboxPending, "b")
+		if err != nil || purged != 1 {
+			t.Errorf("purged %d, %v", purged, err)
+		}
+		if err := d.DeleteOutboxMessage(dead[0].ID); err != nil {
+			t.Fatal(err)
+		}
+		if remaining, err := d.GetOutboxMessages("", ""); err != nil || len(remaining) != 1 || remaining[0].Destination != "a" {
+			t.Errorf("remaining %+v, %v", remaining, err)
+		}
+	})
+}
+
+func TestGetDeviceMetricsBetweenOutsideUTC(t *testing.T) {
+	local := time.Local
+	time.Local = time.FixedZone("AEST", 10*60*60)
+	defer func() { time.Local = local }()
+
+	forEachDialect(t, func(t *testing.T, d Datastore) {
+		if err := d.CreateOrUpdateDevice(Device{ID: "tilt", Color: "red"}); err != nil {
+			t.Fatal(err)
+		}
+		start := time.Date(2020, 1, 1, 12, 0, 0, 0, time.Local)
+		for i := 0; i < 4; i++ {
+			if err := d.CreateMetric(Metric{DeviceID: "tilt", Gravity: 1.050, Created: start.Add(time.Duration(i) * time.Hour)}); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		// Batches pass times in UTC, such as when parsed from the API
+		from, to := start.Add(time.Hour).UTC(), start.Add(2*time.Hour).UTC()
+		metrics, err := d.GetDeviceMetricsBetween("tilt", from, to)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(metrics) != 2 || !metrics[0].Created.Equal(from) || !metrics[1].Created.Equal(to) {
+			t.Errorf("got %d metrics between %s and %s: %+v", len(metrics), from, to, metrics)
+		}
+	})
+}
+
+func TestDatastoreWriteErrors(t *testing.T) {
+	// Without migrating there are no tables to write to, which must fail
+	// like any other database error rather than panic
+	d, err := OpenDatastore(filepath.Join(t.TempDir(), "test.sql"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	if err := d.CreateOrUpdateDevice(Device{ID: "tilt", Color: "red"}); err == nil {
+		t.Error("created device without a device table")
+	}
+	if err := d.UpdateDevice(Device{ID: "tilt"}); err == nil {
+		t.Error("updated device without a device table")
+	}
+	if err := d.CreateMetric(Metric{DeviceID: "tilt", Gravity: 1.050}); err == nil {
+		t.Error("created metric without a metric table")
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+	_ "github.com/lib/pq"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// dialect captures the SQL that differs between database backends. Queries
+// are otherwise written with ? placeholders and rebound for the driver.
+type dialect interface {
+	// open connects to the database at the source
+	open(source string) (*sqlx.DB, error)
+	// insertIgnore turns an INSERT statement into one skipping existing rows
+	insertIgnore(insert string) string
+	// epoch returns an integer expression for a timestamp column in unix seconds
+	epoch(column string) string
+	// tableExists returns a query counting the tables named by its argument
+	tableExists() string
+	// insertID runs an INSERT statement, returning the id of the new row
+	insertID(db *sqlx.DB, insert string, args ...interface{}) (int64, error)
+	// schema returns the dialect's statements for a migration
+	schema(m Migration) string
+}
+
+type sqliteDialect struct{}
+
+// sqliteBusyTimeout is how long, in milliseconds, SQLite waits for another
+// process's lock on the database before failing with "database is locked"
+const sqliteBusyTimeout = 5000
+
+// open serializes access on one connection, as SQLite allows only one writer
+// at a time, so concurrent writers queue rather than fail
+func (sqliteDialect) open(source string) (*sqlx.DB, error) {
+	separator := "?"
+	if strings.Contains(source, "?") {
+		separator = "&"
+	}
+	db, err := sqlx.Open("sqlite3", fmt.Sprintf("%s%s_busy_timeout=%d", source, separator, sqliteBusyTimeout))
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(1)
+	return db, nil
+}
+
+func (sqliteDialect) insertIgnore(insert string) string {
+	return strings.Replace(insert, "INSERT INTO", "INSERT OR IGNORE INTO", 1)
+}
+
+func (sqliteDialect) epoch(column string) string {
+	return fmt.Sprintf("CAST(strftime('%%s', %s) AS INTEGER)", column)
+}
+
+func (sqliteDialect) tableExists() string {
+	return "SELECT COUNT(*) FROM sqlite_master WHERE type='table' AND name=?"
+}
+
+func (sqliteDialect) insertID(db *sqlx.DB, insert string, args ...interface{}) (int64, error) {
+	result, err := db.Exec(insert, args...)
+	if err != nil {
+		return 0, err
+	}
+	return result.LastInsertId()
+}
+
+func (sqliteDialect) schema(m Migration) string {
+	return m.SQLite
+}
+
+type postgresDialect struct{}
+
+func (postgresDialect) open(source string) (*sqlx.DB, error) {
+	return sqlx.Open("postgres", source)
+}
+
+func (postgresDialect) insertIgnore(insert string) string {
+	return insert + " ON CONFLICT DO NOTHING"
+}
+
+func (postgresDialect) epoch(column string) string {
+	return fmt.Sprintf("CAST(FLOOR(EXTRACT(EPOCH FROM %s)) AS BIGINT)", column)
+}
+
+func (postgresDialect) tableExists() string {
+	return "SELECT COUNT(*) FROM information_schema.tables WHERE table_schema=current_schema() AND table_name=?"
+}
+
+func (postgresDialect) insertID(db *sqlx.DB, insert string, args ...interface{}) (int64, error) {
+	var id int64
+	err := db.Get(&id, db.Rebind(insert+" RETURNING id"), args...)
+	return id, err
+}
+
+func (postgresDialect) schema(m Migration) string {
+	return m.Postgres
+}
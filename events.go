@@ -0,0 +1,190 @@
+package main
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	// EventMetric is published with the Metric stored for a device
+	EventMetric = "metric"
+	// EventDevice is published with the Device when a tilt is discovered
+	EventDevice = "device"
+	// EventError is published with the error message recorded for a device
+	EventError = "error"
+	// EventStage is published with the Fermentation of a device when its
+	// stage changes
+	EventStage = "stage"
+	// EventAlert is published with the AlertEvent of each alert that fires
+	// or resolves
+	EventAlert = "alert"
+)
+
+// Event is something that happened to a device inside the daemon
+type Event struct {
+	Type     string      `json:"type"`
+	DeviceID string      `json:"device_id"`
+	Data     interface{} `json:"data"`
+	Created  time.Time   `json:"created"`
+}
+
+// EventFilter selects the events a subscriber receives. Empty sets match
+// every device or type.
+type EventFilter struct {
+	Devices map[string]bool
+	Types   map[string]bool
+}
+
+// NewEventFilter builds a filter from comma separated device IDs and types
+func NewEventFilter(devices string, types string) EventFilter {
+	return EventFilter{Devices: splitSet(devices), Types: splitSet(types)}
+}
+
+// Match reports whether the event passes the filter
+func (f EventFilter) Match(e Event) bool {
+	if len(f.Devices) > 0 && !f.Devices[e.DeviceID] {
+		return false
+	}
+	if len(f.Types) > 0 && !f.Types[e.Type] {
+		return false
+	}
+	return true
+}
+
+// EventBus fans out published events to every matching subscriber
+type EventBus struct {
+	mu          sync.Mutex
+	subscribers map[chan Event]EventFilter
+	queues      map[chan Event]*eventQueue
+}
+
+// NewEventBus returns an event bus without subscribers
+func NewEventBus() *EventBus {
+	return &EventBus{subscribers: make(map[chan Event]EventFilter), queues: make(map[chan Event]*eventQueue)}
+}
+
+// Subscribe returns a channel receiving the events matching filter, which
+// must be released with Unsubscribe. Events are dropped while the channel is
+// full, so it suits clients that can live with gaps, like API streams.
+func (b *EventBus) Subscribe(filter EventFilter) chan Event {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	ch := make(chan Event, 64)
+	b.subscribers[ch] = filter
+	return ch
+}
+
+// SubscribeReliable is like Subscribe, but queues events for as long as the
+// subscriber takes to receive them rather than dropping any, for consumers
+// that must see every reading
+func (b *EventBus) SubscribeReliable(filter EventFilter) chan Event {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	ch := make(chan Event)
+	q := &eventQueue{ready: make(chan bool, 1), done: make(chan bool)}
+	b.subscribers[ch] = filter
+	b.queues[ch] = q
+	go q.pump(ch)
+	return ch
+}
+
+// Unsubscribe stops delivering events to the channel and closes it
+func (b *EventBus) Unsubscribe(ch chan Event) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if _, ok := b.subscribers[ch]; !ok {
+		return
+	}
+	delete(b.subscribers, ch)
+	if q, ok := b.queues[ch]; ok {
+		// The pump closes the channel once it stops
+		delete(b.queues, ch)
+		close(q.done)
+		return
+	}
+	close(ch)
+}
+
+// Publish delivers the event to every matching subscriber without blocking,
+// dropping it for subscribers that aren't keeping up unless they subscribed
+// reliably
+func (b *EventBus) Publish(eventType string, deviceID string, data interface{}) {
+	e := Event{Type: eventType, DeviceID: deviceID, Data: data, Created: time.Now()}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for ch, filter := range b.subscribers {
+		if !filter.Match(e) {
+			continue
+		}
+		if q, ok := b.queues[ch]; ok {
+			q.push(e)
+			continue
+		}
+		select {
+		case ch <- e:
+		default:
+			log.Warnf("[events] Dropping %s event for %s, subscriber is full", e.Type, e.DeviceID)
+		}
+	}
+}
+
+// eventQueue buffers the events of a reliable subscription without bound
+type eventQueue struct {
+	mu     sync.Mutex
+	events []Event
+	ready  chan bool
+	done   chan bool
+}
+
+func (q *eventQueue) push(e Event) {
+	q.mu.Lock()
+	q.events = append(q.events, e)
+	q.mu.Unlock()
+
+	select {
+	case q.ready <- true:
+	default:
+	}
+}
+
+// pump sends queued events to the channel in order until unsubscribed
+func (q *eventQueue) pump(ch chan Event) {
+	defer close(ch)
+	for {
+		q.mu.Lock()
+		events := q.events
+		q.events = nil
+		q.mu.Unlock()
+
+		for _, e := range events {
+			select {
+			case ch <- e:
+			case <-q.done:
+				return
+			}
+		}
+		select {
+		case <-q.ready:
+		case <-q.done:
+			return
+		}
+	}
+}
+
+func splitSet(list string) map[string]bool {
+	set := map[string]bool{}
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			set[item] = true
+		}
+	}
+	return set
+}
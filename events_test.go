@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+// awaitSubscribers waits for the bus to have the given number of subscribers
+func awaitSubscribers(t *testing.T, b *EventBus, count int) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		b.mu.Lock()
+		subscribed := len(b.subscribers)
+		b.mu.Unlock()
+		if subscribed == count {
+			return
+		}
+	}
+	t.Fatalf("never had %d subscribers", count)
+}
+
+func TestEventBusReliableSubscribers(t *testing.T) {
+	b := NewEventBus()
+	lossy := b.Subscribe(EventFilter{})
+	reliable := b.SubscribeReliable(NewEventFilter("", EventMetric))
+
+	// Nothing receives until everything is published, filling the lossy
+	// subscriber
+	for i := 0; i < 500; i++ {
+		b.Publish(EventMetric, fmt.Sprint(i), nil)
+		b.Publish(EventDevice, fmt.Sprint(i), nil)
+	}
+	if len(lossy) != cap(lossy) {
+		t.Errorf("lossy subscriber has %d events, want it full with %d", len(lossy), cap(lossy))
+	}
+	for i := 0; i < 500; i++ {
+		select {
+		case e := <-reliable:
+			if e.Type != EventMetric || e.DeviceID != fmt.Sprint(i) {
+				t.Fatalf("event %d is %s for %s", i, e.Type, e.DeviceID)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("lost events after %d", i)
+		}
+	}
+
+	b.Unsubscribe(lossy)
+	b.Unsubscribe(reliable)
+	for range reliable {
+	}
+	if _, ok := <-lossy; !ok {
+		t.Error("dropped the lossy subscriber's buffered events on unsubscribing")
+	}
+}
+
+func TestForwarderKeepsEveryMetric(t *testing.T) {
+	d := newTestDatastore(t)
+	if err := d.CreateOrUpdateDevice(Device{ID: "tilt", Color: "red", Endpoint: "http://example.com/log"}); err != nil {
+		t.Fatal(err)
+	}
+	events := NewEventBus()
+	outbox, _ := newTestOutbox(t, d, 3)
+	go NewForwarder(d, events, outbox).Run()
+	awaitSubscribers(t, events, 1)
+
+	// A burst of readings outpaces the forwarder's writes to the outbox
+	start := time.Now()
+	for i := 0; i < 200; i++ {
+		events.Publish(EventMetric, "tilt", Metric{DeviceID: "tilt", Gravity: 1.050, Temperature: 68, Created: start.Add(time.Duration(i) * time.Second)})
+	}
+	for deadline := time.Now().Add(10 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		messages := outboxMessages(t, d, "", "forward:tilt")
+		if len(messages) == 200 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("queued %d of 200 metrics", len(messages))
+		}
+	}
+}
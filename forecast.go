@@ -0,0 +1,263 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"time"
+)
+
+const (
+	// ForecastWindow is how much history is fitted for devices without an
+	// active batch
+	ForecastWindow = 14 * 24 * time.Hour
+	// MinForecastReadings is the fewest readings a forecast is fitted to
+	MinForecastReadings = 12
+	// CompletionTolerance is how close to the final gravity fermentation is
+	// complete
+	CompletionTolerance = 0.001
+
+	// forecastGrid is the number of rates and midpoints searched, and
+	// forecastRefine the number searched again around the best of them
+	forecastGrid   = 80
+	forecastRefine = 20
+	// forecastF approximates the F statistic bounding the 95% confidence
+	// region of the four parameter fit
+	forecastF = 2.5
+)
+
+// Forecast predicts where and when a fermentation will finish from a
+// logistic decay fitted to its gravity
+//
+//	gravity(t) = final + (original - final) / (1 + exp(rate * (t - midpoint)))
+//
+// The ranges cover every fit within the 95% confidence region.
+type Forecast struct {
+	OriginalGravity    float64   `json:"original_gravity"`
+	FinalGravity       float64   `json:"final_gravity"`
+	FinalGravityLow    float64   `json:"final_gravity_low"`
+	FinalGravityHigh   float64   `json:"final_gravity_high"`
+	Completion         time.Time `json:"completion"`
+	CompletionEarliest time.Time `json:"completion_earliest"`
+	CompletionLatest   time.Time `json:"completion_latest"`
+	// Rate is the logistic rate per day, and Midpoint the time of the
+	// fastest fall
+	Rate     float64   `json:"rate"`
+	Midpoint time.Time `json:"midpoint"`
+	// Residual is the root mean square error of the fit
+	Residual float64 `json:"residual"`
+	Readings int     `json:"readings"`
+}
+
+// logisticFit is one candidate fit, linear in final and amplitude once rate
+// and midpoint (in days) are fixed
+type logisticFit struct {
+	rate, midpoint   float64
+	final, amplitude float64
+	sse              float64
+}
+
+// completion returns the days until the fit is within CompletionTolerance of
+// its final gravity
+func (f logisticFit) completion() float64 {
+	if f.amplitude <= CompletionTolerance {
+		return f.midpoint
+	}
+	return f.midpoint + math.Log(f.amplitude/CompletionTolerance-1)/f.rate
+}
+
+// NewForecast fits the metrics, in ascending order
+func NewForecast(metrics []Metric) (Forecast, error) {
+	if len(metrics) < MinForecastReadings {
+		return Forecast{}, fmt.Errorf("At least %d readings are needed to forecast, have %d", MinForecastReadings, len(metrics))
+	}
+
+	start := metrics[0].Created
+	days := make([]float64, len(metrics))
+	gravities := make([]float64, len(metrics))
+	min, max := metrics[0].Gravity, metrics[0].Gravity
+	for i, m := range metrics {
+		days[i] = m.Created.Sub(start).Hours() / 24
+		gravities[i] = m.Gravity
+		min = math.Min(min, m.Gravity)
+		max = math.Max(max, m.Gravity)
+	}
+	// Any curve fits a flat history, so there's nothing to forecast from
+	if round(max-min, 4) <= StableGravityTolerance {
+		return Forecast{}, fmt.Errorf("Gravity is not falling, cannot forecast")
+	}
+	span := days[len(days)-1]
+
+	// Search rates from 0.1 to 20 per day, and midpoints from before the
+	// first reading to well after the last
+	ratio := math.Pow(200, 1.0/(forecastGrid-1))
+	step := (span + 25) / (forecastGrid - 1)
+	fits := searchLogistic(days, gravities, 0.1, ratio, -5, step, forecastGrid)
+	if len(fits) == 0 {
+		return Forecast{}, fmt.Errorf("Gravity is not falling, cannot forecast")
+	}
+
+	// Refine around the best fit of the coarse search
+	coarse := fits[0]
+	fits = append(fits, searchLogistic(
+		days, gravities,
+		coarse.rate/ratio, math.Pow(ratio, 2.0/(forecastRefine-1)),
+		coarse.midpoint-step, 2*step/(forecastRefine-1),
+		forecastRefine,
+	)...)
+	sort.Slice(fits, func(i, j int) bool { return fits[i].sse < fits[j].sse })
+	best := fits[0]
+
+	at := func(days float64) time.Time {
+		return start.Add(time.Duration(days * 24 * float64(time.Hour)))
+	}
+	n := float64(len(metrics))
+	forecast := Forecast{
+		OriginalGravity: round(best.final+best.amplitude, 4),
+		FinalGravity:    round(best.final, 4),
+		Completion:      at(best.completion()),
+		Rate:            round(best.rate, 4),
+		Midpoint:        at(best.midpoint),
+		Residual:        round(math.Sqrt(best.sse/n), 5),
+		Readings:        len(metrics),
+	}
+
+	threshold := best.sse * (1 + 4/(n-4)*forecastF)
+	low, high := best.final, best.final
+	earliest, latest := best.completion(), best.completion()
+	for _, fit := range fits {
+		if fit.sse > threshold {
+			break
+		}
+		low = math.Min(low, fit.final)
+		high = math.Max(high, fit.final)
+		earliest = math.Min(earliest, fit.completion())
+		latest = math.Max(latest, fit.completion())
+	}
+	forecast.FinalGravityLow = round(low, 4)
+	forecast.FinalGravityHigh = round(high, 4)
+	forecast.CompletionEarliest = at(earliest)
+	forecast.CompletionLatest = at(latest)
+	return forecast, nil
+}
+
+// searchLogistic fits a size by size grid of geometrically spaced rates and
+// evenly spaced midpoints, returning the fits ordered best first
+func searchLogistic(days []float64, gravities []float64, rate float64, ratio float64, midpoint float64, step float64, size int) []logisticFit {
+	fits := []logisticFit{}
+	for i := 0; i < size; i++ {
+		for j := 0; j < size; j++ {
+			fit, ok := fitLogistic(days, gravities, rate*math.Pow(ratio, float64(i)), midpoint+step*float64(j))
+			if ok {
+				fits = append(fits, fit)
+			}
+		}
+	}
+	sort.Slice(fits, func(i, j int) bool { return fits[i].sse < fits[j].sse })
+	return fits
+}
+
+// fitLogistic regresses gravity on the logistic curve with the given rate
+// and midpoint, only accepting falling gravities
+func fitLogistic(days []float64, gravities []float64, rate float64, midpoint float64) (logisticFit, bool) {
+	n := float64(len(days))
+	curve := make([]float64, len(days))
+	var sumX, sumY, sumXY, sumXX float64
+	for i, d := range days {
+		curve[i] = 1 / (1 + math.Exp(rate*(d-midpoint)))
+		sumX += curve[i]
+		sumY += gravities[i]
+		sumXY += curve[i] * gravities[i]
+		sumXX += curve[i] * curve[i]
+	}
+	denominator := n*sumXX - sumX*sumX
+	if denominator < 1e-12 {
+		return logisticFit{}, false
+	}
+
+	fit := logisticFit{rate: rate, midpoint: midpoint}
+	fit.amplitude = (n*sumXY - sumX*sumY) / denominator
+	fit.final = (sumY - fit.amplitude*sumX) / n
+	if fit.amplitude <= 0 || fit.final < 0.98 {
+		return logisticFit{}, false
+	}
+	for i, c := range curve {
+		residual := gravities[i] - (fit.final + fit.amplitude*c)
+		fit.sse += residual * residual
+	}
+	return fit, true
+}
+
+// DeviceForecast forecasts the device's active batch. Without one, its recent
+// history is forecast from the highest reading, where the latest fermentation
+// would have started.
+func DeviceForecast(datastore Datastore, id string) (Forecast, error) {
+	if batch, err := datastore.GetActiveBatch(id); err == nil {
+		metrics, err := datastore.GetBatchMetrics(batch)
+		if err != nil {
+			return Forecast{}, err
+		}
+		return NewForecast(metrics)
+	}
+
+	now := time.Now()
+	metrics, err := datastore.GetDeviceMetricsBetween(id, now.Add(-ForecastWindow), now)
+	if err != nil {
+		return Forecast{}, err
+	}
+	start := 0
+	for i, m := range metrics {
+		if m.Gravity > metrics[start].Gravity {
+			start = i
+		}
+	}
+	return NewForecast(metrics[start:])
+}
+
+// BacktestResult compares the forecast from the start of a fermentation to
+// what actually happened
+type BacktestResult struct {
+	Batch Batch
+	// Cutoff is the fraction of the fermentation fitted
+	Cutoff   float64
+	Forecast Forecast
+	// FinalGravity is the mean of the last StableReadings readings, and
+	// Completion when gravity first came within CompletionTolerance of it
+	FinalGravity float64
+	Completion   time.Time
+}
+
+// GravityError is the forecast's final gravity error in points
+func (r BacktestResult) GravityError() float64 {
+	return (r.Forecast.FinalGravity - r.FinalGravity) * 1000
+}
+
+// CompletionError is how much later than it did the forecast expected
+// fermentation to finish
+func (r BacktestResult) CompletionError() time.Duration {
+	return r.Forecast.Completion.Sub(r.Completion)
+}
+
+// Backtest replays the metrics of an ended batch, forecasting from the first
+// cutoff fraction of its readings
+func Backtest(batch Batch, metrics []Metric, cutoff float64) (BacktestResult, error) {
+	result := BacktestResult{Batch: batch, Cutoff: cutoff}
+	if len(metrics) < StableReadings {
+		return result, fmt.Errorf("Batch %d has too few readings to back-test", batch.ID)
+	}
+
+	tail := metrics[len(metrics)-StableReadings:]
+	for _, m := range tail {
+		result.FinalGravity += m.Gravity / StableReadings
+	}
+	for _, m := range metrics {
+		if m.Gravity-result.FinalGravity <= CompletionTolerance {
+			result.Completion = m.Created
+			break
+		}
+	}
+
+	var err error
+	result.Forecast, err = NewForecast(metrics[:int(float64(len(metrics))*cutoff)])
+	return result, err
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+// logisticSeries returns readings every two hours for the given days of a
+// fermentation from og to fg, falling fastest at midpoint days with the given
+// rate per day, each offset by the matching noise, if any
+func logisticSeries(start time.Time, og float64, fg float64, rate float64, midpoint float64, days float64, noise ...float64) []Metric {
+	metrics := []Metric{}
+	for i := 0; float64(i)/12 <= days; i++ {
+		day := float64(i) / 12
+		gravity := fg + (og-fg)/(1+math.Exp(rate*(day-midpoint)))
+		if len(noise) > 0 {
+			gravity += noise[i%len(noise)]
+		}
+		metrics = append(metrics, Metric{
+			DeviceID: "tilt",
+			Gravity:  round(gravity, 4),
+			Created:  start.Add(time.Duration(i) * 2 * time.Hour),
+		})
+	}
+	return metrics
+}
+
+// logisticCompletion is when the logistic curve comes within
+// CompletionTolerance of fg
+func logisticCompletion(start time.Time, og float64, fg float64, rate float64, midpoint float64) time.Time {
+	days := midpoint + math.Log((og-fg)/CompletionTolerance-1)/rate
+	return start.Add(time.Duration(days * 24 * float64(time.Hour)))
+}
+
+func TestNewForecast(t *testing.T) {
+	start := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	noise := []float64{0.0004, -0.0003, 0.0001, -0.0005, 0.0002, 0.0003, -0.0002}
+	tests := []struct {
+		name       string
+		og         float64
+		fg         float64
+		rate       float64
+		midpoint   float64
+		days       float64
+		noise      []float64
+		gravity    float64
+		completion time.Duration
+	}{
+		{"whole fermentation", 1.060, 1.012, 1.5, 3, 10, nil, 0.0005, 2 * time.Hour},
+		{"past the midpoint", 1.060, 1.012, 1.5, 3, 4, nil, 0.001, 6 * time.Hour},
+		{"noisy readings", 1.050, 1.010, 1, 4, 10, noise, 0.001, 12 * time.Hour},
+		{"strong beer", 1.090, 1.020, 0.8, 5, 14, nil, 0.001, 6 * time.Hour},
+	}
+	for _, test := range tests {
+		metrics := logisticSeries(start, test.og, test.fg, test.rate, test.midpoint, test.days, test.noise...)
+		forecast, err := NewForecast(metrics)
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+		if forecast.Readings != len(metrics) {
+			t.Errorf("%s: fitted %d readings, want %d", test.name, forecast.Readings, len(metrics))
+		}
+		if math.Abs(forecast.FinalGravity-test.fg) > test.gravity {
+			t.Errorf("%s: final gravity %.4f, want %.4f", test.name, forecast.FinalGravity, test.fg)
+		}
+		if math.Abs(forecast.OriginalGravity-test.og) > 0.002 {
+			t.Errorf("%s: original gravity %.4f, want %.4f", test.name, forecast.OriginalGravity, test.og)
+		}
+		completion := logisticCompletion(start, test.og, test.fg, test.rate, test.midpoint)
+		if diff := forecast.Completion.Sub(completion); diff < -test.completion || diff > test.completion {
+			t.Errorf("%s: completion %s, want %s", test.name, forecast.Completion, completion)
+		}
+
+		// The confidence band contains the best fit, and is only as wide as
+		// the data leaves it uncertain
+		if forecast.FinalGravityLow > forecast.FinalGravity || forecast.FinalGravityHigh < forecast.FinalGravity {
+			t.Errorf("%s: final gravity %.4f outside %.4f-%.4f", test.name, forecast.FinalGravity, forecast.FinalGravityLow, forecast.FinalGravityHigh)
+		}
+		if forecast.FinalGravityHigh-forecast.FinalGravityLow > 0.005 {
+			t.Errorf("%s: final gravity range %.4f-%.4f too wide", test.name, forecast.FinalGravityLow, forecast.FinalGravityHigh)
+		}
+		if forecast.CompletionEarliest.After(forecast.Completion) || forecast.CompletionLatest.Before(forecast.Completion) {
+			t.Errorf("%s: completion %s outside %s-%s", test.name, forecast.Completion, forecast.CompletionEarliest, forecast.CompletionLatest)
+		}
+	}
+}
+
+func TestForecastConfidenceNarrows(t *testing.T) {
+	start := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	width := func(days float64) float64 {
+		forecast, err := NewForecast(logisticSeries(start, 1.060, 1.012, 1.5, 3, days, 0.0004, -0.0004, 0.0002))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return forecast.FinalGravityHigh - forecast.FinalGravityLow
+	}
+	if early, late := width(3.5), width(10); late > early {
+		t.Errorf("final gravity range widened from %.4f to %.4f with more readings", early, late)
+	}
+}
+
+func TestForecastDegenerateHistories(t *testing.T) {
+	start := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	flat := logisticSeries(start, 1.050, 1.050, 1, 3, 5)
+	rising := logisticSeries(start, 1.010, 1.050, 1, 3, 5)
+	tests := []struct {
+		name    string
+		metrics []Metric
+	}{
+		{"no readings", nil},
+		{"too few readings", logisticSeries(start, 1.060, 1.012, 1.5, 3, 10)[:MinForecastReadings-1]},
+		{"flat gravity", flat},
+		{"rising gravity", rising},
+	}
+	for _, test := range tests {
+		if forecast, err := NewForecast(test.metrics); err == nil {
+			t.Errorf("%s: forecast %+v", test.name, forecast)
+		}
+	}
+}
+
+func TestBacktest(t *testing.T) {
+	start := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	metrics := logisticSeries(start, 1.060, 1.012, 1.5, 3, 10)
+	batch := Batch{ID: 1, DeviceID: "tilt", Started: start}
+
+	result, err := Backtest(batch, metrics, 0.5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if math.Abs(result.FinalGravity-1.012) > 0.0001 {
+		t.Errorf("actual final gravity %.4f, want 1.0120", result.FinalGravity)
+	}
+	completion := logisticCompletion(start, 1.060, 1.012, 1.5, 3)
+	if diff := result.Completion.Sub(completion); diff < -2*time.Hour || diff > 2*time.Hour {
+		t.Errorf("actual completion %s, want %s", result.Completion, completion)
+	}
+	if result.Forecast.Readings != len(metrics)/2 {
+		t.Errorf("forecast from %d readings, want %d", result.Forecast.Readings, len(metrics)/2)
+	}
+	if math.Abs(result.GravityError()) > 0.5 {
+		t.Errorf("final gravity off by %.1f points", result.GravityError())
+	}
+	if diff := result.CompletionError(); diff < -4*time.Hour || diff > 4*time.Hour {
+		t.Errorf("completion off by %s", diff)
+	}
+
+	if _, err := Backtest(batch, metrics, 0.05); err == nil {
+		t.Error("Back-tested from too few readings")
+	}
+	if _, err := Backtest(batch, metrics[:StableReadings-1], 1); err == nil {
+		t.Error("Back-tested a batch with too few readings")
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	// ForwardTilt posts the form fields of the Tilt app's cloud URL, as used
+	// by its Google Sheets template
+	ForwardTilt = "tilt"
+	// ForwardBrewfather posts Brewfather custom stream JSON
+	ForwardBrewfather = "brewfather"
+	// ForwardBrewersFriend posts Brewer's Friend stream JSON
+	ForwardBrewersFriend = "brewersfriend"
+)
+
+// ValidateEndpoint checks the device's endpoint can be forwarded to
+func ValidateEndpoint(device Device) error {
+	switch device.EndpointFormat {
+	case "", ForwardTilt, ForwardBrewfather, ForwardBrewersFriend:
+	default:
+		return fmt.Errorf("Unknown endpoint format: %s", device.EndpointFormat)
+	}
+	if device.Endpoint == "" {
+		return nil
+	}
+	endpoint, err := url.Parse(device.Endpoint)
+	if err != nil || (endpoint.Scheme != "http" && endpoint.Scheme != "https") || endpoint.Host == "" {
+		return fmt.Errorf("Invalid endpoint URL: %s", device.Endpoint)
+	}
+	return nil
+}
+
+// NewForwardMessage formats the metric for the device's endpoint, in the
+// Tilt app's format unless another is set. Beer is the name of the active
+// batch, if any.
+func NewForwardMessage(device Device, beer string, metric Metric) (OutboxMessage, error) {
+	message := OutboxMessage{Destination: "forward:" + device.ID, URL: device.Endpoint}
+	name := displayName(device)
+
+	var body interface{}
+	switch device.EndpointFormat {
+	case "", ForwardTilt:
+		if beer == "" {
+			beer = name
+		}
+		form := url.Values{}
+		form.Set("Timepoint", fmt.Sprint(spreadsheetDate(metric.Created)))
+		form.Set("Temp", fmt.Sprint(metric.Temperature))
+		form.Set("SG", fmt.Sprint(metric.Gravity))
+		form.Set("Beer", beer)
+		form.Set("Color", strings.ToUpper(device.Color))
+		form.Set("Comment", "")
+		message.ContentType = "application/x-www-form-urlencoded"
+		message.Body = form.Encode()
+		return message, nil
+	case ForwardBrewfather:
+		body = map[string]interface{}{
+			"name":         name,
+			"beer":         beer,
+			"temp":         metric.Temperature,
+			"temp_unit":    "F",
+			"gravity":      metric.Gravity,
+			"gravity_unit": "G",
+		}
+	case ForwardBrewersFriend:
+		body = map[string]interface{}{
+			"name":          name,
+			"beer":          beer,
+			"device_source": "Tilt",
+			"report_source": "hydromonitor",
+			"temp":          metric.Temperature,
+			"temp_unit":     "F",
+			"gravity":       metric.Gravity,
+			"gravity_unit":  "G",
+			"rssi":          metric.Power,
+		}
+	default:
+		return message, fmt.Errorf("Unknown endpoint format: %s", device.EndpointFormat)
+	}
+
+	encoded, err := json.Marshal(body)
+	message.ContentType = "application/json"
+	message.Body = string(encoded)
+	return message, err
+}
+
+// spreadsheetDate is the fractional days since 1899-12-30 of the time's wall
+// clock, as sent by the Tilt app
+func spreadsheetDate(t time.Time) float64 {
+	wall := time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), time.UTC)
+	return wall.Sub(time.Date(1899, 12, 30, 0, 0, 0, 0, time.UTC)).Hours() / 24
+}
+
+// displayName is the device's name, or its color when it hasn't been named
+func displayName(device Device) string {
+	if device.Name != "" {
+		return device.Name
+	}
+	return fmt.Sprintf("Tilt %s", strings.Title(device.Color))
+}
+
+// Forwarder queues each metric for the endpoint of its device, if set
+type Forwarder struct {
+	datastore Datastore
+	events    *EventBus
+	outbox    *Outbox
+}
+
+// NewForwarder returns a forwarder delivering through the outbox
+func NewForwarder(datastore Datastore, events *EventBus, outbox *Outbox) *Forwarder {
+	return &Forwarder{datastore: datastore, events: events, outbox: outbox}
+}
+
+// Run forwards metrics until the events subscription is closed
+func (f *Forwarder) Run() {
+	metrics := f.events.SubscribeReliable(NewEventFilter("", EventMetric))
+	for e := range metrics {
+		if err := f.Forward(e.DeviceID, e.Data.(Metric)); err != nil {
+			log.Errorf("[forward] Error forwarding metric for %s: %s", e.DeviceID, err)
+		}
+	}
+}
+
+// Forward queues the metric for the device's endpoint
+func (f *Forwarder) Forward(deviceID string, metric Metric) error {
+	device, err := f.datastore.GetDevice(deviceID)
+	if err != nil || device.Endpoint == "" {
+		return err
+	}
+
+	beer := ""
+	batch, err := f.datastore.GetActiveBatch(deviceID)
+	if err == nil {
+		beer = batch.Name
+	} else if err != sql.ErrNoRows {
+		return err
+	}
+
+	message, err := NewForwardMessage(device, beer, metric)
+	if err != nil {
+		return err
+	}
+	return f.outbox.Enqueue(message)
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	scansTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "hydromonitor_scans_total",
+		Help: "Scans run for new tilts.",
+	})
+	devicesFoundTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "hydromonitor_devices_found_total",
+		Help: "Tilts found by scans.",
+	})
+	pollsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "hydromonitor_polls_total",
+		Help: "Device metric refreshes by polling, by result (success or failure).",
+	}, []string{"result"})
+	dialDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "hydromonitor_ble_dial_duration_seconds",
+		Help:    "Time taken to connect to a tilt to refresh its metrics, by result.",
+		Buckets: []float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 15, 30},
+	}, []string{"result"})
+	queryDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "hydromonitor_datastore_query_duration_seconds",
+		Help:    "Time taken by datastore queries, by datastore method.",
+		Buckets: prometheus.ExponentialBuckets(0.0005, 4, 8),
+	}, []string{"query"})
+)
+
+func init() {
+	prometheus.MustRegister(scansTotal, devicesFoundTotal, pollsTotal, dialDuration, queryDuration)
+}
+
+// outcome labels whether an operation succeeded
+func outcome(err error) string {
+	if err != nil {
+		return "failure"
+	}
+	return "success"
+}
+
+// observeQuery records the time since start against the datastore method,
+// deferred at the top of each method
+func observeQuery(query string, start time.Time) {
+	queryDuration.WithLabelValues(query).Observe(time.Since(start).Seconds())
+}
+
+// deviceLabels identify the device of each device gauge
+var deviceLabels = []string{"id", "name", "color"}
+
+// DeviceCollector exports the latest reading of each tilt in the state as
+// gauges. Devices are loaded from the datastore on every scrape, so removed
+// and renamed devices don't leave stale series behind, but their readings
+// come from the state rather than querying every device's latest metric.
+type DeviceCollector struct {
+	datastore Datastore
+	state     *State
+
+	gravity     *prometheus.Desc
+	temperature *prometheus.Desc
+	battery     *prometheus.Desc
+	rssi        *prometheus.Desc
+	lastSeen    *prometheus.Desc
+}
+
+// NewDeviceCollector returns a collector for the stored devices
+func NewDeviceCollector(datastore Datastore, state *State) *DeviceCollector {
+	return &DeviceCollector{
+		datastore:   datastore,
+		state:       state,
+		gravity:     prometheus.NewDesc("hydromonitor_device_gravity", "Latest specific gravity.", deviceLabels, nil),
+		temperature: prometheus.NewDesc("hydromonitor_device_temperature_celsius", "Latest temperature.", deviceLabels, nil),
+		battery:     prometheus.NewDesc("hydromonitor_device_battery", "Latest battery level.", deviceLabels, nil),
+		rssi:        prometheus.NewDesc("hydromonitor_device_rssi_dbm", "Latest signal strength.", deviceLabels, nil),
+		lastSeen:    prometheus.NewDesc("hydromonitor_device_last_seen_timestamp_seconds", "Time of the latest reading.", deviceLabels, nil),
+	}
+}
+
+// Describe implements prometheus.Collector
+func (c *DeviceCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.gravity
+	ch <- c.temperature
+	ch <- c.battery
+	ch <- c.rssi
+	ch <- c.lastSeen
+}
+
+// Collect implements prometheus.Collector
+func (c *DeviceCollector) Collect(ch chan<- prometheus.Metric) {
+	devices, err := c.datastore.GetDevices()
+	if err != nil {
+		log.Errorf("[metrics] Error loading devices: %s", err)
+		ch <- prometheus.NewInvalidMetric(c.gravity, err)
+		return
+	}
+
+	latest := c.state.LatestMetrics()
+	for _, device := range devices {
+		m, ok := latest[device.ID]
+		if !ok {
+			continue
+		}
+		labels := []string{device.ID, device.Name, device.Color}
+		ch <- prometheus.MustNewConstMetric(c.gravity, prometheus.GaugeValue, m.Gravity, labels...)
+		ch <- prometheus.MustNewConstMetric(c.temperature, prometheus.GaugeValue, FahrenheitToCelsius(m.Temperature), labels...)
+		ch <- prometheus.MustNewConstMetric(c.battery, prometheus.GaugeValue, float64(m.Battery), labels...)
+		ch <- prometheus.MustNewConstMetric(c.rssi, prometheus.GaugeValue, float64(m.Power), labels...)
+		ch <- prometheus.MustNewConstMetric(c.lastSeen, prometheus.GaugeValue, float64(m.Created.UnixNano())/1e9, labels...)
+	}
+}
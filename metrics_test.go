@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// staticTransport reads the same metric from every tilt
+type staticTransport struct {
+	metric Metric
+}
+
+func (s staticTransport) Scan(ctx context.Context, known func(string) bool, found func(*TiltClient)) error {
+	return nil
+}
+
+func (s staticTransport) ReadMetrics(tilt *TiltClient) (Metric, error) {
+	metric := s.metric
+	metric.DeviceID = tilt.Address.String()
+	return metric, nil
+}
+
+// scrapeDatastore fails the test if a scrape loads every device's latest
+// metric from the datastore
+type scrapeDatastore struct {
+	Datastore
+	t        *testing.T
+	scraping bool
+}
+
+func (d *scrapeDatastore) GetDevicesWithMetrics() ([]Device, error) {
+	if d.scraping {
+		d.t.Error("Scrape queried the latest metric of every device")
+	}
+	return d.Datastore.GetDevicesWithMetrics()
+}
+
+func deviceGauges(name string, color string, gravity float64, created time.Time, ids ...string) string {
+	text := `
+# HELP hydromonitor_device_gravity Latest specific gravity.
+# TYPE hydromonitor_device_gravity gauge
+`
+	for _, id := range ids {
+		text += fmt.Sprintf("hydromonitor_device_gravity{color=%q,id=%q,name=%q} %g\n", color, id, name, gravity)
+	}
+	text += `
+# HELP hydromonitor_device_last_seen_timestamp_seconds Time of the latest reading.
+# TYPE hydromonitor_device_last_seen_timestamp_seconds gauge
+`
+	for _, id := range ids {
+		text += fmt.Sprintf("hydromonitor_device_last_seen_timestamp_seconds{color=%q,id=%q,name=%q} %d\n", color, id, name, created.Unix())
+	}
+	return text
+}
+
+func TestDeviceCollector(t *testing.T) {
+	d := &scrapeDatastore{Datastore: newTestDatastore(t), t: t}
+	read := time.Unix(1700000000, 0)
+	for _, id := range []string{"a4:95:00:00:10:bb", "a4:95:00:00:20:bb", "a4:95:00:00:30:bb"} {
+		if err := d.CreateOrUpdateDevice(Device{ID: id, Name: "Fermenter", Color: "red"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, id := range []string{"a4:95:00:00:10:bb", "a4:95:00:00:30:bb"} {
+		if err := d.CreateMetric(Metric{DeviceID: id, Gravity: 1.050, Temperature: 68, Battery: 90, Power: -70, Created: read}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := d.DisableDevice("a4:95:00:00:30:bb", "manually"); err != nil {
+		t.Fatal(err)
+	}
+
+	refreshed := read.Add(time.Hour)
+	state := NewState(d, staticTransport{Metric{Gravity: 1.040, Temperature: 50, Battery: 80, Power: -60, Created: refreshed}}, NewEventBus(), time.Second, 1, 0, 0)
+	if err := state.Load(); err != nil {
+		t.Fatal(err)
+	}
+	d.scraping = true
+	collector := NewDeviceCollector(d, state)
+
+	// Loaded tilts start from their stored reading, and those never read or
+	// disabled have none
+	if err := testutil.CollectAndCompare(collector, strings.NewReader(deviceGauges("Fermenter", "red", 1.050, read, "a4:95:00:00:10:bb")),
+		"hydromonitor_device_gravity", "hydromonitor_device_last_seen_timestamp_seconds"); err != nil {
+		t.Error(err)
+	}
+	expected := `
+# HELP hydromonitor_device_temperature_celsius Latest temperature.
+# TYPE hydromonitor_device_temperature_celsius gauge
+hydromonitor_device_temperature_celsius{color="red",id="a4:95:00:00:10:bb",name="Fermenter"} 20
+# HELP hydromonitor_device_battery Latest battery level.
+# TYPE hydromonitor_device_battery gauge
+hydromonitor_device_battery{color="red",id="a4:95:00:00:10:bb",name="Fermenter"} 90
+# HELP hydromonitor_device_rssi_dbm Latest signal strength.
+# TYPE hydromonitor_device_rssi_dbm gauge
+hydromonitor_device_rssi_dbm{color="red",id="a4:95:00:00:10:bb",name="Fermenter"} -70
+`
+	if err := testutil.CollectAndCompare(collector, strings.NewReader(expected),
+		"hydromonitor_device_temperature_celsius", "hydromonitor_device_battery", "hydromonitor_device_rssi_dbm"); err != nil {
+		t.Error(err)
+	}
+
+	// Reads replace the readings, and renames are picked up
+	for _, id := range []string{"a4:95:00:00:10:bb", "a4:95:00:00:20:bb"} {
+		if err := state.RefreshTilt(id); err != nil {
+			t.Fatal(err)
+		}
+		if err := d.UpdateDevice(Device{ID: id, Name: "Conical"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := testutil.CollectAndCompare(collector, strings.NewReader(deviceGauges("Conical", "red", 1.040, refreshed, "a4:95:00:00:10:bb", "a4:95:00:00:20:bb")),
+		"hydromonitor_device_gravity", "hydromonitor_device_last_seen_timestamp_seconds"); err != nil {
+		t.Error(err)
+	}
+
+	// Deleted devices are left out
+	if err := d.DeleteDevice("a4:95:00:00:10:bb"); err != nil {
+		t.Fatal(err)
+	}
+	state.Forget("a4:95:00:00:10:bb")
+	if count := testutil.CollectAndCount(collector); count != 5 {
+		t.Errorf("collected %d gauges, want 5 for one device", count)
+	}
+}
@@ -0,0 +1,436 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// Migration upgrades the database schema from the previous version
+type Migration struct {
+	Version     int
+	Description string
+	SQLite      string
+	Postgres    string
+}
+
+// migrations must only ever be appended to, as each is applied exactly once
+// to every database in the field
+var migrations = []Migration{
+	{
+		Version:     1,
+		Description: "create device and metric tables",
+		SQLite: `
+		CREATE TABLE IF NOT EXISTS device (
+		id VARCHAR(255) PRIMARY KEY,
+		name VARCHAR(255),
+		color VARCHAR(50),
+		endpoint TEXT,
+		disabled BOOLEAN,
+		error TEXT,
+		created TIMESTAMP,
+		updated TIMESTAMP
+		);
+		CREATE TABLE IF NOT EXISTS metric (
+		id INTEGER PRIMARY KEY,
+		device_id VARCHAR(255) NOT NULL,
+		power INTEGER,
+		battery INTEGER,
+		temperature INTEGER,
+		gravity REAL,
+		created TIMESTAMP
+		);
+		`,
+		Postgres: `
+		CREATE TABLE IF NOT EXISTS device (
+		id VARCHAR(255) PRIMARY KEY,
+		name VARCHAR(255),
+		color VARCHAR(50),
+		endpoint TEXT,
+		disabled BOOLEAN,
+		error TEXT,
+		created TIMESTAMPTZ,
+		updated TIMESTAMPTZ
+		);
+		CREATE TABLE IF NOT EXISTS metric (
+		id SERIAL PRIMARY KEY,
+		device_id VARCHAR(255) NOT NULL,
+		power INTEGER,
+		battery INTEGER,
+		temperature DOUBLE PRECISION,
+		gravity DOUBLE PRECISION,
+		created TIMESTAMPTZ
+		);
+		`,
+	},
+	{
+		Version:     2,
+		Description: "create batch table",
+		SQLite: `
+		CREATE TABLE IF NOT EXISTS batch (
+		id INTEGER PRIMARY KEY,
+		name VARCHAR(255),
+		style VARCHAR(255),
+		device_id VARCHAR(255),
+		started TIMESTAMP,
+		ended TIMESTAMP,
+		original_gravity REAL,
+		target_gravity REAL,
+		notes TEXT,
+		created TIMESTAMP,
+		updated TIMESTAMP
+		);
+		`,
+		Postgres: `
+		CREATE TABLE IF NOT EXISTS batch (
+		id SERIAL PRIMARY KEY,
+		name VARCHAR(255),
+		style VARCHAR(255),
+		device_id VARCHAR(255),
+		started TIMESTAMPTZ,
+		ended TIMESTAMPTZ,
+		original_gravity DOUBLE PRECISION,
+		target_gravity DOUBLE PRECISION,
+		notes TEXT,
+		created TIMESTAMPTZ,
+		updated TIMESTAMPTZ
+		);
+		`,
+	},
+	{
+		Version:     3,
+		Description: "add metric aggregate tables and index",
+		SQLite: `
+		CREATE INDEX IF NOT EXISTS metric_device_created ON metric (device_id, created);
+		CREATE TABLE IF NOT EXISTS metric_hourly (
+		device_id VARCHAR(255) NOT NULL,
+		bucket INTEGER NOT NULL,
+		count INTEGER,
+		min_gravity REAL,
+		max_gravity REAL,
+		avg_gravity REAL,
+		min_temperature REAL,
+		max_temperature REAL,
+		avg_temperature REAL,
+		PRIMARY KEY (device_id, bucket)
+		);
+		CREATE TABLE IF NOT EXISTS metric_daily (
+		device_id VARCHAR(255) NOT NULL,
+		bucket INTEGER NOT NULL,
+		count INTEGER,
+		min_gravity REAL,
+		max_gravity REAL,
+		avg_gravity REAL,
+		min_temperature REAL,
+		max_temperature REAL,
+		avg_temperature REAL,
+		PRIMARY KEY (device_id, bucket)
+		);
+		`,
+		Postgres: `
+		CREATE INDEX IF NOT EXISTS metric_device_created ON metric (device_id, created);
+		CREATE TABLE IF NOT EXISTS metric_hourly (
+		device_id VARCHAR(255) NOT NULL,
+		bucket BIGINT NOT NULL,
+		count INTEGER,
+		min_gravity DOUBLE PRECISION,
+		max_gravity DOUBLE PRECISION,
+		avg_gravity DOUBLE PRECISION,
+		min_temperature DOUBLE PRECISION,
+		max_temperature DOUBLE PRECISION,
+		avg_temperature DOUBLE PRECISION,
+		PRIMARY KEY (device_id, bucket)
+		);
+		CREATE TABLE IF NOT EXISTS metric_daily (
+		device_id VARCHAR(255) NOT NULL,
+		bucket BIGINT NOT NULL,
+		count INTEGER,
+		min_gravity DOUBLE PRECISION,
+		max_gravity DOUBLE PRECISION,
+		avg_gravity DOUBLE PRECISION,
+		min_temperature DOUBLE PRECISION,
+		max_temperature DOUBLE PRECISION,
+		avg_temperature DOUBLE PRECISION,
+		PRIMARY KEY (device_id, bucket)
+		);
+		`,
+	},
+	{
+		Version:     4,
+		Description: "add device calibration",
+		SQLite: `
+		ALTER TABLE device ADD COLUMN gravity_offset REAL NOT NULL DEFAULT 0;
+		ALTER TABLE device ADD COLUMN temperature_offset REAL NOT NULL DEFAULT 0;
+		ALTER TABLE metric ADD COLUMN raw_gravity REAL;
+		ALTER TABLE metric ADD COLUMN raw_temperature INTEGER;
+		UPDATE metric SET raw_gravity = gravity, raw_temperature = temperature;
+		CREATE TABLE IF NOT EXISTS calibration_point (
+		id INTEGER PRIMARY KEY,
+		device_id VARCHAR(255) NOT NULL,
+		raw REAL,
+		actual REAL,
+		created TIMESTAMP
+		);
+		`,
+		Postgres: `
+		ALTER TABLE device ADD COLUMN gravity_offset DOUBLE PRECISION NOT NULL DEFAULT 0;
+		ALTER TABLE device ADD COLUMN temperature_offset DOUBLE PRECISION NOT NULL DEFAULT 0;
+		ALTER TABLE metric ADD COLUMN raw_gravity DOUBLE PRECISION;
+		ALTER TABLE metric ADD COLUMN raw_temperature DOUBLE PRECISION;
+		UPDATE metric SET raw_gravity = gravity, raw_temperature = temperature;
+		CREATE TABLE IF NOT EXISTS calibration_point (
+		id SERIAL PRIMARY KEY,
+		device_id VARCHAR(255) NOT NULL,
+		raw DOUBLE PRECISION,
+		actual DOUBLE PRECISION,
+		created TIMESTAMPTZ
+		);
+		`,
+	},
+	{
+		Version:     5,
+		Description: "add device unit preferences",
+		SQLite: `
+		ALTER TABLE device ADD COLUMN gravity_units VARCHAR(10) NOT NULL DEFAULT '';
+		ALTER TABLE device ADD COLUMN temperature_units VARCHAR(10) NOT NULL DEFAULT '';
+		`,
+		Postgres: `
+		ALTER TABLE device ADD COLUMN gravity_units VARCHAR(10) NOT NULL DEFAULT '';
+		ALTER TABLE device ADD COLUMN temperature_units VARCHAR(10) NOT NULL DEFAULT '';
+		`,
+	},
+	{
+		Version:     6,
+		Description: "add device fermentation stage",
+		SQLite: `
+		ALTER TABLE device ADD COLUMN stage VARCHAR(20) NOT NULL DEFAULT '';
+		ALTER TABLE device ADD COLUMN stalled BOOLEAN NOT NULL DEFAULT 0;
+		ALTER TABLE device ADD COLUMN terminal_gravity BOOLEAN NOT NULL DEFAULT 0;
+		`,
+		Postgres: `
+		ALTER TABLE device ADD COLUMN stage VARCHAR(20) NOT NULL DEFAULT '';
+		ALTER TABLE device ADD COLUMN stalled BOOLEAN NOT NULL DEFAULT false;
+		ALTER TABLE device ADD COLUMN terminal_gravity BOOLEAN NOT NULL DEFAULT false;
+		`,
+	},
+	{
+		Version:     7,
+		Description: "create alert_rule and alert tables",
+		SQLite: `
+		CREATE TABLE IF NOT EXISTS alert_rule (
+		id INTEGER PRIMARY KEY,
+		name VARCHAR(255) NOT NULL,
+		metric VARCHAR(20) NOT NULL,
+		comparator VARCHAR(2) NOT NULL,
+		threshold REAL NOT NULL,
+		hysteresis REAL NOT NULL DEFAULT 0,
+		duration INTEGER NOT NULL DEFAULT 0,
+		device_id VARCHAR(255) NOT NULL DEFAULT '',
+		batch_id INTEGER NOT NULL DEFAULT 0,
+		disabled BOOLEAN NOT NULL DEFAULT 0,
+		created TIMESTAMP,
+		updated TIMESTAMP
+		);
+		CREATE TABLE IF NOT EXISTS alert (
+		id INTEGER PRIMARY KEY,
+		rule_id INTEGER NOT NULL,
+		device_id VARCHAR(255) NOT NULL,
+		state VARCHAR(20) NOT NULL,
+		value REAL,
+		started TIMESTAMP,
+		fired TIMESTAMP,
+		resolved TIMESTAMP,
+		updated TIMESTAMP
+		);
+		CREATE INDEX IF NOT EXISTS alert_rule_device ON alert (rule_id, device_id, state);
+		`,
+		Postgres: `
+		CREATE TABLE IF NOT EXISTS alert_rule (
+		id SERIAL PRIMARY KEY,
+		name VARCHAR(255) NOT NULL,
+		metric VARCHAR(20) NOT NULL,
+		comparator VARCHAR(2) NOT NULL,
+		threshold DOUBLE PRECISION NOT NULL,
+		hysteresis DOUBLE PRECISION NOT NULL DEFAULT 0,
+		duration INTEGER NOT NULL DEFAULT 0,
+		device_id VARCHAR(255) NOT NULL DEFAULT '',
+		batch_id INTEGER NOT NULL DEFAULT 0,
+		disabled BOOLEAN NOT NULL DEFAULT false,
+		created TIMESTAMPTZ,
+		updated TIMESTAMPTZ
+		);
+		CREATE TABLE IF NOT EXISTS alert (
+		id SERIAL PRIMARY KEY,
+		rule_id INTEGER NOT NULL,
+		device_id VARCHAR(255) NOT NULL,
+		state VARCHAR(20) NOT NULL,
+		value DOUBLE PRECISION,
+		started TIMESTAMPTZ,
+		fired TIMESTAMPTZ,
+		resolved TIMESTAMPTZ,
+		updated TIMESTAMPTZ
+		);
+		CREATE INDEX IF NOT EXISTS alert_rule_device ON alert (rule_id, device_id, state);
+		`,
+	},
+	{
+		Version:     8,
+		Description: "create notifier table",
+		SQLite: `
+		CREATE TABLE IF NOT EXISTS notifier (
+		id INTEGER PRIMARY KEY,
+		name VARCHAR(255) NOT NULL,
+		type VARCHAR(20) NOT NULL,
+		url TEXT NOT NULL,
+		template TEXT NOT NULL DEFAULT '',
+		to_address TEXT NOT NULL DEFAULT '',
+		from_address VARCHAR(255) NOT NULL DEFAULT '',
+		events VARCHAR(255) NOT NULL DEFAULT '',
+		rate_limit INTEGER NOT NULL DEFAULT 0,
+		disabled BOOLEAN NOT NULL DEFAULT 0,
+		created TIMESTAMP,
+		updated TIMESTAMP
+		);
+		`,
+		Postgres: `
+		CREATE TABLE IF NOT EXISTS notifier (
+		id SERIAL PRIMARY KEY,
+		name VARCHAR(255) NOT NULL,
+		type VARCHAR(20) NOT NULL,
+		url TEXT NOT NULL,
+		template TEXT NOT NULL DEFAULT '',
+		to_address TEXT NOT NULL DEFAULT '',
+		from_address VARCHAR(255) NOT NULL DEFAULT '',
+		events VARCHAR(255) NOT NULL DEFAULT '',
+		rate_limit INTEGER NOT NULL DEFAULT 0,
+		disabled BOOLEAN NOT NULL DEFAULT false,
+		created TIMESTAMPTZ,
+		updated TIMESTAMPTZ
+		);
+		`,
+	},
+	{
+		Version:     9,
+		Description: "add device endpoint format and create outbox table",
+		SQLite: `
+		ALTER TABLE device ADD COLUMN endpoint_format VARCHAR(20) NOT NULL DEFAULT '';
+		CREATE TABLE IF NOT EXISTS outbox (
+		id INTEGER PRIMARY KEY,
+		destination VARCHAR(255) NOT NULL,
+		url TEXT NOT NULL,
+		content_type VARCHAR(255) NOT NULL,
+		body TEXT NOT NULL,
+		attempts INTEGER NOT NULL DEFAULT 0,
+		error TEXT NOT NULL DEFAULT '',
+		next_attempt TIMESTAMP,
+		created TIMESTAMP
+		);
+		`,
+		Postgres: `
+		ALTER TABLE device ADD COLUMN endpoint_format VARCHAR(20) NOT NULL DEFAULT '';
+		CREATE TABLE IF NOT EXISTS outbox (
+		id SERIAL PRIMARY KEY,
+		destination VARCHAR(255) NOT NULL,
+		url TEXT NOT NULL,
+		content_type VARCHAR(255) NOT NULL,
+		body TEXT NOT NULL,
+		attempts INTEGER NOT NULL DEFAULT 0,
+		error TEXT NOT NULL DEFAULT '',
+		next_attempt TIMESTAMPTZ,
+		created TIMESTAMPTZ
+		);
+		`,
+	},
+	{
+		Version:     10,
+		Description: "add outbox message kind, headers and dead letters",
+		SQLite: `
+		ALTER TABLE outbox ADD COLUMN kind VARCHAR(20) NOT NULL DEFAULT 'http';
+		ALTER TABLE outbox ADD COLUMN headers TEXT NOT NULL DEFAULT '';
+		ALTER TABLE outbox ADD COLUMN dead BOOLEAN NOT NULL DEFAULT 0;
+		CREATE INDEX IF NOT EXISTS outbox_destination ON outbox (destination);
+		`,
+		Postgres: `
+		ALTER TABLE outbox ADD COLUMN kind VARCHAR(20) NOT NULL DEFAULT 'http';
+		ALTER TABLE outbox ADD COLUMN headers TEXT NOT NULL DEFAULT '';
+		ALTER TABLE outbox ADD COLUMN dead BOOLEAN NOT NULL DEFAULT false;
+		CREATE INDEX IF NOT EXISTS outbox_destination ON outbox (destination);
+		`,
+	},
+	{
+		Version:     11,
+		Description: "add device poll interval",
+		SQLite: `
+		ALTER TABLE device ADD COLUMN poll_interval INTEGER NOT NULL DEFAULT 0;
+		`,
+		Postgres: `
+		ALTER TABLE device ADD COLUMN poll_interval INTEGER NOT NULL DEFAULT 0;
+		`,
+	},
+}
+
+// SchemaVersion returns the version of the last migration applied
+func (d *SQLDatastore) SchemaVersion() (int, error) {
+	defer observeQuery("SchemaVersion", time.Now())
+	var tables int
+	if err := d.db.Get(&tables, d.db.Rebind(d.dialect.tableExists()), "schema_version"); err != nil || tables == 0 {
+		return 0, err
+	}
+
+	var version int
+	err := d.db.Get(&version, "SELECT COALESCE(MAX(version), 0) FROM schema_version")
+	return version, err
+}
+
+// Migrate applies every pending migration in order, each in its own
+// transaction, returning those applied. With dryRun set the pending
+// migrations are returned without being applied.
+func (d *SQLDatastore) Migrate(dryRun bool) ([]Migration, error) {
+	defer observeQuery("Migrate", time.Now())
+	applied := []Migration{}
+
+	version, err := d.SchemaVersion()
+	if err != nil {
+		return applied, err
+	}
+
+	if !dryRun {
+		if _, err := d.db.Exec(`
+		CREATE TABLE IF NOT EXISTS schema_version (
+		version INTEGER PRIMARY KEY,
+		description TEXT,
+		applied TIMESTAMP
+		);
+		`); err != nil {
+			return applied, err
+		}
+	}
+
+	for _, m := range migrations {
+		if m.Version <= version {
+			continue
+		}
+		if dryRun {
+			applied = append(applied, m)
+			continue
+		}
+
+		tx, err := d.db.Beginx()
+		if err != nil {
+			return applied, err
+		}
+		if _, err := tx.Exec(d.dialect.schema(m)); err != nil {
+			tx.Rollback()
+			return applied, fmt.Errorf("Migration %d (%s) failed: %s", m.Version, m.Description, err)
+		}
+		if _, err := tx.Exec(tx.Rebind("INSERT INTO schema_version (version, description, applied) VALUES (?,?,?)"), m.Version, m.Description, time.Now()); err != nil {
+			tx.Rollback()
+			return applied, err
+		}
+		if err := tx.Commit(); err != nil {
+			return applied, err
+		}
+		applied = append(applied, m)
+	}
+
+	return applied, nil
+}
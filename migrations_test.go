@@ -0,0 +1,106 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// baselineSchema is the schema of databases created before migrations, which
+// have no schema_version table
+const baselineSchema = `
+CREATE TABLE IF NOT EXISTS device (
+id VARCHAR(255) PRIMARY KEY,
+name VARCHAR(255),
+color VARCHAR(50),
+endpoint TEXT,
+disabled BOOLEAN,
+error TEXT,
+created TIMESTAMP,
+updated TIMESTAMP
+);
+CREATE TABLE IF NOT EXISTS metric (
+id INTEGER PRIMARY KEY,
+device_id VARCHAR(255) NOT NULL,
+power INTEGER,
+battery INTEGER,
+temperature INTEGER,
+gravity REAL,
+created TIMESTAMP
+);
+`
+
+func TestMigrateBaselineDatabase(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "baseline.sql")
+	db, err := sqlx.Open("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.MustExec(baselineSchema)
+	created := time.Date(2017, 6, 1, 12, 0, 0, 0, time.Local)
+	db.MustExec("INSERT OR IGNORE INTO device VALUES (?,?,?,?,?,?,?,?)", "a4:c1:38:00:00:01", "Pale Ale", "red", "http://example.com/log", false, "", created, created)
+	for i := 0; i < 3; i++ {
+		db.MustExec("INSERT INTO metric (device_id, power, battery, temperature, gravity, created) VALUES (?,?,?,?,?,?)",
+			"a4:c1:38:00:00:01", -70, 90, 68+i, 1.050-float64(i)*0.01, created.Add(time.Duration(i)*time.Hour))
+	}
+	db.Close()
+
+	d, err := OpenDatastore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	if version, err := d.SchemaVersion(); err != nil || version != 0 {
+		t.Fatalf("baseline schema version = %d, %v; want 0", version, err)
+	}
+	applied, err := d.Migrate(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	latest := migrations[len(migrations)-1].Version
+	if len(applied) != len(migrations) {
+		t.Errorf("applied %d migrations, want %d", len(applied), len(migrations))
+	}
+	if version, err := d.SchemaVersion(); err != nil || version != latest {
+		t.Errorf("schema version = %d, %v; want %d", version, err, latest)
+	}
+	if again, err := d.Migrate(false); err != nil || len(again) != 0 {
+		t.Errorf("migrating again applied %d migrations, %v", len(again), err)
+	}
+
+	device, err := d.GetDevice("a4:c1:38:00:00:01")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if device.Name != "Pale Ale" || device.Color != "red" || device.Endpoint != "http://example.com/log" || device.Disabled {
+		t.Errorf("device not kept: %+v", device)
+	}
+
+	metrics, err := d.GetDeviceMetricsBetween(device.ID, created, created.Add(2*time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(metrics) != 3 {
+		t.Fatalf("kept %d metrics, want 3", len(metrics))
+	}
+	for i, metric := range metrics {
+		if metric.Temperature != float64(68+i) || metric.Gravity != 1.050-float64(i)*0.01 || metric.Battery != 90 || metric.Power != -70 {
+			t.Errorf("metric %d not kept: %+v", i, metric)
+		}
+		// Readings from before calibration are their own raw readings
+		if metric.RawTemperature != metric.Temperature || metric.RawGravity != metric.Gravity {
+			t.Errorf("metric %d not kept: %+v", i, metric)
+		}
+	}
+
+	// The upgraded database takes new data like a fresh one
+	if err := d.CreateMetric(Metric{DeviceID: device.ID, Temperature: 67.5, Gravity: 1.020}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.GetDevicesWithMetrics(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	server "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/hooks/auth"
+	"github.com/mochi-mqtt/server/v2/listeners"
+)
+
+// startBroker serves an embedded broker on the address, returning a function
+// stopping it
+func startBroker(t *testing.T, address string) func() {
+	t.Helper()
+	broker := server.New(nil)
+	broker.AddHook(new(auth.AllowHook), nil)
+	if err := broker.AddListener(listeners.NewTCP("test", address, nil)); err != nil {
+		t.Fatal(err)
+	}
+	go broker.Serve()
+	for {
+		conn, err := net.Dial("tcp", address)
+		if err == nil {
+			conn.Close()
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	once := sync.Once{}
+	stop := func() { once.Do(func() { broker.Close() }) }
+	t.Cleanup(stop)
+	return stop
+}
+
+func freeAddress(t *testing.T) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	return listener.Addr().String()
+}
+
+// retained subscribes to every topic on the broker, returning the latest
+// payload of each
+type retained struct {
+	mu       sync.Mutex
+	messages map[string]string
+}
+
+func subscribe(t *testing.T, address string) *retained {
+	t.Helper()
+	r := &retained{messages: make(map[string]string)}
+	client := mqtt.NewClient(mqtt.NewClientOptions().AddBroker("tcp://" + address).SetClientID("test-subscriber"))
+	if err := wait(client.Connect()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Disconnect(0) })
+	err := wait(client.Subscribe("#", 1, func(_ mqtt.Client, message mqtt.Message) {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		r.messages[message.Topic()] = string(message.Payload())
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+// await waits for the topic to hold the payload
+func (r *retained) await(t *testing.T, topic string, payload string) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		r.mu.Lock()
+		got, ok := r.messages[topic]
+		r.mu.Unlock()
+		if ok && got == payload {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%s is %q, want %q", topic, got, payload)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func (r *retained) get(topic string) string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.messages[topic]
+}
+
+func newTestPublisher(t *testing.T, address string, d Datastore) *MQTTPublisher {
+	t.Helper()
+	outbox := NewOutbox(d, 50*time.Millisecond, 0)
+	units := Units{Gravity: GravityPlato, Temperature: TemperatureC}
+	p, err := NewMQTTPublisher("tcp://"+address, "hydromonitor", "homeassistant", units, d, NewEventBus(), outbox)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(p.Close)
+	go outbox.Run()
+	return p
+}
+
+// awaitConnection waits for the publisher's connection to be open, or closed
+func awaitConnection(t *testing.T, p *MQTTPublisher, open bool) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for p.client.IsConnectionOpen() != open {
+		if time.Now().After(deadline) {
+			t.Fatalf("connection open is %v, want %v", !open, open)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// awaitDelivered waits for the outbox to have no pending messages
+func awaitDelivered(t *testing.T, d Datastore) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		messages, err := d.GetOutboxMessages(OutboxPending, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(messages) == 0 {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("undelivered %+v", messages)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestMQTTPublishesRetainedTopics(t *testing.T) {
+	address := freeAddress(t)
+	startBroker(t, address)
+	d := newTestDatastore(t)
+	device := Device{ID: "a4:95:00:00:10:bb", Name: "Stout", Color: "red"}
+	p := newTestPublisher(t, address, d)
+	awaitConnection(t, p, true)
+
+	if err := p.announce(device); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Publish(device, Metric{DeviceID: device.ID, Gravity: 1.050, Temperature: 68, Battery: 5, Power: -70}); err != nil {
+		t.Fatal(err)
+	}
+	awaitDelivered(t, d)
+
+	// Subscribing afterwards only sees what the broker retained
+	topics := subscribe(t, address)
+	topics.await(t, "hydromonitor/status", "online")
+	topics.await(t, "hydromonitor/red/gravity", "12.39")
+	topics.await(t, "hydromonitor/red/temperature", "20")
+	topics.await(t, "hydromonitor/red/battery", "5")
+	topics.await(t, "hydromonitor/red/rssi", "-70")
+
+	id := "hydromonitor_a495000010bb_temperature"
+	topics.await(t, "homeassistant/sensor/"+id+"/config", topics.get("homeassistant/sensor/"+id+"/config"))
+	config := map[string]interface{}{}
+	if err := json.Unmarshal([]byte(topics.get("homeassistant/sensor/"+id+"/config")), &config); err != nil {
+		t.Fatal(err)
+	}
+	if config["unique_id"] != id || config["state_topic"] != "hydromonitor/red/temperature" ||
+		config["availability_topic"] != "hydromonitor/status" || config["device_class"] != "temperature" ||
+		config["unit_of_measurement"] != "°C" || config["state_class"] != "measurement" {
+		t.Errorf("discovery config %+v", config)
+	}
+	if device := config["device"].(map[string]interface{}); device["name"] != "Stout" || device["model"] != "Tilt Hydrometer (red)" {
+		t.Errorf("discovery device %+v", device)
+	}
+	for _, field := range []string{"gravity", "battery", "rssi"} {
+		if topics.get("homeassistant/sensor/hydromonitor_a495000010bb_"+field+"/config") == "" {
+			t.Errorf("no %s discovery config", field)
+		}
+	}
+
+	p.Close()
+	topics.await(t, "hydromonitor/status", "offline")
+}
+
+func TestMQTTReconnects(t *testing.T) {
+	address := freeAddress(t)
+	stopBroker := startBroker(t, address)
+	d := newTestDatastore(t)
+	device := Device{ID: "a4:95:00:00:10:bb", Color: "red"}
+	p := newTestPublisher(t, address, d)
+	awaitConnection(t, p, true)
+
+	stopBroker()
+	awaitConnection(t, p, false)
+
+	// Metrics published while the broker is down wait in the outbox
+	if err := p.Publish(device, Metric{DeviceID: device.ID, Gravity: 1.050, Temperature: 68}); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		messages, err := d.GetOutboxMessages(OutboxPending, mqttDestination)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(messages) > 0 && messages[0].Attempts > 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("queued %+v", messages)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Once the broker is back, the publisher reconnects and catches up
+	startBroker(t, address)
+	awaitDelivered(t, d)
+	topics := subscribe(t, address)
+	topics.await(t, "hydromonitor/status", "online")
+	topics.await(t, "hydromonitor/red/gravity", "12.39")
+	topics.await(t, "hydromonitor/red/temperature", "20")
+	p.Close()
+	topics.await(t, "hydromonitor/status", "offline")
+}
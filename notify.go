@@ -0,0 +1,197 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	// NotifierWebhook posts the notification as JSON, or rendered through
+	// the notifier's template
+	NotifierWebhook = "webhook"
+	// NotifierSlack posts to a Slack incoming webhook
+	NotifierSlack = "slack"
+	// NotifierDiscord posts to a Discord webhook
+	NotifierDiscord = "discord"
+	// NotifierNtfy publishes to an ntfy topic URL
+	NotifierNtfy = "ntfy"
+	// NotifierSMTP emails the notification through an smtp:// URL
+	NotifierSMTP = "smtp"
+
+	// notifyAttempts is how many times a notification is sent before giving
+	// up, doubling notifyBackoff between attempts
+	notifyAttempts = 3
+	notifyBackoff  = 2 * time.Second
+)
+
+// Notifier is a configured notification channel
+type Notifier struct {
+	ID   int    `json:"id" db:"id"`
+	Name string `json:"name" db:"name"`
+	Type string `json:"type" db:"type"`
+	URL  string `json:"url" db:"url"`
+	// Template renders the body of webhook notifications
+	Template string `json:"template" db:"template"`
+	// To and From address emails, To being comma separated
+	To   string `json:"to" db:"to_address"`
+	From string `json:"from" db:"from_address"`
+	// Events are the comma separated event types notified, by default
+	// errors and alerts
+	Events string `json:"events" db:"events"`
+	// RateLimit is the fewest seconds between notifications, any more
+	// being dropped
+	RateLimit int       `json:"rate_limit" db:"rate_limit"`
+	Disabled  bool      `json:"disabled" db:"disabled"`
+	Created   time.Time `json:"created" db:"created"`
+	Updated   time.Time `json:"updated" db:"updated"`
+}
+
+// Notification is the message sent to a notifier
+type Notification struct {
+	Event    string      `json:"event"`
+	DeviceID string      `json:"device_id"`
+	Title    string      `json:"title"`
+	Message  string      `json:"message"`
+	Data     interface{} `json:"data"`
+	Created  time.Time   `json:"created"`
+}
+
+// Sender delivers notifications to one channel
+type Sender interface {
+	Send(n Notification) error
+}
+
+// Validate checks the notifier has a sender
+func (n Notifier) Validate() error {
+	if n.Name == "" {
+		return fmt.Errorf("Notifier name is required")
+	}
+	_, err := NewSender(n)
+	return err
+}
+
+// events returns the event types the notifier is sent
+func (n Notifier) events() map[string]bool {
+	if strings.TrimSpace(n.Events) == "" {
+		return map[string]bool{EventError: true, EventAlert: true}
+	}
+	return splitSet(n.Events)
+}
+
+// NewNotification describes an event for people
+func NewNotification(e Event) Notification {
+	n := Notification{Event: e.Type, DeviceID: e.DeviceID, Data: e.Data, Created: e.Created}
+	switch data := e.Data.(type) {
+	case AlertEvent:
+		n.Title = fmt.Sprintf("%s %s on %s", data.Rule.Name, data.State, e.DeviceID)
+		n.Message = fmt.Sprintf("%s is %g (%s %g)", data.Rule.Metric, data.Value, data.Rule.Comparator, data.Rule.Threshold)
+	case Fermentation:
+		n.Title = fmt.Sprintf("%s is %s", e.DeviceID, data.Stage)
+		n.Message = fmt.Sprintf("Fermentation on %s is %s, losing %g points a day", e.DeviceID, data.Stage, data.Rate)
+		if data.Stalled {
+			n.Message += ", and has stalled"
+		}
+	default:
+		n.Title = fmt.Sprintf("%s on %s", strings.Title(e.Type), e.DeviceID)
+		n.Message = fmt.Sprint(e.Data)
+	}
+	return n
+}
+
+// Dispatcher sends published events to every notifier subscribed to them,
+// rate limiting and retrying each notifier independently. Notifications
+// posted over HTTP are delivered through the outbox, and others retried a
+// few times.
+type Dispatcher struct {
+	datastore Datastore
+	events    *EventBus
+	outbox    *Outbox
+
+	mu   sync.Mutex
+	sent map[int]time.Time
+}
+
+// NewDispatcher returns a dispatcher for the stored notifiers
+func NewDispatcher(datastore Datastore, events *EventBus, outbox *Outbox) *Dispatcher {
+	return &Dispatcher{datastore: datastore, events: events, outbox: outbox, sent: make(map[int]time.Time)}
+}
+
+// Run notifies events until the events subscription is closed
+func (d *Dispatcher) Run() {
+	events := d.events.SubscribeReliable(EventFilter{})
+	for e := range events {
+		if e.Type == EventMetric || e.Type == EventDevice {
+			continue
+		}
+
+		notifiers, err := d.datastore.GetNotifiers()
+		if err != nil {
+			log.Errorf("[notify] Error loading notifiers: %s", err)
+			continue
+		}
+		for _, notifier := range notifiers {
+			if notifier.Disabled || !notifier.events()[e.Type] {
+				continue
+			}
+			if !d.allow(notifier, e.Created) {
+				log.Warnf("[notify] Rate limiting %s, dropping %s notification for %s", notifier.Name, e.Type, e.DeviceID)
+				continue
+			}
+			go d.deliver(notifier, NewNotification(e))
+		}
+	}
+}
+
+// allow reports whether the notifier's rate limit allows sending now,
+// recording the send if so
+func (d *Dispatcher) allow(notifier Notifier, now time.Time) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if last, ok := d.sent[notifier.ID]; ok && now.Sub(last) < time.Duration(notifier.RateLimit)*time.Second {
+		return false
+	}
+	d.sent[notifier.ID] = now
+	return true
+}
+
+// deliver sends the notification, backing off between failed attempts
+func (d *Dispatcher) deliver(notifier Notifier, n Notification) {
+	sender, err := NewSender(notifier)
+	if err != nil {
+		log.Errorf("[notify] Invalid notifier %s: %s", notifier.Name, err)
+		return
+	}
+
+	if s, ok := sender.(messageSender); ok {
+		message, err := s.Message(n)
+		if err == nil {
+			message.Destination = fmt.Sprintf("notifier:%d", notifier.ID)
+			err = d.outbox.Enqueue(message)
+		}
+		if err != nil {
+			log.Errorf("[notify] Error queueing %s notification for %s to %s: %s", n.Event, n.DeviceID, notifier.Name, err)
+		}
+		return
+	}
+
+	backoff := notifyBackoff
+	for attempt := 1; ; attempt++ {
+		err := sender.Send(n)
+		if err == nil {
+			log.Debugf("[notify] Sent %s notification for %s to %s", n.Event, n.DeviceID, notifier.Name)
+			return
+		}
+		if attempt == notifyAttempts {
+			log.Errorf("[notify] Giving up sending to %s after %d attempts: %s", notifier.Name, attempt, err)
+			return
+		}
+		log.Warnf("[notify] Error sending to %s, retrying in %s: %s", notifier.Name, backoff, err)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	// OutboxHTTP messages are POSTed to their URL
+	OutboxHTTP = "http"
+	// OutboxMQTT messages are published, retained, to the topic in their URL
+	OutboxMQTT = "mqtt"
+
+	// OutboxPending messages are waiting to be delivered
+	OutboxPending = "pending"
+	// OutboxDead messages failed every attempt and won't be retried unless
+	// asked to
+	OutboxDead = "dead"
+
+	// outboxBackoff is the wait after a message's first failed delivery,
+	// doubling with each further failure up to outboxMaxBackoff
+	outboxBackoff    = 30 * time.Second
+	outboxMaxBackoff = time.Hour
+)
+
+// OutboxMessage is a stored message waiting to be delivered. Messages to the
+// same destination are delivered in the order they were queued.
+type OutboxMessage struct {
+	ID          int    `json:"id" db:"id"`
+	Kind        string `json:"kind" db:"kind"`
+	Destination string `json:"destination" db:"destination"`
+	// URL is where HTTP messages are posted, or the topic of MQTT messages
+	URL         string `json:"url" db:"url"`
+	ContentType string `json:"content_type" db:"content_type"`
+	// Headers are the JSON encoded extra headers of HTTP messages
+	Headers     string    `json:"headers" db:"headers"`
+	Body        string    `json:"body" db:"body"`
+	Attempts    int       `json:"attempts" db:"attempts"`
+	Error       string    `json:"error" db:"error"`
+	Dead        bool      `json:"dead" db:"dead"`
+	NextAttempt time.Time `json:"next_attempt" db:"next_attempt"`
+	Created     time.Time `json:"created" db:"created"`
+}
+
+// header returns the extra headers of an HTTP message
+func (m OutboxMessage) header() map[string]string {
+	headers := map[string]string{}
+	if m.Headers != "" {
+		json.Unmarshal([]byte(m.Headers), &headers)
+	}
+	return headers
+}
+
+// Deliverer delivers outbox messages of one kind
+type Deliverer interface {
+	Deliver(message OutboxMessage) error
+}
+
+// DelivererFunc adapts a function to a Deliverer
+type DelivererFunc func(message OutboxMessage) error
+
+// Deliver calls the function
+func (f DelivererFunc) Deliver(message OutboxMessage) error {
+	return f(message)
+}
+
+// Outbox stores messages before delivering them, so messages survive
+// destinations being down and restarts and are delivered at least once.
+// Each destination is a queue delivered independently of the others, failed
+// deliveries being retried with backoff until the message dies after the
+// given number of attempts.
+type Outbox struct {
+	datastore Datastore
+	interval  time.Duration
+	attempts  int
+	queued    chan struct{}
+
+	mu         sync.Mutex
+	deliverers map[string]Deliverer
+}
+
+// NewOutbox returns an outbox delivering HTTP and Graphite messages, checking
+// for messages due to be retried every interval
+func NewOutbox(datastore Datastore, interval time.Duration, attempts int) *Outbox {
+	o := &Outbox{
+		datastore:  datastore,
+		interval:   interval,
+		attempts:   attempts,
+		queued:     make(chan struct{}, 1),
+		deliverers: make(map[string]Deliverer),
+	}
+	o.Register(OutboxHTTP, DelivererFunc(postMessage))
+	o.Register(OutboxGraphite, DelivererFunc(deliverGraphite))
+	return o
+}
+
+// Register delivers messages of the kind through the deliverer
+func (o *Outbox) Register(kind string, deliverer Deliverer) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.deliverers[kind] = deliverer
+}
+
+// Enqueue stores the message, by default an HTTP message, delivering it as
+// soon as possible
+func (o *Outbox) Enqueue(message OutboxMessage) error {
+	if message.Kind == "" {
+		message.Kind = OutboxHTTP
+	}
+	if _, err := o.datastore.CreateOutboxMessage(message); err != nil {
+		return err
+	}
+	o.wake()
+	return nil
+}
+
+// Retry makes the message due straight away, reviving it if dead
+func (o *Outbox) Retry(message OutboxMessage) error {
+	message.Attempts = 0
+	message.Dead = false
+	message.NextAttempt = time.Now()
+	if err := o.datastore.UpdateOutboxMessage(message); err != nil {
+		return err
+	}
+	o.wake()
+	return nil
+}
+
+// Resume makes the destination's next message due straight away, for when
+// the destination is known to be back
+func (o *Outbox) Resume(destination string) error {
+	messages, err := o.datastore.GetOutboxMessages(OutboxPending, destination)
+	if err != nil || len(messages) == 0 {
+		return err
+	}
+	messages[0].NextAttempt = time.Now()
+	if err := o.datastore.UpdateOutboxMessage(messages[0]); err != nil {
+		return err
+	}
+	o.wake()
+	return nil
+}
+
+func (o *Outbox) wake() {
+	select {
+	case o.queued <- struct{}{}:
+	default:
+	}
+}
+
+// Run delivers due messages as they are queued and every interval
+func (o *Outbox) Run() {
+	ticker := time.NewTicker(o.interval)
+	defer ticker.Stop()
+
+	for {
+		o.Deliver(time.Now())
+		select {
+		case <-o.queued:
+		case <-ticker.C:
+		}
+	}
+}
+
+// Deliver sends the messages due by now, each destination concurrently
+func (o *Outbox) Deliver(now time.Time) {
+	messages, err := o.datastore.GetOutboxMessages(OutboxPending, "")
+	if err != nil {
+		log.Errorf("[outbox] Error loading messages: %s", err)
+		return
+	}
+
+	queues := map[string][]OutboxMessage{}
+	for _, message := range messages {
+		queues[message.Destination] = append(queues[message.Destination], message)
+	}
+
+	wg := sync.WaitGroup{}
+	for _, queue := range queues {
+		wg.Add(1)
+		go func(queue []OutboxMessage) {
+			defer wg.Done()
+			o.deliverQueue(queue, now)
+		}(queue)
+	}
+	wg.Wait()
+}
+
+// deliverQueue sends one destination's messages in order, stopping at the
+// first that isn't due or fails. Dead messages no longer hold up the queue.
+func (o *Outbox) deliverQueue(queue []OutboxMessage, now time.Time) {
+	for _, message := range queue {
+		if message.NextAttempt.After(now) {
+			return
+		}
+
+		err := o.deliver(message)
+		if err == nil {
+			log.Debugf("[outbox] Delivered message %d to %s", message.ID, message.Destination)
+			if err := o.datastore.DeleteOutboxMessage(message.ID); err != nil {
+				log.Errorf("[outbox] Error deleting message %d: %s", message.ID, err)
+			}
+			continue
+		}
+
+		message.Attempts++
+		message.Error = err.Error()
+		message.NextAttempt = now.Add(outboxDelay(message.Attempts))
+		message.Dead = o.attempts > 0 && message.Attempts >= o.attempts
+		if message.Dead {
+			log.Errorf("[outbox] Giving up delivering message %d to %s after %d attempts: %s", message.ID, message.Destination, message.Attempts, err)
+		} else {
+			log.Warnf("[outbox] Error delivering to %s (attempt %d), retrying at %s: %s", message.Destination, message.Attempts, message.NextAttempt.Format(time.RFC3339), err)
+		}
+		if err := o.datastore.UpdateOutboxMessage(message); err != nil {
+			log.Errorf("[outbox] Error updating message %d: %s", message.ID, err)
+		}
+		if !message.Dead {
+			return
+		}
+	}
+}
+
+func (o *Outbox) deliver(message OutboxMessage) error {
+	o.mu.Lock()
+	deliverer, ok := o.deliverers[message.Kind]
+	o.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("Nothing delivers %s messages", message.Kind)
+	}
+	return deliverer.Deliver(message)
+}
+
+// outboxDelay is the wait before retrying a message after its attempts
+func outboxDelay(attempts int) time.Duration {
+	delay := outboxBackoff
+	for i := 1; i < attempts && delay < outboxMaxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > outboxMaxBackoff {
+		delay = outboxMaxBackoff
+	}
+	return delay
+}
+
+// postMessage delivers an HTTP message
+func postMessage(message OutboxMessage) error {
+	return post(message.URL, message.ContentType, []byte(message.Body), message.header())
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeDeliverer records the messages delivered to each destination, failing
+// those to destinations that are down
+type fakeDeliverer struct {
+	mu        sync.Mutex
+	down      map[string]bool
+	attempts  map[string]int
+	delivered map[string][]string
+}
+
+func newFakeDeliverer() *fakeDeliverer {
+	return &fakeDeliverer{down: make(map[string]bool), attempts: make(map[string]int), delivered: make(map[string][]string)}
+}
+
+func (f *fakeDeliverer) Deliver(message OutboxMessage) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.attempts[message.Destination]++
+	if f.down[message.Destination] {
+		return fmt.Errorf("%s is down", message.Destination)
+	}
+	f.delivered[message.Destination] = append(f.delivered[message.Destination], message.Body)
+	return nil
+}
+
+func (f *fakeDeliverer) setDown(destination string, down bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.down[destination] = down
+}
+
+func (f *fakeDeliverer) check(t *testing.T, destination string, attempts int, delivered ...string) {
+	t.Helper()
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.attempts[destination] != attempts {
+		t.Errorf("%s attempted %d times, want %d", destination, f.attempts[destination], attempts)
+	}
+	if len(delivered) == 0 && len(f.delivered[destination]) == 0 {
+		return
+	}
+	if !reflect.DeepEqual(f.delivered[destination], delivered) {
+		t.Errorf("%s delivered %v, want %v", destination, f.delivered[destination], delivered)
+	}
+}
+
+func newTestOutbox(t *testing.T, d Datastore, attempts int) (*Outbox, *fakeDeliverer) {
+	outbox := NewOutbox(d, time.Hour, attempts)
+	deliverer := newFakeDeliverer()
+	outbox.Register("test", deliverer)
+	return outbox, deliverer
+}
+
+func enqueue(t *testing.T, outbox *Outbox, destination string, bodies ...string) {
+	t.Helper()
+	for _, body := range bodies {
+		if err := outbox.Enqueue(OutboxMessage{Kind: "test", Destination: destination, Body: body}); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func outboxMessages(t *testing.T, d Datastore, state string, destination string) []OutboxMessage {
+	t.Helper()
+	messages, err := d.GetOutboxMessages(state, destination)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return messages
+}
+
+func TestOutboxDeliversInOrder(t *testing.T) {
+	d := newTestDatastore(t)
+	outbox, deliverer := newTestOutbox(t, d, 3)
+	enqueue(t, outbox, "a", "1", "2", "3")
+	enqueue(t, outbox, "b", "1", "2")
+
+	outbox.Deliver(time.Now())
+	deliverer.check(t, "a", 3, "1", "2", "3")
+	deliverer.check(t, "b", 2, "1", "2")
+	if messages := outboxMessages(t, d, "", ""); len(messages) != 0 {
+		t.Errorf("left %+v", messages)
+	}
+}
+
+func TestOutboxBacksOff(t *testing.T) {
+	d := newTestDatastore(t)
+	outbox, deliverer := newTestOutbox(t, d, 0)
+	deliverer.setDown("a", true)
+	enqueue(t, outbox, "a", "1", "2")
+	enqueue(t, outbox, "b", "1")
+
+	// A failing message holds up the rest of its queue, but not others
+	now := time.Now()
+	outbox.Deliver(now)
+	deliverer.check(t, "a", 1)
+	deliverer.check(t, "b", 1, "1")
+	pending := outboxMessages(t, d, OutboxPending, "a")
+	if len(pending) != 2 || pending[0].Attempts != 1 || pending[0].Error != "a is down" || !pending[0].NextAttempt.Equal(now.Add(outboxBackoff)) {
+		t.Fatalf("pending %+v", pending)
+	}
+
+	outbox.Deliver(now.Add(outboxBackoff - time.Second))
+	deliverer.check(t, "a", 1)
+	outbox.Deliver(now.Add(outboxBackoff))
+	deliverer.check(t, "a", 2)
+	pending = outboxMessages(t, d, OutboxPending, "a")
+	if !pending[0].NextAttempt.Equal(now.Add(3 * outboxBackoff)) {
+		t.Errorf("second retry at %s, want %s", pending[0].NextAttempt, now.Add(3*outboxBackoff))
+	}
+
+	// Once the destination is known to be back, it needn't wait out the backoff
+	deliverer.setDown("a", false)
+	if err := outbox.Resume("a"); err != nil {
+		t.Fatal(err)
+	}
+	outbox.Deliver(time.Now())
+	deliverer.check(t, "a", 4, "1", "2")
+}
+
+func TestOutboxDelay(t *testing.T) {
+	for attempts, delay := range map[int]time.Duration{
+		1:  outboxBackoff,
+		2:  2 * outboxBackoff,
+		3:  4 * outboxBackoff,
+		7:  64 * outboxBackoff,
+		8:  outboxMaxBackoff,
+		50: outboxMaxBackoff,
+	} {
+		if got := outboxDelay(attempts); got != delay {
+			t.Errorf("after %d attempts got %s, want %s", attempts, got, delay)
+		}
+	}
+}
+
+func TestOutboxDeadLetters(t *testing.T) {
+	d := newTestDatastore(t)
+	outbox, deliverer := newTestOutbox(t, d, 2)
+	deliverer.setDown("a", true)
+	enqueue(t, outbox, "a", "1", "2")
+
+	now := time.Now()
+	outbox.Deliver(now)
+	// Dead messages no longer hold up their queue, so the next is attempted
+	outbox.Deliver(now.Add(outboxBackoff))
+	deliverer.check(t, "a", 3)
+	dead := outboxMessages(t, d, OutboxDead, "a")
+	if len(dead) != 1 || dead[0].Body != "1" || dead[0].Attempts != 2 {
+		t.Fatalf("dead %+v", dead)
+	}
+	if pending := outboxMessages(t, d, OutboxPending, "a"); len(pending) != 1 || pending[0].Body != "2" || pending[0].Attempts != 1 {
+		t.Fatalf("pending %+v", pending)
+	}
+
+	// Retrying revives the dead message, delivered ahead of later ones
+	deliverer.setDown("a", false)
+	if err := outbox.Retry(dead[0]); err != nil {
+		t.Fatal(err)
+	}
+	outbox.Deliver(now.Add(2 * outboxBackoff))
+	deliverer.check(t, "a", 5, "1", "2")
+	if messages := outboxMessages(t, d, "", ""); len(messages) != 0 {
+		t.Errorf("left %+v", messages)
+	}
+}
+
+func TestOutboxUnknownKind(t *testing.T) {
+	d := newTestDatastore(t)
+	outbox, _ := newTestOutbox(t, d, 1)
+	if err := outbox.Enqueue(OutboxMessage{Kind: "pigeon", Destination: "a"}); err != nil {
+		t.Fatal(err)
+	}
+	outbox.Deliver(time.Now())
+	if dead := outboxMessages(t, d, OutboxDead, "a"); len(dead) != 1 || dead[0].Error != "Nothing delivers pigeon messages" {
+		t.Errorf("dead %+v", dead)
+	}
+}
+
+func TestOutboxSurvivesRestart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.sql")
+	d := openTestDatastore(t, path)
+	outbox, deliverer := newTestOutbox(t, d, 0)
+	deliverer.setDown("a", true)
+	enqueue(t, outbox, "a", "1", "2", "3")
+	outbox.Deliver(time.Now())
+	deliverer.check(t, "a", 1)
+	d.Close()
+
+	// Messages still pending are delivered once the next process is due to
+	d = openTestDatastore(t, path)
+	outbox, deliverer = newTestOutbox(t, d, 0)
+	outbox.Deliver(time.Now())
+	deliverer.check(t, "a", 0)
+	outbox.Deliver(time.Now().Add(outboxBackoff))
+	deliverer.check(t, "a", 3, "1", "2", "3")
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// PresencePresent tilts have been advertising recently
+	PresencePresent = "present"
+	// PresenceMissing tilts haven't been seen for a while, but are still
+	// polled in case they're just out of range for now
+	PresenceMissing = "missing"
+	// PresenceLost tilts have been gone long enough to no longer be polled,
+	// until they're seen again
+	PresenceLost = "lost"
+)
+
+// TiltStatus is how a tilt in the registry has been doing
+type TiltStatus struct {
+	ID       string `json:"id"`
+	Color    string `json:"color"`
+	Presence string `json:"presence"`
+	// LastSeen is when the tilt was last discovered or advertised
+	LastSeen    *time.Time `json:"last_seen"`
+	LastSuccess *time.Time `json:"last_success"`
+	LastError   string     `json:"last_error"`
+	// Errors is the number of reads failed since the last success
+	Errors int `json:"errors"`
+}
+
+// Registry is the set of tilts being polled and their status, safe for
+// concurrent use by the scan, the scheduler and the API. Tilts go missing
+// once they haven't been seen for missingAfter, and are lost after lostAfter.
+type Registry struct {
+	mu           sync.RWMutex
+	tilts        map[string]*registryEntry
+	missingAfter time.Duration
+	lostAfter    time.Duration
+}
+
+type registryEntry struct {
+	client      TiltClient
+	presence    string
+	lastSeen    *time.Time
+	lastSuccess *time.Time
+	lastError   string
+	// pollInterval is the device's own poll interval, zero for the default
+	pollInterval time.Duration
+	// latest is the last metric stored for the tilt, if any
+	latest *Metric
+}
+
+// NewRegistry returns an empty registry
+func NewRegistry(missingAfter time.Duration, lostAfter time.Duration) *Registry {
+	return &Registry{
+		tilts:        make(map[string]*registryEntry),
+		missingAfter: missingAfter,
+		lostAfter:    lostAfter,
+	}
+}
+
+// Add puts the tilt in the registry, marking it seen at the time. Tilts
+// already in the registry keep their status, while new ones start with the
+// error last stored for them, if any, until they're read from.
+func (r *Registry) Add(tilt *TiltClient, at time.Time, lastError string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	id := tilt.Address.String()
+	entry, ok := r.tilts[id]
+	if !ok {
+		entry = &registryEntry{client: TiltClient{Address: tilt.Address, Errors: tilt.Errors}, lastError: lastError}
+		r.tilts[id] = entry
+	}
+	entry.client.Color = tilt.Color
+	entry.presence = PresencePresent
+	entry.lastSeen = &at
+}
+
+// Sight marks the tilt as seen advertising at the time, returning its
+// presence beforehand and whether it's in the registry
+func (r *Registry) Sight(id string, at time.Time) (string, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	entry, ok := r.tilts[id]
+	if !ok {
+		return "", false
+	}
+	previous := entry.presence
+	entry.presence = PresencePresent
+	entry.lastSeen = &at
+	return previous, true
+}
+
+// UpdatePresence moves tilts not seen recently enough to missing or lost,
+// returning the status of those whose presence changed
+func (r *Registry) UpdatePresence(now time.Time) []TiltStatus {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	changed := []TiltStatus{}
+	for id, entry := range r.tilts {
+		presence := PresencePresent
+		if entry.lastSeen != nil {
+			switch unseen := now.Sub(*entry.lastSeen); {
+			case r.lostAfter > 0 && unseen >= r.lostAfter:
+				presence = PresenceLost
+			case r.missingAfter > 0 && unseen >= r.missingAfter:
+				presence = PresenceMissing
+			}
+		}
+		if presence != entry.presence {
+			entry.presence = presence
+			changed = append(changed, entry.status(id))
+		}
+	}
+	sort.Slice(changed, func(i, j int) bool { return changed[i].ID < changed[j].ID })
+	return changed
+}
+
+// Remove takes the tilt out of the registry
+func (r *Registry) Remove(id string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.tilts, id)
+}
+
+// Has returns whether the tilt is in the registry
+func (r *Registry) Has(id string) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	_, ok := r.tilts[id]
+	return ok
+}
+
+// Get returns a copy of the tilt's client
+func (r *Registry) Get(id string) (TiltClient, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	entry, ok := r.tilts[id]
+	if !ok {
+		return TiltClient{}, false
+	}
+	return entry.client, true
+}
+
+// Status returns the tilt's status
+func (r *Registry) Status(id string) (TiltStatus, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	entry, ok := r.tilts[id]
+	if !ok {
+		return TiltStatus{}, false
+	}
+	return entry.status(id), true
+}
+
+// Snapshot returns the status of every tilt, ordered by id. The snapshot is
+// a copy, so can be ranged over while tilts come and go.
+func (r *Registry) Snapshot() []TiltStatus {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	statuses := make([]TiltStatus, 0, len(r.tilts))
+	for id, entry := range r.tilts {
+		statuses = append(statuses, entry.status(id))
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].ID < statuses[j].ID })
+	return statuses
+}
+
+// Errors returns the tilt's consecutive errors
+func (r *Registry) Errors(id string) int {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if entry, ok := r.tilts[id]; ok {
+		return entry.client.Errors
+	}
+	return 0
+}
+
+// SetPollInterval sets how often the tilt is polled, zero for the default
+func (r *Registry) SetPollInterval(id string, interval time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if entry, ok := r.tilts[id]; ok {
+		entry.pollInterval = interval
+	}
+}
+
+// PollInterval returns how often the tilt is polled, zero for the default
+func (r *Registry) PollInterval(id string) time.Duration {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if entry, ok := r.tilts[id]; ok {
+		return entry.pollInterval
+	}
+	return 0
+}
+
+// RecordSuccess marks the tilt read at the time, clearing its errors and
+// returning whether it had any
+func (r *Registry) RecordSuccess(id string, at time.Time) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	entry, ok := r.tilts[id]
+	if !ok {
+		return false
+	}
+	failed := entry.client.Errors > 0 || entry.lastError != ""
+	entry.lastSuccess = &at
+	entry.lastError = ""
+	entry.client.Errors = 0
+	return failed
+}
+
+// SetLatest keeps the tilt's latest stored metric
+func (r *Registry) SetLatest(id string, metric Metric) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if entry, ok := r.tilts[id]; ok {
+		entry.latest = &metric
+	}
+}
+
+// Latest returns the latest stored metric of every tilt that has one
+func (r *Registry) Latest() map[string]Metric {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	latest := make(map[string]Metric, len(r.tilts))
+	for id, entry := range r.tilts {
+		if entry.latest != nil {
+			latest[id] = *entry.latest
+		}
+	}
+	return latest
+}
+
+// RecordError counts a failed read of the tilt, returning its consecutive
+// errors
+func (r *Registry) RecordError(id string, err error) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	entry, ok := r.tilts[id]
+	if !ok {
+		return 0
+	}
+	entry.lastError = err.Error()
+	entry.client.Errors++
+	return entry.client.Errors
+}
+
+func (e *registryEntry) status(id string) TiltStatus {
+	return TiltStatus{
+		ID:          id,
+		Color:       e.client.Color,
+		Presence:    e.presence,
+		LastSeen:    e.lastSeen,
+		LastSuccess: e.lastSuccess,
+		LastError:   e.lastError,
+		Errors:      e.client.Errors,
+	}
+}
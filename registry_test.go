@@ -0,0 +1,124 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/currantlabs/ble"
+)
+
+func testTilt(i int) *TiltClient {
+	return &TiltClient{Address: ble.NewAddr(fmt.Sprintf("a4:95:00:00:%02x:bb", i)), Color: "red"}
+}
+
+func TestRegistryErrors(t *testing.T) {
+	r := NewRegistry(time.Hour, 2*time.Hour)
+	tilt := testTilt(1)
+	id := tilt.Address.String()
+	r.Add(tilt, time.Now(), "stored error")
+	if status, _ := r.Status(id); status.LastError != "stored error" || status.Errors != 0 {
+		t.Errorf("added %+v", status)
+	}
+
+	r.RecordError(id, errors.New("timeout"))
+	if errs := r.RecordError(id, errors.New("timeout")); errs != 2 {
+		t.Errorf("got %d errors, want 2", errs)
+	}
+	// Rediscovering the tilt keeps its status
+	r.Add(tilt, time.Now(), "")
+	if status, _ := r.Status(id); status.Errors != 2 || status.LastError != "timeout" {
+		t.Errorf("rediscovered %+v", status)
+	}
+
+	if !r.RecordSuccess(id, time.Now()) {
+		t.Error("success after errors reported none")
+	}
+	if status, _ := r.Status(id); status.Errors != 0 || status.LastError != "" || status.LastSuccess == nil {
+		t.Errorf("succeeded %+v", status)
+	}
+	if r.RecordError("unknown", errors.New("timeout")) != 0 || r.RecordSuccess("unknown", time.Now()) {
+		t.Error("recorded a tilt not in the registry")
+	}
+}
+
+func TestRegistryPresence(t *testing.T) {
+	r := NewRegistry(time.Hour, 2*time.Hour)
+	seen := time.Now()
+	tilt := testTilt(1)
+	id := tilt.Address.String()
+	r.Add(tilt, seen, "")
+
+	if changed := r.UpdatePresence(seen.Add(30 * time.Minute)); len(changed) != 0 {
+		t.Errorf("changed %+v", changed)
+	}
+	if changed := r.UpdatePresence(seen.Add(time.Hour)); len(changed) != 1 || changed[0].Presence != PresenceMissing {
+		t.Errorf("changed %+v", changed)
+	}
+	if changed := r.UpdatePresence(seen.Add(2 * time.Hour)); len(changed) != 1 || changed[0].Presence != PresenceLost {
+		t.Errorf("changed %+v", changed)
+	}
+
+	previous, ok := r.Sight(id, seen.Add(3*time.Hour))
+	if !ok || previous != PresenceLost {
+		t.Errorf("sighted %s, %v", previous, ok)
+	}
+	if status, _ := r.Status(id); status.Presence != PresencePresent {
+		t.Errorf("sighted %+v", status)
+	}
+	if _, ok := r.Sight("unknown", seen); ok {
+		t.Error("sighted a tilt not in the registry")
+	}
+}
+
+// TestRegistryConcurrent is meant for go test -race, with tilts coming and
+// going while they're read from and reported on
+func TestRegistryConcurrent(t *testing.T) {
+	r := NewRegistry(time.Millisecond, 5*time.Millisecond)
+	wg := sync.WaitGroup{}
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			tilt := testTilt(i % 4)
+			id := tilt.Address.String()
+			for j := 0; j < 500; j++ {
+				switch j % 5 {
+				case 0:
+					r.Add(tilt, time.Now(), "")
+				case 1:
+					r.Sight(id, time.Now())
+				case 2:
+					r.RecordError(id, errors.New("timeout"))
+				case 3:
+					r.RecordSuccess(id, time.Now())
+				case 4:
+					if i%2 == 0 {
+						r.Remove(id)
+					}
+				}
+				r.UpdatePresence(time.Now())
+				for _, status := range r.Snapshot() {
+					if status.LastSeen == nil {
+						t.Errorf("unseen %+v", status)
+					}
+				}
+				if client, ok := r.Get(id); ok && client.Address.String() != id {
+					t.Errorf("got %s for %s", client.Address, id)
+				}
+				r.Errors(id)
+				r.Has(id)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	snapshot := r.Snapshot()
+	for i := 1; i < len(snapshot); i++ {
+		if snapshot[i-1].ID >= snapshot[i].ID {
+			t.Errorf("snapshot out of order: %+v", snapshot)
+		}
+	}
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/jmoiron/sqlx"
+)
+
+// aggregateColumns are the columns shared by the metric_hourly and
+// metric_daily tables, matching MetricBucket
+const aggregateColumns = "bucket, count, min_gravity, max_gravity, avg_gravity, min_temperature, max_temperature, avg_temperature"
+
+// RetentionPolicy controls how long metrics are kept. Zero durations keep
+// the corresponding data forever.
+type RetentionPolicy struct {
+	// Raw is how long raw readings are kept before being rolled into the
+	// hourly and daily aggregates
+	Raw time.Duration
+	// Hourly is how long hourly aggregates are kept, after which only the
+	// daily ones remain
+	Hourly time.Duration
+	// Horizon is the age beyond which readings and aggregates are pruned
+	Horizon time.Duration
+}
+
+// Enabled reports whether the policy removes anything at all
+func (p RetentionPolicy) Enabled() bool {
+	return p.Raw > 0 || p.Hourly > 0 || p.Horizon > 0
+}
+
+// RetentionReport counts the rows affected by applying a retention policy
+type RetentionReport struct {
+	Compacted     int64
+	HourlyBuckets int
+	DailyBuckets  int
+	PrunedRaw     int64
+	PrunedHourly  int64
+	PrunedDaily   int64
+}
+
+func (r RetentionReport) String() string {
+	return fmt.Sprintf(
+		"compacted %d readings into %d hourly and %d daily buckets, pruned %d readings, %d hourly and %d daily buckets",
+		r.Compacted, r.HourlyBuckets, r.DailyBuckets, r.PrunedRaw, r.PrunedHourly, r.PrunedDaily,
+	)
+}
+
+type deviceBucket struct {
+	DeviceID string `db:"device_id"`
+	MetricBucket
+}
+
+// RunRetention applies the retention policy every interval
+func RunRetention(datastore Datastore, policy RetentionPolicy, interval time.Duration) {
+	for {
+		log.Debugf("[retention] Applying retention policy...")
+		report, err := datastore.ApplyRetention(policy, time.Now())
+		if err != nil {
+			log.Errorf("[retention] Error applying retention policy: %s", err)
+		} else {
+			log.Infof("[retention] Finished, %s", report)
+		}
+
+		log.Debugf("[retention] Waiting %s before next run...", interval)
+		time.Sleep(interval)
+	}
+}
+
+// ApplyRetention rolls raw readings older than the policy allows into the
+// hourly and daily aggregates, then prunes expired aggregates and anything
+// beyond the horizon. Cutoffs are aligned to whole (UTC) days, so every
+// aggregate bucket is only ever built from one run.
+func (d *SQLDatastore) ApplyRetention(policy RetentionPolicy, now time.Time) (RetentionReport, error) {
+	defer observeQuery("ApplyRetention", time.Now())
+	report := RetentionReport{}
+
+	tx, err := d.db.Beginx()
+	if err != nil {
+		return report, err
+	}
+	defer tx.Rollback()
+
+	if policy.Raw > 0 {
+		cutoff := truncateDay(now.Add(-policy.Raw))
+		if report.HourlyBuckets, err = d.rollup(tx, "metric_hourly", 3600, cutoff); err != nil {
+			return report, err
+		}
+		if report.DailyBuckets, err = d.rollup(tx, "metric_daily", 86400, cutoff); err != nil {
+			return report, err
+		}
+		if report.Compacted, err = execCount(tx, "DELETE FROM metric WHERE created<?", cutoff.Local()); err != nil {
+			return report, err
+		}
+	}
+
+	if policy.Hourly > 0 {
+		cutoff := truncateDay(now.Add(-policy.Hourly))
+		if report.PrunedHourly, err = execCount(tx, "DELETE FROM metric_hourly WHERE bucket<?", cutoff.Unix()); err != nil {
+			return report, err
+		}
+	}
+
+	if policy.Horizon > 0 {
+		cutoff := truncateDay(now.Add(-policy.Horizon))
+		if report.PrunedRaw, err = execCount(tx, "DELETE FROM metric WHERE created<?", cutoff.Local()); err != nil {
+			return report, err
+		}
+		pruned, err := execCount(tx, "DELETE FROM metric_hourly WHERE bucket<?", cutoff.Unix())
+		if err != nil {
+			return report, err
+		}
+		report.PrunedHourly += pruned
+		if report.PrunedDaily, err = execCount(tx, "DELETE FROM metric_daily WHERE bucket<?", cutoff.Unix()); err != nil {
+			return report, err
+		}
+	}
+
+	return report, tx.Commit()
+}
+
+// rollup summarises the raw readings before cutoff into the aggregate table,
+// merging with any bucket already there, and returns the buckets written
+func (d *SQLDatastore) rollup(tx *sqlx.Tx, table string, seconds int64, cutoff time.Time) (int, error) {
+	defer observeQuery("rollup", time.Now())
+	buckets := []deviceBucket{}
+	bucket := fmt.Sprintf("(%s / %d) * %d", d.dialect.epoch("created"), seconds, seconds)
+	err := tx.Select(&buckets, tx.Rebind(`
+	SELECT device_id, `+bucket+` AS bucket,
+	COUNT(*) AS count,
+	MIN(gravity) AS min_gravity,
+	MAX(gravity) AS max_gravity,
+	AVG(gravity) AS avg_gravity,
+	MIN(temperature) AS min_temperature,
+	MAX(temperature) AS max_temperature,
+	AVG(temperature) AS avg_temperature
+	FROM metric WHERE created<? GROUP BY device_id, `+bucket), cutoff.Local())
+	if err != nil {
+		return 0, err
+	}
+
+	for _, b := range buckets {
+		existing := deviceBucket{}
+		err := tx.Get(&existing, tx.Rebind("SELECT device_id, "+aggregateColumns+" FROM "+table+" WHERE device_id=? AND bucket=?"), b.DeviceID, b.Bucket)
+		if err == nil {
+			b.MetricBucket = mergeBuckets(existing.MetricBucket, b.MetricBucket)
+			if _, err := tx.Exec(tx.Rebind("DELETE FROM "+table+" WHERE device_id=? AND bucket=?"), b.DeviceID, b.Bucket); err != nil {
+				return 0, err
+			}
+		} else if err != sql.ErrNoRows {
+			return 0, err
+		}
+
+		if _, err := tx.Exec(
+			tx.Rebind("INSERT INTO "+table+" (device_id, "+aggregateColumns+") VALUES (?,?,?,?,?,?,?,?,?)"),
+			b.DeviceID,
+			b.Bucket,
+			b.Count,
+			b.MinGravity,
+			b.MaxGravity,
+			b.AvgGravity,
+			b.MinTemperature,
+			b.MaxTemperature,
+			b.AvgTemperature,
+		); err != nil {
+			return 0, err
+		}
+	}
+	return len(buckets), nil
+}
+
+// mergeBuckets combines two summaries of the same interval
+func mergeBuckets(a MetricBucket, b MetricBucket) MetricBucket {
+	count := float64(a.Count + b.Count)
+	merged := a
+	merged.Count = a.Count + b.Count
+	merged.AvgGravity = (a.AvgGravity*float64(a.Count) + b.AvgGravity*float64(b.Count)) / count
+	merged.AvgTemperature = (a.AvgTemperature*float64(a.Count) + b.AvgTemperature*float64(b.Count)) / count
+	if b.MinGravity < a.MinGravity {
+		merged.MinGravity = b.MinGravity
+	}
+	if b.MaxGravity > a.MaxGravity {
+		merged.MaxGravity = b.MaxGravity
+	}
+	if b.MinTemperature < a.MinTemperature {
+		merged.MinTemperature = b.MinTemperature
+	}
+	if b.MaxTemperature > a.MaxTemperature {
+		merged.MaxTemperature = b.MaxTemperature
+	}
+	return merged
+}
+
+func execCount(tx *sqlx.Tx, query string, args ...interface{}) (int64, error) {
+	result, err := tx.Exec(tx.Rebind(query), args...)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// truncateDay rounds the time down to the start of its UTC day, matching the
+// epoch aligned aggregate buckets
+func truncateDay(t time.Time) time.Time {
+	return time.Unix((t.Unix()/86400)*86400, 0)
+}
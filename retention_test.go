@@ -0,0 +1,222 @@
+package main
+
+import (
+	"math"
+	"sort"
+	"testing"
+	"time"
+)
+
+// summarise buckets the metrics the way GetDeviceMetricBuckets should
+func summarise(metrics []Metric, interval time.Duration) []MetricBucket {
+	seconds := int64(interval / time.Second)
+	byBucket := map[int64]*MetricBucket{}
+	for _, m := range metrics {
+		start := (m.Created.Unix() / seconds) * seconds
+		b, ok := byBucket[start]
+		if !ok {
+			b = &MetricBucket{
+				Bucket:         start,
+				Start:          time.Unix(start, 0),
+				MinGravity:     m.Gravity,
+				MaxGravity:     m.Gravity,
+				MinTemperature: m.Temperature,
+				MaxTemperature: m.Temperature,
+			}
+			byBucket[start] = b
+		}
+		b.MinGravity = math.Min(b.MinGravity, m.Gravity)
+		b.MaxGravity = math.Max(b.MaxGravity, m.Gravity)
+		b.MinTemperature = math.Min(b.MinTemperature, m.Temperature)
+		b.MaxTemperature = math.Max(b.MaxTemperature, m.Temperature)
+		// Sums until they're divided by the count below
+		b.AvgGravity += m.Gravity
+		b.AvgTemperature += m.Temperature
+		b.Count++
+	}
+
+	buckets := []MetricBucket{}
+	for _, b := range byBucket {
+		b.AvgGravity /= float64(b.Count)
+		b.AvgTemperature /= float64(b.Count)
+		buckets = append(buckets, *b)
+	}
+	sort.Slice(buckets, func(i, j int) bool { return buckets[i].Bucket < buckets[j].Bucket })
+	return buckets
+}
+
+func sameBuckets(got []MetricBucket, want []MetricBucket) bool {
+	if len(got) != len(want) {
+		return false
+	}
+	for i := range got {
+		g, w := got[i], want[i]
+		if g.Bucket != w.Bucket || g.Count != w.Count ||
+			g.MinGravity != w.MinGravity || g.MaxGravity != w.MaxGravity ||
+			g.MinTemperature != w.MinTemperature || g.MaxTemperature != w.MaxTemperature ||
+			math.Abs(g.AvgGravity-w.AvgGravity) > 1e-9 || math.Abs(g.AvgTemperature-w.AvgTemperature) > 1e-9 {
+			return false
+		}
+	}
+	return true
+}
+
+func TestApplyRetention(t *testing.T) {
+	forEachDialect(t, func(t *testing.T, d Datastore) {
+		for _, id := range []string{"tilt", "other"} {
+			if err := d.CreateOrUpdateDevice(Device{ID: id, Color: "red"}); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		// Readings every half hour for six days from midnight UTC
+		start := time.Unix(1577836800, 0) // 2020-01-01T00:00:00Z
+		day := 24 * time.Hour
+		readings := []Metric{}
+		for i := 0; i < 6*48; i++ {
+			readings = append(readings, Metric{
+				DeviceID:    "tilt",
+				Gravity:     round(1.060-0.0001*float64(i), 4),
+				Temperature: float64(60 + i%10),
+				Created:     start.Add(time.Duration(i) * 30 * time.Minute),
+			})
+		}
+		readings = append(readings, Metric{DeviceID: "other", Gravity: 1.020, Temperature: 50, Created: start.Add(time.Hour)})
+		for _, m := range readings {
+			if err := d.CreateMetric(m); err != nil {
+				t.Fatal(err)
+			}
+		}
+		tilt := readings[:len(readings)-1]
+
+		query := MetricQuery{From: start, To: start.Add(7 * day), Limit: 1000}
+		expectBuckets := func(when string, metrics []Metric) {
+			t.Helper()
+			for _, interval := range []time.Duration{time.Hour, day} {
+				buckets, err := d.GetDeviceMetricBuckets("tilt", query, interval)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if want := summarise(metrics, interval); !sameBuckets(buckets, want) {
+					t.Errorf("%s: %s buckets\n%+v\nwant\n%+v", when, interval, buckets, want)
+				}
+			}
+		}
+		expectBuckets("before retention", tilt)
+
+		// Raw readings before day five are compacted, the cutoff being
+		// rounded down to the start of the day
+		now := start.Add(9*day + 13*time.Hour)
+		policy := RetentionPolicy{Raw: 4 * day}
+		report, err := d.ApplyRetention(policy, now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if report.Compacted != 5*48+1 || report.HourlyBuckets != 5*24+1 || report.DailyBuckets != 5+1 {
+			t.Errorf("first run %s", report)
+		}
+		metrics, err := d.GetDeviceMetrics("tilt", query)
+		if err != nil || len(metrics) != 48 || !metrics[0].Created.Equal(start.Add(5*day)) {
+			t.Errorf("%d raw readings left, %v", len(metrics), err)
+		}
+		expectBuckets("after compacting", tilt)
+		if buckets, err := d.GetDeviceMetricBuckets("other", query, time.Hour); err != nil || len(buckets) != 1 || buckets[0].Count != 1 {
+			t.Errorf("other device's buckets %+v, %v", buckets, err)
+		}
+
+		// Running again has nothing left to compact
+		report, err = d.ApplyRetention(policy, now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if report != (RetentionReport{}) {
+			t.Errorf("second run %s", report)
+		}
+		expectBuckets("after running again", tilt)
+
+		// A reading arriving late for a compacted day is merged into its
+		// buckets by the next run
+		late := Metric{DeviceID: "tilt", Gravity: 1.000, Temperature: 90, Created: start.Add(4*day + 10*time.Minute)}
+		if err := d.CreateMetric(late); err != nil {
+			t.Fatal(err)
+		}
+		tilt = append(tilt, late)
+		report, err = d.ApplyRetention(policy, now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if report.Compacted != 1 || report.HourlyBuckets != 1 || report.DailyBuckets != 1 {
+			t.Errorf("late run %s", report)
+		}
+		expectBuckets("after merging a late reading", tilt)
+
+		// Hourly aggregates before day two are pruned, leaving daily ones
+		policy.Hourly = 7 * day
+		report, err = d.ApplyRetention(policy, now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if report.PrunedHourly != 2*24+1 {
+			t.Errorf("pruning hourly aggregates %s", report)
+		}
+		buckets, err := d.GetDeviceMetricBuckets("tilt", query, day)
+		if err != nil || !sameBuckets(buckets, summarise(tilt, day)) {
+			t.Errorf("daily buckets after pruning hourly aggregates %+v, %v", buckets, err)
+		}
+		hourly := []Metric{}
+		for _, m := range tilt {
+			if !m.Created.Before(start.Add(2 * day)) {
+				hourly = append(hourly, m)
+			}
+		}
+		buckets, err = d.GetDeviceMetricBuckets("tilt", query, time.Hour)
+		if err != nil || !sameBuckets(buckets, summarise(hourly, time.Hour)) {
+			t.Errorf("hourly buckets after pruning hourly aggregates %+v, %v", buckets, err)
+		}
+
+		// Nothing is kept past the horizon, starting at day one
+		policy.Horizon = 8 * day
+		report, err = d.ApplyRetention(policy, now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if report.PrunedDaily != 2 || report.PrunedRaw != 0 {
+			t.Errorf("pruning past the horizon %s", report)
+		}
+		kept := []Metric{}
+		for _, m := range tilt {
+			if !m.Created.Before(start.Add(day)) {
+				kept = append(kept, m)
+			}
+		}
+		buckets, err = d.GetDeviceMetricBuckets("tilt", query, day)
+		if err != nil || !sameBuckets(buckets, summarise(kept, day)) {
+			t.Errorf("daily buckets past the horizon %+v, %v", buckets, err)
+		}
+
+		// Raw readings past the horizon go too
+		report, err = d.ApplyRetention(RetentionPolicy{Horizon: 3 * day}, now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if report.PrunedRaw != 48 || report.PrunedDaily != 4 {
+			t.Errorf("pruning raw readings past the horizon %s", report)
+		}
+		if metrics, err := d.GetDeviceMetrics("tilt", query); err != nil || len(metrics) != 0 {
+			t.Errorf("%d raw readings left past the horizon, %v", len(metrics), err)
+		}
+	})
+}
+
+func TestMergeBuckets(t *testing.T) {
+	a := MetricBucket{Count: 3, MinGravity: 1.040, MaxGravity: 1.050, AvgGravity: 1.045, MinTemperature: 64, MaxTemperature: 68, AvgTemperature: 66}
+	b := MetricBucket{Count: 1, MinGravity: 1.030, MaxGravity: 1.030, AvgGravity: 1.030, MinTemperature: 70, MaxTemperature: 70, AvgTemperature: 70}
+	merged := mergeBuckets(a, b)
+	if merged.Count != 4 || merged.MinGravity != 1.030 || merged.MaxGravity != 1.050 || merged.MinTemperature != 64 || merged.MaxTemperature != 70 ||
+		math.Abs(merged.AvgGravity-1.04125) > 1e-9 || merged.AvgTemperature != 67 {
+		t.Errorf("merged %+v", merged)
+	}
+	if swapped := mergeBuckets(b, a); !sameBuckets([]MetricBucket{swapped}, []MetricBucket{merged}) {
+		t.Errorf("merging the other way round gave %+v, want %+v", swapped, merged)
+	}
+}
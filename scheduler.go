@@ -0,0 +1,157 @@
+package main
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// schedulerTick is how often the scheduler looks for devices due a poll
+const schedulerTick = time.Second
+
+// Scheduler polls each tilt in the state on its own schedule, so a slow or
+// hung device doesn't hold up the others. Each device is due again its poll
+// interval, or the default, after its last poll finished, give or take the
+// jitter so polls drift apart rather than bunching up. The state bounds how
+// many are connected to at once. A failing device backs off, doubling its
+// interval with each consecutive error up to a few times its interval, and is
+// disabled once it reaches the quarantine threshold. Lost tilts aren't polled
+// until they're seen again.
+type Scheduler struct {
+	state    *State
+	interval time.Duration
+	// jitter is the fraction of the interval polls are randomly moved by
+	jitter float64
+	// backoffLimit is the most times its interval a failing device is
+	// backed off to
+	backoffLimit int
+	// quarantine is the consecutive errors a device is disabled after, or
+	// zero to never disable devices
+	quarantine int
+
+	mu      sync.Mutex
+	due     map[string]time.Time
+	polling map[string]bool
+}
+
+// NewScheduler returns a scheduler polling devices without their own poll
+// interval every interval, backing off failing devices up to backoffLimit
+// times their interval
+func NewScheduler(state *State, interval time.Duration, jitter float64, backoffLimit int, quarantine int) *Scheduler {
+	return &Scheduler{
+		state:        state,
+		interval:     interval,
+		jitter:       jitter,
+		backoffLimit: backoffLimit,
+		quarantine:   quarantine,
+		due:          make(map[string]time.Time),
+		polling:      make(map[string]bool),
+	}
+}
+
+// Run polls devices as they fall due, forever
+func (s *Scheduler) Run() {
+	ticker := time.NewTicker(schedulerTick)
+	defer ticker.Stop()
+
+	for now := range ticker.C {
+		s.schedule(now)
+	}
+}
+
+// schedule starts polling the devices due by now
+func (s *Scheduler) schedule(now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	present := map[string]bool{}
+	for _, tilt := range s.state.Tilts() {
+		if tilt.Presence == PresenceLost {
+			continue
+		}
+		id := tilt.ID
+		present[id] = true
+		due, ok := s.due[id]
+		if !ok {
+			// Newly found tilts have just been refreshed, while those loaded
+			// at startup carry on from when they were last read
+			s.due[id] = tilt.LastSeen.Add(s.next(id))
+			continue
+		}
+		if s.polling[id] || now.Before(due) {
+			continue
+		}
+
+		s.polling[id] = true
+		go s.poll(id)
+	}
+
+	for id := range s.due {
+		if !present[id] {
+			delete(s.due, id)
+		}
+	}
+	for id, polling := range s.polling {
+		if !present[id] && !polling {
+			delete(s.polling, id)
+		}
+	}
+}
+
+func (s *Scheduler) poll(id string) {
+	defer func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.polling[id] = false
+	}()
+
+	// Devices disabled since they were added leave the state, so are found
+	// again by a scan if enabled
+	if device, err := s.state.datastore.GetDevice(id); err == nil && device.Disabled {
+		log.Infof("[poll] %s is disabled, no longer polling it", id)
+		s.state.registry.Remove(id)
+		return
+	}
+
+	log.Debugf("[poll] Refreshing %s...", id)
+	err := s.state.RefreshTilt(id)
+	pollsTotal.WithLabelValues(outcome(err)).Inc()
+	if err != nil {
+		log.Errorf("[poll] Error refreshing metrics for tilt %s: %s", id, err)
+		s.state.recordError(id, err)
+		if s.quarantine > 0 && s.state.registry.Errors(id) >= s.quarantine {
+			s.state.quarantine(id, err)
+			return
+		}
+	}
+
+	next := s.next(id)
+	log.Debugf("[poll] Polling %s again in %s", id, next.Round(time.Second))
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.due[id] = time.Now().Add(next)
+}
+
+// next returns the jittered time until the device is next due, backed off
+// for each consecutive error
+func (s *Scheduler) next(id string) time.Duration {
+	interval := s.state.registry.PollInterval(id)
+	if interval <= 0 {
+		interval = s.interval
+	}
+	limit := interval
+	if s.backoffLimit > 1 {
+		limit *= time.Duration(s.backoffLimit)
+	}
+	backoff := interval
+	for i := s.state.registry.Errors(id); i > 0 && backoff < limit; i-- {
+		backoff *= 2
+	}
+	if backoff > limit {
+		backoff = limit
+	}
+	return backoff + time.Duration((rand.Float64()*2-1)*s.jitter*float64(backoff))
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestSchedulerBackoff(t *testing.T) {
+	state := NewState(newTestDatastore(t), nil, NewEventBus(), time.Second, 1, time.Hour, 2*time.Hour)
+	scheduler := NewScheduler(state, time.Hour, 0, 4, 0)
+	tilt := testTilt(1)
+	id := tilt.Address.String()
+	state.registry.Add(tilt, time.Now(), "")
+
+	for errs, want := range []time.Duration{time.Hour, 2 * time.Hour, 4 * time.Hour, 4 * time.Hour, 4 * time.Hour} {
+		if got := scheduler.next(id); got != want {
+			t.Errorf("after %d errors got %s, want %s", errs, got, want)
+		}
+		state.registry.RecordError(id, errors.New("timeout"))
+	}
+
+	// Devices with their own interval back off from it
+	state.SetPollInterval(id, 900)
+	if got := scheduler.next(id); got != time.Hour {
+		t.Errorf("15m interval after errors got %s, want 1h", got)
+	}
+	state.registry.RecordSuccess(id, time.Now())
+	if got := scheduler.next(id); got != 15*time.Minute {
+		t.Errorf("15m interval got %s", got)
+	}
+}
+
+func TestSchedulerJitter(t *testing.T) {
+	state := NewState(newTestDatastore(t), nil, NewEventBus(), time.Second, 1, time.Hour, 2*time.Hour)
+	scheduler := NewScheduler(state, time.Hour, 0.1, 4, 0)
+	for i := 0; i < 100; i++ {
+		if got := scheduler.next("unknown"); got < 54*time.Minute || got > 66*time.Minute {
+			t.Fatalf("jittered interval %s", got)
+		}
+	}
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/smtp"
+	"net/url"
+	"strings"
+	"text/template"
+	"time"
+)
+
+var notifyClient = &http.Client{Timeout: 10 * time.Second}
+
+// NewSender returns the sender for the notifier's type
+func NewSender(notifier Notifier) (Sender, error) {
+	target, err := url.Parse(notifier.URL)
+	if err != nil || target.Host == "" {
+		return nil, fmt.Errorf("Invalid notifier URL: %s", notifier.URL)
+	}
+
+	switch notifier.Type {
+	case NotifierWebhook:
+		sender := &webhookSender{url: notifier.URL}
+		if notifier.Template != "" {
+			funcs := template.FuncMap{"json": func(v interface{}) (string, error) {
+				encoded, err := json.Marshal(v)
+				return string(encoded), err
+			}}
+			if sender.template, err = template.New(notifier.Name).Funcs(funcs).Parse(notifier.Template); err != nil {
+				return nil, fmt.Errorf("Invalid webhook template: %s", err)
+			}
+		}
+		return sender, nil
+	case NotifierSlack:
+		return &chatSender{url: notifier.URL, field: "text"}, nil
+	case NotifierDiscord:
+		return &chatSender{url: notifier.URL, field: "content"}, nil
+	case NotifierNtfy:
+		return &ntfySender{url: notifier.URL}, nil
+	case NotifierSMTP:
+		if target.Scheme != "smtp" {
+			return nil, fmt.Errorf("SMTP notifier URL must be smtp://[user:password@]host:port")
+		}
+		if notifier.To == "" || notifier.From == "" {
+			return nil, fmt.Errorf("SMTP notifier to and from addresses are required")
+		}
+		to := []string{}
+		for _, address := range strings.Split(notifier.To, ",") {
+			to = append(to, strings.TrimSpace(address))
+		}
+		return &smtpSender{server: target, from: notifier.From, to: to}, nil
+	}
+	return nil, fmt.Errorf("Unknown notifier type: %s", notifier.Type)
+}
+
+// post sends the body, treating any non 2xx response as an error
+func post(url string, contentType string, body []byte, headers map[string]string) error {
+	request, err := http.NewRequest("POST", url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", contentType)
+	for name, value := range headers {
+		request.Header.Set(name, value)
+	}
+
+	response, err := notifyClient.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		message, _ := ioutil.ReadAll(response.Body)
+		return fmt.Errorf("%s responded %s: %s", url, response.Status, strings.TrimSpace(string(message)))
+	}
+	return nil
+}
+
+// messageSender is a Sender of HTTP messages, which can be delivered through
+// the outbox
+type messageSender interface {
+	Message(n Notification) (OutboxMessage, error)
+}
+
+// sendMessage posts the sender's message straight away
+func sendMessage(s messageSender, n Notification) error {
+	message, err := s.Message(n)
+	if err != nil {
+		return err
+	}
+	return postMessage(message)
+}
+
+type webhookSender struct {
+	url      string
+	template *template.Template
+}
+
+func (s *webhookSender) Send(n Notification) error {
+	return sendMessage(s, n)
+}
+
+func (s *webhookSender) Message(n Notification) (OutboxMessage, error) {
+	message := OutboxMessage{Kind: OutboxHTTP, URL: s.url, ContentType: "application/json"}
+	if s.template == nil {
+		body, err := json.Marshal(n)
+		message.Body = string(body)
+		return message, err
+	}
+
+	body := bytes.Buffer{}
+	err := s.template.Execute(&body, n)
+	message.Body = body.String()
+	return message, err
+}
+
+// chatSender posts the notification as the message field of a chat webhook
+type chatSender struct {
+	url   string
+	field string
+}
+
+func (s *chatSender) Send(n Notification) error {
+	return sendMessage(s, n)
+}
+
+func (s *chatSender) Message(n Notification) (OutboxMessage, error) {
+	body, err := json.Marshal(map[string]string{s.field: fmt.Sprintf("*%s*\n%s", n.Title, n.Message)})
+	return OutboxMessage{Kind: OutboxHTTP, URL: s.url, ContentType: "application/json", Body: string(body)}, err
+}
+
+type ntfySender struct {
+	url string
+}
+
+func (s *ntfySender) Send(n Notification) error {
+	return sendMessage(s, n)
+}
+
+func (s *ntfySender) Message(n Notification) (OutboxMessage, error) {
+	headers := map[string]string{"Title": n.Title, "Tags": n.Event}
+	if n.Event == EventAlert || n.Event == EventError {
+		headers["Priority"] = "high"
+	}
+	encoded, err := json.Marshal(headers)
+	return OutboxMessage{Kind: OutboxHTTP, URL: s.url, ContentType: "text/plain", Headers: string(encoded), Body: n.Message}, err
+}
+
+type smtpSender struct {
+	server *url.URL
+	from   string
+	to     []string
+}
+
+func (s *smtpSender) Send(n Notification) error {
+	var auth smtp.Auth
+	if s.server.User != nil {
+		password, _ := s.server.User.Password()
+		auth = smtp.PlainAuth("", s.server.User.Username(), password, s.server.Hostname())
+	}
+
+	host := s.server.Host
+	if s.server.Port() == "" {
+		host += ":25"
+	}
+
+	message := fmt.Sprintf(
+		"From: %s\r\nTo: %s\r\nSubject: %s\r\nDate: %s\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n%s\r\n",
+		s.from, strings.Join(s.to, ", "), n.Title, n.Created.Format(time.RFC1123Z), n.Message,
+	)
+	return smtp.SendMail(host, auth, s.from, s.to, []byte(message))
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// receivedRequest is what a test server was sent
+type receivedRequest struct {
+	header http.Header
+	body   string
+}
+
+// newReceiver returns a server recording the requests sent to it, responding
+// with the status
+func newReceiver(t *testing.T, status int) (*httptest.Server, chan receivedRequest) {
+	received := make(chan receivedRequest, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		received <- receivedRequest{header: r.Header, body: string(body)}
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(server.Close)
+	return server, received
+}
+
+func testNotification() Notification {
+	return Notification{
+		Event:    EventAlert,
+		DeviceID: "tilt",
+		Title:    "Hot firing on tilt",
+		Message:  "temperature is 75 (> 72)",
+		Created:  time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC),
+	}
+}
+
+func send(t *testing.T, notifier Notifier) error {
+	t.Helper()
+	sender, err := NewSender(notifier)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sender.Send(testNotification())
+}
+
+func TestWebhookSender(t *testing.T) {
+	server, received := newReceiver(t, http.StatusOK)
+	if err := send(t, Notifier{Name: "hook", Type: NotifierWebhook, URL: server.URL}); err != nil {
+		t.Fatal(err)
+	}
+	request := <-received
+	if request.header.Get("Content-Type") != "application/json" {
+		t.Errorf("content type %s", request.header.Get("Content-Type"))
+	}
+	n := Notification{}
+	if err := json.Unmarshal([]byte(request.body), &n); err != nil {
+		t.Fatal(err)
+	}
+	if n.Event != EventAlert || n.DeviceID != "tilt" || n.Title != "Hot firing on tilt" || !n.Created.Equal(testNotification().Created) {
+		t.Errorf("sent %+v", n)
+	}
+
+	templated := Notifier{Name: "hook", Type: NotifierWebhook, URL: server.URL, Template: `{"text": {{json .Message}}}`}
+	if err := send(t, templated); err != nil {
+		t.Fatal(err)
+	}
+	if request := <-received; request.body != `{"text": "temperature is 75 (\u003e 72)"}` {
+		t.Errorf("sent %s", request.body)
+	}
+}
+
+func TestChatSenders(t *testing.T) {
+	server, received := newReceiver(t, http.StatusNoContent)
+	for notifierType, field := range map[string]string{NotifierSlack: "text", NotifierDiscord: "content"} {
+		if err := send(t, Notifier{Name: "chat", Type: notifierType, URL: server.URL}); err != nil {
+			t.Fatal(err)
+		}
+		request := <-received
+		body := map[string]string{}
+		if err := json.Unmarshal([]byte(request.body), &body); err != nil {
+			t.Fatal(err)
+		}
+		if request.header.Get("Content-Type") != "application/json" || body[field] != "*Hot firing on tilt*\ntemperature is 75 (> 72)" {
+			t.Errorf("%s sent %s: %s", notifierType, request.header.Get("Content-Type"), request.body)
+		}
+	}
+}
+
+func TestNtfySender(t *testing.T) {
+	server, received := newReceiver(t, http.StatusOK)
+	if err := send(t, Notifier{Name: "phone", Type: NotifierNtfy, URL: server.URL + "/brewing"}); err != nil {
+		t.Fatal(err)
+	}
+	request := <-received
+	if request.body != "temperature is 75 (> 72)" {
+		t.Errorf("sent %s", request.body)
+	}
+	for name, value := range map[string]string{"Content-Type": "text/plain", "Title": "Hot firing on tilt", "Tags": EventAlert, "Priority": "high"} {
+		if got := request.header.Get(name); got != value {
+			t.Errorf("%s header %q, want %q", name, got, value)
+		}
+	}
+}
+
+func TestSenderErrorResponse(t *testing.T) {
+	server, received := newReceiver(t, http.StatusInternalServerError)
+	err := send(t, Notifier{Name: "hook", Type: NotifierWebhook, URL: server.URL})
+	<-received
+	if err == nil || !strings.Contains(err.Error(), "500") {
+		t.Errorf("got %v", err)
+	}
+}
+
+// smtpReceiver accepts one mail over a minimal SMTP conversation, sending
+// back the envelope and message
+func smtpReceiver(t *testing.T) (string, chan []string) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	received := make(chan []string, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		lines := []string{}
+		reader := bufio.NewReader(conn)
+		reply := func(line string) { conn.Write([]byte(line + "\r\n")) }
+
+		reply("220 localhost")
+		data := false
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				return
+			}
+			line = strings.TrimRight(line, "\r\n")
+			switch {
+			case data && line == ".":
+				data = false
+				reply("250 OK")
+			case data:
+				lines = append(lines, line)
+			case strings.HasPrefix(line, "EHLO"), strings.HasPrefix(line, "HELO"):
+				reply("250 localhost")
+			case line == "DATA":
+				data = true
+				reply("354 Go ahead")
+			case line == "QUIT":
+				reply("221 Bye")
+				received <- lines
+				return
+			default:
+				lines = append(lines, line)
+				reply("250 OK")
+			}
+		}
+	}()
+	return listener.Addr().String(), received
+}
+
+func TestSMTPSender(t *testing.T) {
+	address, received := smtpReceiver(t)
+	notifier := Notifier{Name: "mail", Type: NotifierSMTP, URL: "smtp://" + address, From: "brewery@example.com", To: "a@example.com, b@example.com"}
+	if err := send(t, notifier); err != nil {
+		t.Fatal(err)
+	}
+
+	mail := strings.Join(<-received, "\n")
+	for _, want := range []string{
+		"MAIL FROM:<brewery@example.com>",
+		"RCPT TO:<a@example.com>",
+		"RCPT TO:<b@example.com>",
+		"From: brewery@example.com",
+		"To: a@example.com, b@example.com",
+		"Subject: Hot firing on tilt",
+		"Date: Wed, 01 Jan 2020 12:00:00 +0000",
+		"temperature is 75 (> 72)",
+	} {
+		if !strings.Contains(mail, want) {
+			t.Errorf("mail is missing %q:\n%s", want, mail)
+		}
+	}
+}
+
+func TestNewSenderValidation(t *testing.T) {
+	invalid := []Notifier{
+		{Type: NotifierWebhook, URL: "not a url"},
+		{Type: NotifierWebhook, URL: "http://example.com", Template: "{{"},
+		{Type: NotifierSMTP, URL: "http://example.com", To: "a@example.com", From: "b@example.com"},
+		{Type: NotifierSMTP, URL: "smtp://example.com"},
+		{Type: "pigeon", URL: "http://example.com"},
+	}
+	for _, notifier := range invalid {
+		if _, err := NewSender(notifier); err == nil {
+			t.Errorf("accepted %+v", notifier)
+		}
+	}
+}
+
+func TestDispatcherQueuesHTTPNotifications(t *testing.T) {
+	server, received := newReceiver(t, http.StatusOK)
+	d := newTestDatastore(t)
+	outbox := NewOutbox(d, time.Hour, 3)
+	dispatcher := NewDispatcher(d, NewEventBus(), outbox)
+
+	dispatcher.deliver(Notifier{ID: 1, Name: "phone", Type: NotifierNtfy, URL: server.URL}, testNotification())
+	messages, err := d.GetOutboxMessages(OutboxPending, "notifier:1")
+	if err != nil || len(messages) != 1 {
+		t.Fatalf("queued %+v, %v", messages, err)
+	}
+
+	outbox.Deliver(time.Now())
+	request := <-received
+	if request.body != "temperature is 75 (> 72)" || request.header.Get("Title") != "Hot firing on tilt" || request.header.Get("Priority") != "high" {
+		t.Errorf("delivered %+v", request)
+	}
+}
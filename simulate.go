@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"math/rand"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/currantlabs/ble"
+)
+
+// SimulatedTransport emits fake tilts fermenting from an original to a final
+// gravity, so the daemon can run on machines without Bluetooth
+type SimulatedTransport struct {
+	tilts    []*simulatedTilt
+	started  time.Time
+	duration time.Duration
+}
+
+type simulatedTilt struct {
+	client          *TiltClient
+	originalGravity float64
+	finalGravity    float64
+	temperature     float64
+}
+
+// NewSimulatedTransport parses a comma separated list of tilts to simulate,
+// each given as color[:original gravity[:final gravity]], e.g.
+// "red:1.062:1.012,blue". An empty spec simulates one tilt of each color.
+func NewSimulatedTransport(spec string) (*SimulatedTransport, error) {
+	s := &SimulatedTransport{started: time.Now(), duration: 7 * 24 * time.Hour}
+
+	if spec == "" {
+		for _, code := range Colors {
+			name, _ := colorName(code)
+			spec += name + ","
+		}
+		spec = strings.TrimSuffix(spec, ",")
+	}
+
+	seen := map[string]bool{}
+	for i, entry := range strings.Split(spec, ",") {
+		fields := strings.Split(strings.TrimSpace(entry), ":")
+		code, ok := colorCode(fields[0])
+		if !ok {
+			return nil, fmt.Errorf("Unknown tilt color: %s", fields[0])
+		}
+		if seen[code] {
+			return nil, fmt.Errorf("Duplicate tilt color: %s", fields[0])
+		}
+		seen[code] = true
+
+		tilt := &simulatedTilt{
+			client: &TiltClient{
+				Address: ble.NewAddr(fmt.Sprintf("a4:95:00:00:%s:%s", code[0:2], code[2:4])),
+				Color:   fields[0],
+			},
+			originalGravity: 1.050 + 0.004*float64(i),
+			finalGravity:    1.010,
+			temperature:     66 + float64(i),
+		}
+		if len(fields) > 1 {
+			og, err := strconv.ParseFloat(fields[1], 64)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid original gravity for %s: %s", fields[0], err)
+			}
+			tilt.originalGravity = og
+		}
+		if len(fields) > 2 {
+			fg, err := strconv.ParseFloat(fields[2], 64)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid final gravity for %s: %s", fields[0], err)
+			}
+			tilt.finalGravity = fg
+		}
+		s.tilts = append(s.tilts, tilt)
+	}
+
+	return s, nil
+}
+
+// Scan reports every simulated tilt not yet discovered
+func (s *SimulatedTransport) Scan(ctx context.Context, known func(string) bool, found func(*TiltClient)) error {
+	for _, tilt := range s.tilts {
+		if known(tilt.client.Address.String()) {
+			continue
+		}
+		log.Debugf("[simulated] Found tilt: %s", tilt.client.Address)
+		found(&TiltClient{Address: tilt.client.Address, Color: tilt.client.Color})
+	}
+	return nil
+}
+
+// ReadMetrics returns the simulated metrics for the current point in the
+// fermentation, with a little noise on the temperature and signal
+func (s *SimulatedTransport) ReadMetrics(tilt *TiltClient) (Metric, error) {
+	for _, t := range s.tilts {
+		if t.client.Address.String() != tilt.Address.String() {
+			continue
+		}
+
+		// Gravity decays exponentially, reaching ~98% attenuation after duration
+		progress := float64(time.Since(s.started)) / float64(s.duration)
+		gravity := t.finalGravity + (t.originalGravity-t.finalGravity)*math.Exp(-4*progress)
+
+		return Metric{
+			DeviceID:    tilt.Address.String(),
+			Power:       -60 - rand.Intn(15),
+			Battery:     90,
+			Temperature: math.Round(t.temperature + rand.Float64()*2 - 1),
+			Gravity:     math.Round(gravity*1000) / 1000,
+		}, nil
+	}
+	return Metric{DeviceID: tilt.Address.String()}, fmt.Errorf("No such simulated tilt: %s", tilt.Address)
+}
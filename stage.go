@@ -0,0 +1,167 @@
+package main
+
+import (
+	"math"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	// StageLag is before fermentation has visibly started
+	StageLag = "lag"
+	// StageActive is while gravity is falling quickly
+	StageActive = "active"
+	// StageSlowing is once the fall has slowed, or stalled
+	StageSlowing = "slowing"
+	// StageComplete is once terminal gravity has been reached
+	StageComplete = "complete"
+
+	// LagDrop is how far below the original gravity fermentation must get
+	// before it has started
+	LagDrop = 0.003
+	// ActiveRate is the gravity points lost per day above which fermentation
+	// is active
+	ActiveRate = 3.0
+	// StallMargin is how far above the target gravity a device must stop
+	// for fermentation to have stalled rather than finished
+	StallMargin = 0.004
+	// ExpectedAttenuation estimates the target gravity of batches without one
+	ExpectedAttenuation = 0.75
+)
+
+// Fermentation is the stage a device's fermentation is in, classified from
+// the slope of its recent readings
+type Fermentation struct {
+	Stage string `json:"stage"`
+	// Stalled is set when gravity stopped moving well above the target
+	Stalled bool `json:"stalled"`
+	// TerminalGravity is set once gravity stopped moving at the target
+	TerminalGravity bool `json:"terminal_gravity"`
+	// Rate is the gravity points (0.001) lost per day over recent readings
+	Rate float64 `json:"rate"`
+}
+
+// ClassifyFermentation classifies the recent metrics, in ascending order, of
+// a fermentation from og towards target. Gravity must stay within
+// StableGravityTolerance for the given number of readings before it has
+// stalled or reached terminal gravity. Unknown og and target gravities are
+// zero, and estimated from the readings.
+func ClassifyFermentation(metrics []Metric, og float64, target float64, readings int) Fermentation {
+	f := Fermentation{}
+	if len(metrics) < 2 {
+		return f
+	}
+
+	min, max := metrics[0].Gravity, metrics[0].Gravity
+	for _, m := range metrics {
+		min = math.Min(min, m.Gravity)
+		max = math.Max(max, m.Gravity)
+	}
+	if og == 0 {
+		og = max
+	}
+	if target == 0 {
+		target = og - (og-1)*ExpectedAttenuation
+	}
+
+	gravity := metrics[len(metrics)-1].Gravity
+	stable := len(metrics) >= readings && round(max-min, 4) <= StableGravityTolerance
+	// Adding zero normalises the -0 of a flat slope
+	f.Rate = round(-gravitySlope(metrics)*1000*86400, 1) + 0
+
+	switch {
+	case f.Rate >= ActiveRate:
+		f.Stage = StageActive
+	case og-gravity < LagDrop:
+		f.Stage = StageLag
+	case stable && gravity <= target+StallMargin:
+		f.Stage = StageComplete
+		f.TerminalGravity = true
+	case stable:
+		f.Stage = StageSlowing
+		f.Stalled = true
+	default:
+		f.Stage = StageSlowing
+	}
+	return f
+}
+
+// gravitySlope is the least squares slope of gravity per second
+func gravitySlope(metrics []Metric) float64 {
+	start := metrics[0].Created
+	n := float64(len(metrics))
+	var sumX, sumY, sumXY, sumXX float64
+	for _, m := range metrics {
+		x := m.Created.Sub(start).Seconds()
+		sumX += x
+		sumY += m.Gravity
+		sumXY += x * m.Gravity
+		sumXX += x * x
+	}
+	denominator := n*sumXX - sumX*sumX
+	if denominator == 0 {
+		return 0
+	}
+	return (n*sumXY - sumX*sumY) / denominator
+}
+
+// StageAnalyzer classifies each device's fermentation as metrics arrive,
+// storing the stage on the device and publishing an EventStage when it
+// changes
+type StageAnalyzer struct {
+	datastore Datastore
+	events    *EventBus
+	readings  int
+}
+
+// NewStageAnalyzer returns an analyzer looking at the given number of recent
+// readings, which must be stable for terminal gravity
+func NewStageAnalyzer(datastore Datastore, events *EventBus, readings int) *StageAnalyzer {
+	return &StageAnalyzer{datastore: datastore, events: events, readings: readings}
+}
+
+// Run analyzes devices as their metrics are published, until the events
+// subscription is closed
+func (a *StageAnalyzer) Run() {
+	metrics := a.events.SubscribeReliable(NewEventFilter("", EventMetric))
+	for e := range metrics {
+		if _, err := a.Analyze(e.DeviceID); err != nil {
+			log.Errorf("[stage] Error analyzing %s: %s", e.DeviceID, err)
+		}
+	}
+}
+
+// Analyze classifies the device's fermentation from its recent readings and
+// active batch, recording any change
+func (a *StageAnalyzer) Analyze(id string) (Fermentation, error) {
+	device, err := a.datastore.GetDevice(id)
+	if err != nil {
+		return Fermentation{}, err
+	}
+
+	metrics, err := a.datastore.GetDeviceMetrics(id, MetricQuery{Limit: a.readings})
+	if err != nil {
+		return Fermentation{}, err
+	}
+
+	og, _, _, err := DeviceOriginalGravity(a.datastore, id)
+	if err != nil {
+		return Fermentation{}, err
+	}
+	target := 0.0
+	if batch, err := a.datastore.GetActiveBatch(id); err == nil {
+		target = batch.TargetGravity
+	}
+
+	f := ClassifyFermentation(metrics, og, target, a.readings)
+	if f.Stage == device.Stage && f.Stalled == device.Stalled && f.TerminalGravity == device.TerminalGravity {
+		return f, nil
+	}
+
+	log.Infof("[stage] %s is now %s (stalled: %t, terminal gravity: %t)", id, f.Stage, f.Stalled, f.TerminalGravity)
+	if err := a.datastore.SetDeviceStage(id, f); err != nil {
+		return f, err
+	}
+	a.events.Publish(EventStage, id, f)
+	return f, nil
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// gravitySeries returns hourly metrics starting at gravity, falling by the
+// given points (0.001) per hour
+func gravitySeries(start time.Time, gravity float64, pointsPerHour float64, n int) []Metric {
+	metrics := []Metric{}
+	for i := 0; i < n; i++ {
+		metrics = append(metrics, Metric{
+			DeviceID:    "tilt",
+			Gravity:     round(gravity-float64(i)*pointsPerHour/1000, 4),
+			Temperature: 68,
+			Created:     start.Add(time.Duration(i) * time.Hour),
+		})
+	}
+	return metrics
+}
+
+func TestClassifyFermentation(t *testing.T) {
+	start := time.Now().Add(-48 * time.Hour)
+	noisy := gravitySeries(start, 1.012, 0, 24)
+	for i := range noisy {
+		if i%2 == 1 {
+			noisy[i].Gravity = 1.014
+		}
+	}
+
+	tests := []struct {
+		name     string
+		metrics  []Metric
+		og       float64
+		target   float64
+		stage    string
+		stalled  bool
+		terminal bool
+	}{
+		{"no readings", nil, 1.050, 1.010, "", false, false},
+		{"one reading", gravitySeries(start, 1.050, 0, 1), 1.050, 1.010, "", false, false},
+		{"lag", gravitySeries(start, 1.050, 0, 12), 1.050, 1.010, StageLag, false, false},
+		{"lag while barely falling", gravitySeries(start, 1.050, 0.1, 12), 1.050, 1.010, StageLag, false, false},
+		{"active", gravitySeries(start, 1.050, 0.5, 12), 1.050, 1.010, StageActive, false, false},
+		{"active from an unknown og", gravitySeries(start, 1.050, 0.5, 12), 0, 0, StageActive, false, false},
+		{"slowing", gravitySeries(start, 1.020, 0.04, 12), 1.050, 1.010, StageSlowing, false, false},
+		{"complete", gravitySeries(start, 1.012, 0, 24), 1.050, 1.010, StageComplete, false, true},
+		{"complete within the stall margin", gravitySeries(start, 1.013, 0, 24), 1.050, 1.010, StageComplete, false, true},
+		{"complete with readings within the tolerance", noisy, 1.050, 1.012, StageComplete, false, true},
+		{"complete at the expected attenuation", gravitySeries(start, 1.016, 0, 24), 1.060, 0, StageComplete, false, true},
+		{"stalled above the target", gravitySeries(start, 1.020, 0, 24), 1.050, 1.010, StageSlowing, true, false},
+		{"stalled above the expected attenuation", gravitySeries(start, 1.025, 0, 24), 1.060, 0, StageSlowing, true, false},
+		{"too few stable readings", gravitySeries(start, 1.012, 0, 23), 1.050, 1.010, StageSlowing, false, false},
+	}
+	for _, test := range tests {
+		f := ClassifyFermentation(test.metrics, test.og, test.target, 24)
+		if f.Stage != test.stage || f.Stalled != test.stalled || f.TerminalGravity != test.terminal {
+			t.Errorf("%s: got %+v, want stage %q stalled %t terminal gravity %t",
+				test.name, f, test.stage, test.stalled, test.terminal)
+		}
+	}
+}
+
+func TestFermentationRate(t *testing.T) {
+	start := time.Now()
+	if f := ClassifyFermentation(gravitySeries(start, 1.050, 0.5, 12), 1.050, 1.010, 24); f.Rate != 12 {
+		t.Errorf("rate %.1f points a day, want 12", f.Rate)
+	}
+	if f := ClassifyFermentation(gravitySeries(start, 1.050, 0, 12), 1.050, 1.010, 24); f.Rate != 0 {
+		t.Errorf("rate %.1f points a day, want 0", f.Rate)
+	}
+}
+
+func TestStageAnalyzer(t *testing.T) {
+	d := newTestDatastore(t)
+	events := NewEventBus()
+	stages := events.Subscribe(NewEventFilter("", EventStage))
+	defer events.Unsubscribe(stages)
+	analyzer := NewStageAnalyzer(d, events, 24)
+
+	if err := d.CreateOrUpdateDevice(Device{ID: "tilt", Color: "red"}); err != nil {
+		t.Fatal(err)
+	}
+	analyze := func(metrics []Metric) Fermentation {
+		t.Helper()
+		for _, m := range metrics {
+			if err := d.CreateMetric(m); err != nil {
+				t.Fatal(err)
+			}
+		}
+		f, err := analyzer.Analyze("tilt")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return f
+	}
+	expectStage := func(stage string, terminal bool) {
+		t.Helper()
+		select {
+		case e := <-stages:
+			f := e.Data.(Fermentation)
+			if e.DeviceID != "tilt" || f.Stage != stage || f.TerminalGravity != terminal {
+				t.Errorf("got stage event %+v, want %s", e, stage)
+			}
+		default:
+			t.Errorf("no %s stage event", stage)
+		}
+		device, err := d.GetDevice("tilt")
+		if err != nil || device.Stage != stage || device.TerminalGravity != terminal {
+			t.Errorf("stored stage %q terminal gravity %t, %v, want %s", device.Stage, device.TerminalGravity, err, stage)
+		}
+	}
+	expectNoEvent := func() {
+		t.Helper()
+		select {
+		case e := <-stages:
+			t.Errorf("unexpected stage event %+v", e)
+		default:
+		}
+	}
+
+	start := time.Now().Add(-72 * time.Hour)
+	if f := analyze(gravitySeries(start, 1.050, 0.5, 24)); f.Stage != StageActive {
+		t.Errorf("falling gravity classified as %+v", f)
+	}
+	expectStage(StageActive, false)
+
+	// Nothing is published while the stage stays the same
+	analyze(nil)
+	expectNoEvent()
+
+	// The original gravity detected from the first readings, 1.0495, puts
+	// the expected final gravity around 1.012
+	if f := analyze(gravitySeries(start.Add(24*time.Hour), 1.012, 0, 24)); f.Stage != StageComplete {
+		t.Errorf("steady gravity classified as %+v", f)
+	}
+	expectStage(StageComplete, true)
+	analyze(nil)
+	expectNoEvent()
+}
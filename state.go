@@ -3,6 +3,8 @@ package main
 import (
 	"context"
 	"fmt"
+	"sort"
+	"sync"
 	"time"
 
 	log "github.com/Sirupsen/logrus"
@@ -12,136 +14,217 @@ import (
 
 // State represents the current in-memory state of discovered clients
 type State struct {
-	tilts          map[string]*TiltClient
-	datastore      *Datastore
-	lockChan       chan int
+	registry       *Registry
+	datastore      Datastore
+	transport      Transport
+	events         *EventBus
 	connectTimeout time.Duration
+
+	// adapter is held exclusively while scanning, and shared by connections
+	// to devices, so the two never collide on the BLE adapter
+	adapter sync.RWMutex
+	// connections bounds the devices connected to at once
+	connections chan struct{}
 }
 
-// NewState should only be called once to return an initial device state
-func NewState(datastore *Datastore, connectTimeout time.Duration) *State {
+// NewState should only be called once to return an initial device state,
+// connecting to at most concurrency devices at once. Tilts not seen by a scan
+// for missingAfter are missing, and after lostAfter no longer polled.
+func NewState(datastore Datastore, transport Transport, events *EventBus, connectTimeout time.Duration, concurrency int, missingAfter time.Duration, lostAfter time.Duration) *State {
+	if concurrency < 1 {
+		concurrency = 1
+	}
 	return &State{
-		tilts:          make(map[string]*TiltClient),
+		registry:       NewRegistry(missingAfter, lostAfter),
 		datastore:      datastore,
+		transport:      transport,
+		events:         events,
 		connectTimeout: connectTimeout,
-		lockChan:       make(chan int, 1),
+		connections:    make(chan struct{}, concurrency),
 	}
 }
 
-// Scan ...
-func (s *State) Scan(interval time.Duration) {
-	for {
-		log.Debugf("[scan] Waiting for lock...")
-		s.lockChan <- 1
-
-		log.Infof("[scan] Scanning for new tilts...")
-		deviceQueue := map[string]bool{}
-		ctx := ble.WithSigHandler(context.WithTimeout(context.Background(), s.connectTimeout))
-		if err := ble.Scan(ctx, false, func(a ble.Advertisement) {
-			log.Debugf("[scan] Found tilt: %s", a.Address())
-			tiltClient, err := NewTiltClient(a.Address(), s.connectTimeout)
-			if err != nil {
-				log.Errorf("[scan] Error connecting to tilt %s: %s", a.Address(), err)
-			} else {
-				go s.addTilt(tiltClient)
-			}
-		}, func(a ble.Advertisement) bool {
-			// Exclude devices in the device queue
-			// TODO: if ok for presence
-			for d := range deviceQueue {
-				if d == a.Address().String() {
-					log.Debug("[scan] Ignoring device already in queue")
-					return false
-				}
-			}
-
-			// TODO: if ok for presence
-			for id := range s.tilts {
-				if id == a.Address().String() {
-					log.Debug("[scan] Ignoring device already discovered")
-					return false
-				}
-			}
+// Load adds the tilts stored in the datastore to the state, so they're polled
+// without waiting to be found by a scan. Disabled tilts are left out, and the
+// presence of each follows from when it was last read, or found if never read.
+// Devices are updated by more than reads, so their updated time isn't used.
+func (s *State) Load() error {
+	devices, err := s.datastore.GetDevices()
+	if err != nil {
+		return err
+	}
+	read, err := s.datastore.GetDevicesWithMetrics()
+	if err != nil {
+		return err
+	}
+	latest := map[string]Metric{}
+	for _, device := range read {
+		latest[device.ID] = device.LatestMetric
+	}
 
-			// Only include devices named Tilt
-			if a.LocalName() == "Tilt" {
-				log.Debug("[scan] Queuing scan of tilt...")
-				deviceQueue[a.Address().String()] = true
-				return true
-			}
-			return false
-		}); err != nil {
-			if errors.Cause(err) == context.DeadlineExceeded || err == nil {
-				log.Debug("[scan] Finished")
-			} else if errors.Cause(err) == context.Canceled {
-				// TODO: notify poll to stop?
-				break
-			} else {
-				log.Fatalf("[scan] Could not start: %s", err)
-			}
+	loaded := 0
+	for _, device := range devices {
+		if device.Disabled {
+			continue
 		}
+		seen := device.Created
+		metric, ok := latest[device.ID]
+		if ok {
+			seen = metric.Created
+		}
+		s.registry.Add(&TiltClient{Address: ble.NewAddr(device.ID), Color: device.Color}, seen, device.Error)
+		if ok {
+			s.registry.SetLatest(device.ID, metric)
+		}
+		s.SetPollInterval(device.ID, device.PollInterval)
+		loaded++
+	}
+	log.Infof("[state] Loaded %d of %d stored tilts", loaded, len(devices))
+	s.updatePresence(time.Now())
+	return nil
+}
 
-		log.Debugf("[scan] Releasing lock...")
-		<-s.lockChan
-
+// Scan ...
+func (s *State) Scan(interval time.Duration) {
+	for s.scan() {
 		log.Infof("[scan] Waiting %s before next scan...", interval)
 		time.Sleep(interval)
 	}
 }
 
-// Poll ...
-func (s *State) Poll(interval time.Duration) {
-	for {
-		log.Debugf("[poll] Waiting for lock...")
-		s.lockChan <- 1
+// scan looks for new tilts once, returning false if it was cancelled
+func (s *State) scan() bool {
+	log.Debugf("[scan] Waiting for adapter...")
+	s.adapter.Lock()
 
-		log.Debugf("[poll] Starting poll for %d tilts...", len(s.tilts))
-		for id := range s.tilts {
-			log.Debugf("[poll] Refreshing %s...", id)
-			err := s.RefreshTilt(id)
-			if err != nil {
-				log.Errorf("[poll] Error refreshing metrics for tilt: %s", id)
-				log.Error(err)
-				s.recordError(id, err)
-			}
+	log.Infof("[scan] Scanning for new tilts...")
+	scansTotal.Inc()
+	disabled := s.disabledTilts()
+	known := func(id string) bool { return disabled[id] || s.sight(id) }
+	ctx := ble.WithSigHandler(context.WithTimeout(context.Background(), s.connectTimeout))
+	if err := s.transport.Scan(ctx, known, func(tilt *TiltClient) {
+		devicesFoundTotal.Inc()
+		go s.addTilt(tilt)
+	}); err != nil {
+		if errors.Cause(err) == context.DeadlineExceeded || err == nil {
+			log.Debug("[scan] Finished")
+		} else if errors.Cause(err) == context.Canceled {
+			// TODO: notify poll to stop?
+			s.adapter.Unlock()
+			return false
+		} else {
+			log.Fatalf("[scan] Could not start: %s", err)
 		}
-
-		log.Debugf("[poll] Releasing lock...")
-		<-s.lockChan
-
-		log.Debugf("[poll] Waiting %s before next polling run...", interval)
-		time.Sleep(interval)
 	}
+
+	log.Debugf("[scan] Releasing adapter...")
+	s.adapter.Unlock()
+	s.updatePresence(time.Now())
+	return true
 }
 
 // RefreshTilt ...
 func (s *State) RefreshTilt(tiltID string) error {
 	// Verify the device actually exists in the state
-	if !s.tiltInState(tiltID) {
+	tilt, ok := s.registry.Get(tiltID)
+	if !ok {
 		return fmt.Errorf("No such tilt: %s", tiltID)
 	}
 
-	metric, err := s.tilts[tiltID].RefreshMetrics(s.connectTimeout)
+	metric, err := s.readMetrics(&tilt)
 	if err != nil {
+		s.registry.RecordError(tiltID, err)
 		return err
 	}
 
+	calibration, err := LoadCalibration(s.datastore, tiltID)
+	if err != nil {
+		log.Errorf("[state] Error loading calibration for %s, storing raw metrics: %s", tiltID, err)
+	} else {
+		metric = calibration.Apply(metric)
+	}
+
+	// Keep when transports such as beacons received the reading
+	if metric.Created.IsZero() {
+		metric.Created = time.Now()
+	}
 	log.Debugf("Creating metric: %+v", metric)
 	if err = s.datastore.CreateMetric(metric); err != nil {
 		return fmt.Errorf("Error storing device metric: %s", err)
 	}
+	s.registry.SetLatest(tiltID, metric)
+	if s.registry.RecordSuccess(tiltID, metric.Created) {
+		log.Infof("[state] Tilt %s recovered", tiltID)
+		if err := s.datastore.SetDeviceError(tiltID, ""); err != nil {
+			log.Errorf("[state] Error clearing tilt error: %s", err)
+		}
+	}
+	s.events.Publish(EventMetric, tiltID, metric)
 
 	return nil
 }
 
+// readMetrics connects to the tilt once a connection is free and no scan is
+// running
+func (s *State) readMetrics(tilt *TiltClient) (Metric, error) {
+	s.connections <- struct{}{}
+	defer func() { <-s.connections }()
+	s.adapter.RLock()
+	defer s.adapter.RUnlock()
+
+	return s.transport.ReadMetrics(tilt)
+}
+
+// sight records a tilt advertising during a scan, returning whether it's
+// already in the state. Lost tilts seen again are refreshed straight away.
+func (s *State) sight(tiltID string) bool {
+	previous, ok := s.registry.Sight(tiltID, time.Now())
+	switch {
+	case previous == PresenceLost:
+		log.Infof("[state] Lost tilt %s is back, polling it again", tiltID)
+		go func() {
+			if err := s.RefreshTilt(tiltID); err != nil {
+				log.Errorf("[state] Error refreshing tilt metrics: %s", err)
+			}
+		}()
+	case previous == PresenceMissing:
+		log.Infof("[state] Missing tilt %s is back", tiltID)
+	}
+	return ok
+}
+
+// updatePresence marks the tilts not seen recently as missing or lost
+func (s *State) updatePresence(now time.Time) {
+	for _, tilt := range s.registry.UpdatePresence(now) {
+		switch tilt.Presence {
+		case PresenceMissing:
+			log.Warnf("[state] Tilt %s is missing, not seen since %s", tilt.ID, tilt.LastSeen.Format(time.RFC3339))
+		case PresenceLost:
+			log.Warnf("[state] Tilt %s is lost, no longer polling it", tilt.ID)
+		}
+	}
+}
+
 func (s *State) addTilt(tilt *TiltClient) {
 	log.Debugf("[state] Adding tilt to database: %s", tilt.Address)
-	if err := s.datastore.CreateOrUpdateDevice(Device{ID: tilt.Address.String(), Color: tilt.Color}); err != nil {
+	// Keep the settings of devices already stored, such as their endpoint
+	device, err := s.datastore.GetDevice(tilt.Address.String())
+	if err != nil {
+		device = Device{ID: tilt.Address.String()}
+	}
+	if device.Disabled {
+		log.Debugf("[state] Not adding disabled tilt: %s", tilt.Address)
+		return
+	}
+	device.Color = tilt.Color
+	if err := s.datastore.CreateOrUpdateDevice(device); err != nil {
 		log.Errorf("[state] Error storing tilt information: %s", err)
 	}
+	s.events.Publish(EventDevice, device.ID, device)
 
 	log.Debugf("[state] Adding tilt to state: %s", tilt.Address)
-	s.tilts[tilt.Address.String()] = tilt
+	s.registry.Add(tilt, time.Now(), device.Error)
+	s.SetPollInterval(device.ID, device.PollInterval)
 	if err := s.RefreshTilt(tilt.Address.String()); err != nil {
 		log.Errorf("[state] Error refreshing tilt metrics: %s", err)
 	}
@@ -151,13 +234,128 @@ func (s *State) recordError(tiltID string, e error) {
 	if err := s.datastore.SetDeviceError(tiltID, e.Error()); err != nil {
 		log.Errorf("Error setting tilt error: %s", err)
 	}
+	s.events.Publish(EventError, tiltID, e.Error())
+}
+
+// Forget takes the tilt out of the state, for when it's deleted
+func (s *State) Forget(tiltID string) {
+	s.registry.Remove(tiltID)
+}
+
+// SetPollInterval sets the tilt's poll interval in seconds, zero for the
+// default, for when its device is updated
+func (s *State) SetPollInterval(tiltID string, seconds int) {
+	s.registry.SetPollInterval(tiltID, time.Duration(seconds)*time.Second)
+}
+
+// quarantine disables a tilt that keeps failing, taking it out of the state
+// until it's enabled again
+func (s *State) quarantine(tiltID string, e error) {
+	reason := fmt.Sprintf("Disabled after %d consecutive errors, last: %s", s.registry.Errors(tiltID), e)
+	log.Warnf("[state] %s: %s", tiltID, reason)
+	if err := s.datastore.DisableDevice(tiltID, reason); err != nil {
+		log.Errorf("[state] Error disabling tilt: %s", err)
+		return
+	}
+	s.registry.Remove(tiltID)
+	s.events.Publish(EventError, tiltID, reason)
+	if device, err := s.datastore.GetDevice(tiltID); err == nil {
+		s.events.Publish(EventDevice, tiltID, device)
+	}
 }
 
-func (s *State) tiltInState(tiltID string) bool {
-	for id := range s.tilts {
-		if id == tiltID {
-			return true
+// disabledTilts returns the ids of the tilts disabled in the datastore, which
+// are neither scanned for nor polled
+func (s *State) disabledTilts() map[string]bool {
+	disabled := map[string]bool{}
+	devices, err := s.datastore.GetDevices()
+	if err != nil {
+		log.Errorf("[state] Error loading devices: %s", err)
+		return disabled
+	}
+	for _, device := range devices {
+		if device.Disabled {
+			disabled[device.ID] = true
 		}
 	}
-	return false
+	return disabled
+}
+
+// Tilt returns the status of the tilt, if it's in the state
+func (s *State) Tilt(tiltID string) (TiltStatus, bool) {
+	return s.registry.Status(tiltID)
+}
+
+// LatestMetrics returns the latest metric stored for each tilt in the state
+// that has been read, or was read before it was loaded
+func (s *State) LatestMetrics() map[string]Metric {
+	return s.registry.Latest()
+}
+
+// Tilts returns the status of each tilt in the state
+func (s *State) Tilts() []TiltStatus {
+	return s.registry.Snapshot()
+}
+
+// StateEntry compares what the state believes about a tilt with what's
+// stored for it, either of which may be missing
+type StateEntry struct {
+	ID     string      `json:"id"`
+	State  *TiltStatus `json:"state"`
+	Stored *Device     `json:"stored"`
+	// Mismatches describe where the state and datastore disagree
+	Mismatches []string `json:"mismatches"`
+}
+
+// Compare returns every tilt in the state or the datastore, ordered by id,
+// with any mismatches between the two
+func (s *State) Compare() ([]StateEntry, error) {
+	devices, err := s.datastore.GetDevices()
+	if err != nil {
+		return nil, err
+	}
+
+	entries := map[string]*StateEntry{}
+	for _, tilt := range s.registry.Snapshot() {
+		tilt := tilt
+		entries[tilt.ID] = &StateEntry{ID: tilt.ID, State: &tilt}
+	}
+	for _, device := range devices {
+		device := device
+		if _, ok := entries[device.ID]; !ok {
+			entries[device.ID] = &StateEntry{ID: device.ID}
+		}
+		entries[device.ID].Stored = &device
+	}
+
+	compared := []StateEntry{}
+	for _, entry := range entries {
+		entry.Mismatches = entry.mismatches()
+		compared = append(compared, *entry)
+	}
+	sort.Slice(compared, func(i, j int) bool { return compared[i].ID < compared[j].ID })
+	return compared, nil
+}
+
+func (e StateEntry) mismatches() []string {
+	mismatches := []string{}
+	switch {
+	case e.Stored == nil:
+		return append(mismatches, "not stored")
+	case e.State == nil && !e.Stored.Disabled:
+		return append(mismatches, "not in state")
+	case e.State == nil:
+		return mismatches
+	}
+
+	if e.Stored.Disabled {
+		mismatches = append(mismatches, "disabled but in state")
+	}
+	if e.State.Color != e.Stored.Color {
+		mismatches = append(mismatches, fmt.Sprintf("color %s is stored as %s", e.State.Color, e.Stored.Color))
+	}
+	if e.State.LastError != e.Stored.Error {
+		mismatches = append(mismatches, fmt.Sprintf("error %q is stored as %q", e.State.LastError, e.Stored.Error))
+	}
+	return mismatches
 }
@@ -0,0 +1,396 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestStateLoad(t *testing.T) {
+	d := newTestDatastore(t)
+	now := time.Now()
+	devices := map[string]string{
+		"a4:95:00:00:10:bb": "read recently",
+		"a4:95:00:00:20:bb": "read long ago",
+		"a4:95:00:00:30:bb": "never read",
+		"a4:95:00:00:40:bb": "disabled",
+	}
+	for id := range devices {
+		if err := d.CreateOrUpdateDevice(Device{ID: id, Color: "red", PollInterval: 900}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := d.CreateMetric(Metric{DeviceID: "a4:95:00:00:10:bb", Gravity: 1.050, Created: now.Add(-time.Minute)}); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.CreateMetric(Metric{DeviceID: "a4:95:00:00:20:bb", Gravity: 1.050, Created: now.Add(-3 * time.Hour)}); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.DisableDevice("a4:95:00:00:40:bb", "manually"); err != nil {
+		t.Fatal(err)
+	}
+	// Updating a device long after its last read doesn't make it present
+	if err := d.SetDeviceError("a4:95:00:00:20:bb", "timeout"); err != nil {
+		t.Fatal(err)
+	}
+
+	state := NewState(d, nil, NewEventBus(), time.Second, 1, time.Hour, 2*time.Hour)
+	if err := state.Load(); err != nil {
+		t.Fatal(err)
+	}
+
+	tilts := state.Tilts()
+	if len(tilts) != 3 {
+		t.Fatalf("loaded %+v", tilts)
+	}
+	want := map[string]string{
+		"a4:95:00:00:10:bb": PresencePresent,
+		"a4:95:00:00:20:bb": PresenceLost,
+		"a4:95:00:00:30:bb": PresencePresent,
+	}
+	for _, tilt := range tilts {
+		if tilt.Presence != want[tilt.ID] {
+			t.Errorf("%s (%s) is %s, want %s", tilt.ID, devices[tilt.ID], tilt.Presence, want[tilt.ID])
+		}
+		if state.registry.PollInterval(tilt.ID) != 15*time.Minute {
+			t.Errorf("%s polled every %s", tilt.ID, state.registry.PollInterval(tilt.ID))
+		}
+	}
+	recent, _ := state.Tilt("a4:95:00:00:10:bb")
+	if !recent.LastSeen.Equal(now.Add(-time.Minute)) {
+		t.Errorf("last seen %s, want %s", recent.LastSeen, now.Add(-time.Minute))
+	}
+	if old, _ := state.Tilt("a4:95:00:00:20:bb"); old.LastError != "timeout" {
+		t.Errorf("loaded %+v", old)
+	}
+}
+
+func TestRefreshTiltKeepsReadingTime(t *testing.T) {
+	d := newTestDatastore(t)
+	beacons := NewBeaconTransport(5 * time.Minute)
+	state := NewState(d, beacons, NewEventBus(), time.Second, 1, time.Hour, 2*time.Hour)
+	tilt := testTilt(1)
+	id := tilt.Address.String()
+	if err := d.CreateOrUpdateDevice(Device{ID: id, Color: "red"}); err != nil {
+		t.Fatal(err)
+	}
+	state.registry.Add(tilt, time.Now(), "")
+
+	received := time.Now().Add(-2 * time.Minute)
+	beacons.readings[id] = Metric{DeviceID: id, Gravity: 1.050, Temperature: 68, Created: received}
+	if err := state.RefreshTilt(id); err != nil {
+		t.Fatal(err)
+	}
+	latest, err := d.GetDeviceLatestMetrics(id)
+	if err != nil || !latest.Created.Equal(received) {
+		t.Errorf("stored %+v, %v, want created %s", latest, err, received)
+	}
+
+	// An advertisement from before the tilt went out of range isn't stored again
+	beacons.readings[id] = Metric{DeviceID: id, Gravity: 1.040, Created: time.Now().Add(-time.Hour)}
+	if err := state.RefreshTilt(id); err == nil {
+		t.Error("refreshed from a stale advertisement")
+	}
+	metrics, err := d.GetDeviceMetrics(id, MetricQuery{From: time.Unix(0, 0), Limit: 10})
+	if err != nil || len(metrics) != 1 {
+		t.Errorf("stored %+v, %v", metrics, err)
+	}
+}
+
+// failingTransport wraps the simulated transport, failing to read the tilts
+// set to fail, and counting what it found and read
+type failingTransport struct {
+	*SimulatedTransport
+
+	mu      sync.Mutex
+	failing map[string]bool
+	found   map[string]int
+	reads   map[string]int
+}
+
+func newFailingTransport(t *testing.T, spec string) *failingTransport {
+	simulated, err := NewSimulatedTransport(spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &failingTransport{
+		SimulatedTransport: simulated,
+		failing:            map[string]bool{},
+		found:              map[string]int{},
+		reads:              map[string]int{},
+	}
+}
+
+func (f *failingTransport) Scan(ctx context.Context, known func(string) bool, found func(*TiltClient)) error {
+	return f.SimulatedTransport.Scan(ctx, known, func(tilt *TiltClient) {
+		f.mu.Lock()
+		f.found[tilt.Address.String()]++
+		f.mu.Unlock()
+		found(tilt)
+	})
+}
+
+func (f *failingTransport) ReadMetrics(tilt *TiltClient) (Metric, error) {
+	f.mu.Lock()
+	id := tilt.Address.String()
+	f.reads[id]++
+	failing := f.failing[id]
+	f.mu.Unlock()
+	if failing {
+		return Metric{DeviceID: id}, errors.New("connection timed out")
+	}
+	return f.SimulatedTransport.ReadMetrics(tilt)
+}
+
+func (f *failingTransport) setFailing(id string, failing bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.failing[id] = failing
+}
+
+func (f *failingTransport) counts(id string) (found int, reads int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.found[id], f.reads[id]
+}
+
+func (f *failingTransport) ids() []string {
+	ids := []string{}
+	for _, tilt := range f.tilts {
+		ids = append(ids, tilt.client.Address.String())
+	}
+	return ids
+}
+
+// awaitMetrics waits for the device to have stored the number of metrics
+func awaitMetrics(t *testing.T, d Datastore, id string, count int) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		metrics, err := d.GetDeviceMetrics(id, MetricQuery{From: time.Unix(0, 0), Limit: 1000})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(metrics) >= count {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%s stored %d metrics, want %d", id, len(metrics), count)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestQuarantine(t *testing.T) {
+	d := newTestDatastore(t)
+	transport := newFailingTransport(t, "red,blue")
+	events := NewEventBus()
+	errs := events.Subscribe(NewEventFilter("", EventError))
+	defer events.Unsubscribe(errs)
+	state := NewState(d, transport, events, time.Second, 2, time.Hour, 2*time.Hour)
+	scheduler := NewScheduler(state, time.Hour, 0, 4, 3)
+	ids := transport.ids()
+	red, blue := ids[0], ids[1]
+
+	// Scans find and read every tilt
+	if !state.scan() {
+		t.Fatal("scan was cancelled")
+	}
+	awaitMetrics(t, d, red, 1)
+	awaitMetrics(t, d, blue, 1)
+
+	// Errors are stored as they happen, and cleared by the next success
+	transport.setFailing(red, true)
+	scheduler.poll(red)
+	if device, err := d.GetDevice(red); err != nil || !strings.Contains(device.Error, "connection timed out") || device.Disabled {
+		t.Errorf("after one error %+v, %v", device, err)
+	}
+	transport.setFailing(red, false)
+	scheduler.poll(red)
+	if device, err := d.GetDevice(red); err != nil || device.Error != "" || state.registry.Errors(red) != 0 {
+		t.Errorf("after recovering %+v, %v", device, err)
+	}
+
+	// Failing up to the threshold disables the tilt, with the reason
+	transport.setFailing(blue, true)
+	for i := 1; i <= 3; i++ {
+		if !state.registry.Has(blue) {
+			t.Fatalf("quarantined after %d errors", i-1)
+		}
+		scheduler.poll(blue)
+	}
+	device, err := d.GetDevice(blue)
+	if err != nil || !device.Disabled || !strings.HasPrefix(device.Error, "Disabled after 3 consecutive errors") ||
+		!strings.Contains(device.Error, "connection timed out") {
+		t.Errorf("after quarantine %+v, %v", device, err)
+	}
+	if state.registry.Has(blue) {
+		t.Error("quarantined tilt still in the state")
+	}
+	reasons := []string{}
+	for len(errs) > 0 {
+		e := <-errs
+		if e.DeviceID == blue {
+			reasons = append(reasons, e.Data.(string))
+		}
+	}
+	if len(reasons) != 4 || reasons[3] != device.Error {
+		t.Errorf("error events %q, want 3 errors then %q", reasons, device.Error)
+	}
+
+	// Disabled tilts are neither found by scans nor polled
+	found, reads := transport.counts(blue)
+	if !state.scan() {
+		t.Fatal("scan was cancelled")
+	}
+	state.registry.Add(&TiltClient{Address: transport.tilts[1].client.Address, Color: "blue"}, time.Now(), "")
+	scheduler.poll(blue)
+	if f, r := transport.counts(blue); f != found || r != reads {
+		t.Errorf("disabled tilt found %d and read %d more times", f-found, r-reads)
+	}
+	if state.registry.Has(blue) {
+		t.Error("polling a disabled tilt left it in the state")
+	}
+
+	// Enabling the tilt lets the next scan find it, and its error is
+	// cleared once it's read
+	transport.setFailing(blue, false)
+	device.Disabled = false
+	if err := d.UpdateDevice(device); err != nil {
+		t.Fatal(err)
+	}
+	if !state.scan() {
+		t.Fatal("scan was cancelled")
+	}
+	awaitMetrics(t, d, blue, 2)
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		device, err = d.GetDevice(blue)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if device.Error == "" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("error not cleared after enabling %+v", device)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !state.registry.Has(blue) || state.registry.Errors(blue) != 0 {
+		t.Errorf("enabled tilt in state %t with %d errors", state.registry.Has(blue), state.registry.Errors(blue))
+	}
+}
+
+// TestConcurrentScanPollAndRefresh runs scans, scheduled polls and refreshes
+// through the API over the same tilts at once, for the race detector
+func TestConcurrentScanPollAndRefresh(t *testing.T) {
+	d := newTestDatastore(t)
+	transport := newFailingTransport(t, "")
+	events := NewEventBus()
+	state := NewState(d, transport, events, 10*time.Millisecond, 2, time.Hour, 2*time.Hour)
+	scheduler := NewScheduler(state, 20*time.Millisecond, 0.5, 4, 0)
+	api := NewAPI(d, state, events, Units{}, NewOutbox(d, time.Hour, 3))
+	ids := transport.ids()
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	run := func(f func()) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+					f()
+				}
+			}
+		}()
+	}
+
+	run(func() {
+		state.scan()
+		time.Sleep(5 * time.Millisecond)
+	})
+	run(func() {
+		scheduler.schedule(time.Now())
+		time.Sleep(5 * time.Millisecond)
+	})
+	refreshed := make([]int, 4)
+	for worker := range refreshed {
+		worker := worker
+		run(func() {
+			for i, id := range ids {
+				response := serve(api, "POST", "/api/v1/devices/"+id+"/refresh", "")
+				switch {
+				case response.Code == http.StatusOK:
+					refreshed[worker]++
+				case response.Code == http.StatusNotFound && strings.Contains(response.Body.String(), "No such tilt"):
+					// Not found by a scan yet
+				default:
+					t.Errorf("refreshing %s: %d %s", id, response.Code, response.Body)
+				}
+				if i%4 == worker {
+					// Switching between the default interval and a second
+					body := fmt.Sprintf(`{"poll_interval": %d}`, i%2)
+					if response := serve(api, "POST", "/api/v1/devices/"+id, body); response.Code != http.StatusOK && response.Code != http.StatusNotFound {
+						t.Errorf("updating %s: %d %s", id, response.Code, response.Body)
+					}
+				}
+			}
+		})
+	}
+
+	time.Sleep(time.Second)
+	close(stop)
+	wg.Wait()
+
+	// Let the polls and additions already started finish before checking
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		scheduler.mu.Lock()
+		polling := 0
+		for _, p := range scheduler.polling {
+			if p {
+				polling++
+			}
+		}
+		scheduler.mu.Unlock()
+		if polling == 0 && len(state.Tilts()) == len(ids) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d polls still running, %d of %d tilts in the state", polling, len(state.Tilts()), len(ids))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	refreshes := 0
+	for _, n := range refreshed {
+		refreshes += n
+	}
+	if refreshes == 0 {
+		t.Error("no refreshes succeeded")
+	}
+	// Every tilt is read once when it's found, and the rest of the reads
+	// not made through the API are scheduled polls
+	reads := 0
+	for _, tilt := range state.Tilts() {
+		if tilt.Errors != 0 || tilt.LastError != "" || tilt.LastSuccess == nil {
+			t.Errorf("tilt %+v", tilt)
+		}
+		_, n := transport.counts(tilt.ID)
+		reads += n
+		awaitMetrics(t, d, tilt.ID, 2)
+	}
+	if reads <= refreshes+len(ids) {
+		t.Errorf("%d reads, %d of them refreshes, so no tilts were polled", reads, refreshes)
+	}
+}
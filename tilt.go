@@ -29,6 +29,18 @@ const (
 )
 
 var (
+	// Colors lists the color codes of every tilt
+	Colors = []string{
+		ColorRed,
+		ColorGreen,
+		ColorBlack,
+		ColorPurple,
+		ColorOrange,
+		ColorBlue,
+		ColorYellow,
+		ColorPink,
+	}
+
 	batteryChar     *ble.Characteristic
 	temperatureChar *ble.Characteristic
 	gravityChar     *ble.Characteristic
@@ -104,7 +116,9 @@ func (t *TiltClient) RefreshMetrics(timeout time.Duration) (Metric, error) {
 	metric := &Metric{DeviceID: t.Address.String()}
 
 	log.Debug("[tilt] Establishing connection...")
+	start := time.Now()
 	client, err := ble.Dial(ble.WithSigHandler(context.WithTimeout(context.Background(), timeout)), t.Address)
+	dialDuration.WithLabelValues(outcome(err)).Observe(time.Since(start).Seconds())
 	if err != nil {
 		return *metric, err
 	}
@@ -145,7 +159,7 @@ func (t *TiltClient) RefreshMetrics(timeout time.Duration) (Metric, error) {
 	if err != nil {
 		return *metric, fmt.Errorf("Error reading temperature: %s", err)
 	}
-	metric.Temperature = result.(int)
+	metric.Temperature = float64(result.(int))
 
 	log.Debug("[tilt] Reading tilt gravity...")
 	result, err = t.wrapTimeout(timeout, func() (interface{}, error) {
@@ -201,46 +215,65 @@ func (t *TiltClient) GetColor(client ble.Client, profile *ble.Profile) (string,
 		if err != nil {
 			return "", err
 		}
-		switch hex.EncodeToString(data) {
-		case ColorRed:
-			return "red", nil
-		case ColorGreen:
-			return "green", nil
-		case ColorBlack:
-			return "black", nil
-		case ColorPurple:
-			return "purple", nil
-		case ColorOrange:
-			return "orange", nil
-		case ColorBlue:
-			return "blue", nil
-		case ColorYellow:
-			return "yellow", nil
-		case ColorPink:
-			return "pink", nil
+		if color, ok := colorName(hex.EncodeToString(data)); ok {
+			return color, nil
 		}
 	}
 	return "", fmt.Errorf("Could not determine color")
 }
 
+// colorName maps a tilt color code to its name
+func colorName(code string) (string, bool) {
+	switch code {
+	case ColorRed:
+		return "red", true
+	case ColorGreen:
+		return "green", true
+	case ColorBlack:
+		return "black", true
+	case ColorPurple:
+		return "purple", true
+	case ColorOrange:
+		return "orange", true
+	case ColorBlue:
+		return "blue", true
+	case ColorYellow:
+		return "yellow", true
+	case ColorPink:
+		return "pink", true
+	}
+	return "", false
+}
+
+// colorCode maps a tilt color name to its code
+func colorCode(name string) (string, bool) {
+	for _, code := range Colors {
+		if n, _ := colorName(code); n == name {
+			return code, true
+		}
+	}
+	return "", false
+}
+
 func (t *TiltClient) wrapTimeout(timeout time.Duration, f func() (interface{}, error)) (interface{}, error) {
-	var result interface{}
-	var err error
-	resultChan := make(chan bool, 1)
-	defer close(resultChan)
+	type response struct {
+		result interface{}
+		err    error
+	}
+	// Buffered so the call can finish after we've given up on it
+	resultChan := make(chan response, 1)
 
 	timer := time.NewTimer(timeout)
 	defer timer.Stop()
 
 	go func() {
-		result, err = f()
-		resultChan<-true
+		result, err := f()
+		resultChan <- response{result, err}
 	}()
 	select {
-	case <-resultChan:
-		return result, err
+	case res := <-resultChan:
+		return res.result, res.err
 	case <-timer.C:
-		fmt.Errorf("timeout")
+		return nil, fmt.Errorf("timeout")
 	}
-	return result, nil
 }
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"runtime"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/currantlabs/ble"
+	"github.com/currantlabs/ble/darwin"
+	"github.com/currantlabs/ble/linux"
+)
+
+// Transport discovers tilts and reads their metrics
+type Transport interface {
+	// Scan searches for tilts until the context is done, calling known with
+	// every tilt advertisement seen, so sightings track presence, and found
+	// for every tilt it does not report as already discovered
+	Scan(ctx context.Context, known func(string) bool, found func(*TiltClient)) error
+	// ReadMetrics returns the current metrics of a discovered tilt, created
+	// when they were read if the transport knows, and otherwise left unset
+	ReadMetrics(tilt *TiltClient) (Metric, error)
+}
+
+// NewTransport returns the named transport, initialising the BLE device for
+// the transports that need one. Advertisements are read until a whole scan
+// interval and scan have passed without them.
+func NewTransport(name string, connectTimeout time.Duration, scanInterval time.Duration, simulate string) (Transport, error) {
+	switch name {
+	case "gatt":
+		if err := setDefaultDevice(); err != nil {
+			return nil, err
+		}
+		return NewGATTTransport(connectTimeout), nil
+	case "beacon":
+		if err := setDefaultDevice(); err != nil {
+			return nil, err
+		}
+		return NewBeaconTransport(scanInterval + connectTimeout), nil
+	case "simulated":
+		return NewSimulatedTransport(simulate)
+	}
+	return nil, fmt.Errorf("Unsupported transport: %s", name)
+}
+
+func setDefaultDevice() error {
+	var device ble.Device
+	var err error
+	switch runtime.GOOS {
+	case "darwin":
+		device, err = darwin.NewDevice()
+	case "linux":
+		device, err = linux.NewDevice()
+	default:
+		return fmt.Errorf("Unsupported OS: %s", runtime.GOOS)
+	}
+	if err != nil {
+		return fmt.Errorf("Error creating device : %s", err)
+	}
+	ble.SetDefaultDevice(device)
+	return nil
+}
+
+// GATTTransport connects to each tilt and reads its characteristics
+type GATTTransport struct {
+	connectTimeout time.Duration
+}
+
+// NewGATTTransport returns a transport using the default BLE device
+func NewGATTTransport(connectTimeout time.Duration) *GATTTransport {
+	return &GATTTransport{connectTimeout: connectTimeout}
+}
+
+// Scan connects to every newly advertised tilt to read its color
+func (g *GATTTransport) Scan(ctx context.Context, known func(string) bool, found func(*TiltClient)) error {
+	deviceQueue := map[string]bool{}
+	return ble.Scan(ctx, false, func(a ble.Advertisement) {
+		log.Debugf("[gatt] Found tilt: %s", a.Address())
+		tiltClient, err := NewTiltClient(a.Address(), g.connectTimeout)
+		if err != nil {
+			log.Errorf("[gatt] Error connecting to tilt %s: %s", a.Address(), err)
+		} else {
+			found(tiltClient)
+		}
+	}, func(a ble.Advertisement) bool {
+		// Only include devices named Tilt
+		if a.LocalName() != "Tilt" {
+			return false
+		}
+
+		// Report every sighting, even of tilts already discovered
+		if known(a.Address().String()) {
+			log.Debug("[gatt] Ignoring device already discovered")
+			return false
+		}
+
+		// Exclude devices in the device queue
+		if deviceQueue[a.Address().String()] {
+			log.Debug("[gatt] Ignoring device already in queue")
+			return false
+		}
+
+		log.Debug("[gatt] Queuing scan of tilt...")
+		deviceQueue[a.Address().String()] = true
+		return true
+	})
+}
+
+// ReadMetrics connects to the tilt and reads its characteristics
+func (g *GATTTransport) ReadMetrics(tilt *TiltClient) (Metric, error) {
+	return tilt.RefreshMetrics(g.connectTimeout)
+}
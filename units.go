@@ -0,0 +1,228 @@
+package main
+
+import (
+	"fmt"
+	"math"
+)
+
+const (
+	// GravitySG is specific gravity, as read from the tilt
+	GravitySG = "sg"
+	// GravityPlato is degrees Plato
+	GravityPlato = "plato"
+	// GravityBrix is degrees Brix
+	GravityBrix = "brix"
+	// TemperatureF is degrees Fahrenheit, as read from the tilt
+	TemperatureF = "f"
+	// TemperatureC is degrees Celsius
+	TemperatureC = "c"
+)
+
+// Units selects how gravity and temperature are presented. Metrics are always
+// stored in specific gravity and °F and only converted for display.
+type Units struct {
+	Gravity     string `json:"gravity"`
+	Temperature string `json:"temperature"`
+}
+
+// NewUnits validates the gravity and temperature units
+func NewUnits(gravity string, temperature string) (Units, error) {
+	u := Units{Gravity: gravity, Temperature: temperature}
+	return u, u.Validate()
+}
+
+// Validate checks both units are known, allowing them to be unset
+func (u Units) Validate() error {
+	switch u.Gravity {
+	case "", GravitySG, GravityPlato, GravityBrix:
+	default:
+		return fmt.Errorf("Unknown gravity units: %s", u.Gravity)
+	}
+	switch u.Temperature {
+	case "", TemperatureF, TemperatureC:
+	default:
+		return fmt.Errorf("Unknown temperature units: %s", u.Temperature)
+	}
+	return nil
+}
+
+// Override returns the units with any set in o taking precedence
+func (u Units) Override(o Units) Units {
+	if o.Gravity != "" {
+		u.Gravity = o.Gravity
+	}
+	if o.Temperature != "" {
+		u.Temperature = o.Temperature
+	}
+	return u
+}
+
+// ConvertGravity converts a specific gravity into the gravity units
+func (u Units) ConvertGravity(sg float64) float64 {
+	switch u.Gravity {
+	case GravityPlato:
+		return round(SGToPlato(sg), 2)
+	case GravityBrix:
+		return round(SGToBrix(sg), 2)
+	}
+	return round(sg, 4)
+}
+
+// GravityToSG converts a gravity in the gravity units back to specific gravity
+func (u Units) GravityToSG(gravity float64) float64 {
+	switch u.Gravity {
+	case GravityPlato:
+		return round(PlatoToSG(gravity), 4)
+	case GravityBrix:
+		return round(BrixToSG(gravity), 4)
+	}
+	return gravity
+}
+
+// ConvertTemperature converts a °F temperature into the temperature units
+func (u Units) ConvertTemperature(f float64) float64 {
+	if u.Temperature == TemperatureC {
+		return round(FahrenheitToCelsius(f), 1)
+	}
+	return f
+}
+
+// Metric converts the readings of a metric
+func (u Units) Metric(m Metric) Metric {
+	m.Gravity = u.ConvertGravity(m.Gravity)
+	m.RawGravity = u.ConvertGravity(m.RawGravity)
+	m.Temperature = u.ConvertTemperature(m.Temperature)
+	m.RawTemperature = u.ConvertTemperature(m.RawTemperature)
+	return m
+}
+
+// Metrics converts the readings of every metric
+func (u Units) Metrics(metrics []Metric) []Metric {
+	for i := range metrics {
+		metrics[i] = u.Metric(metrics[i])
+	}
+	return metrics
+}
+
+// Buckets converts the summaries of every bucket. All conversions preserve
+// order, so minimums and maximums stay correct.
+func (u Units) Buckets(buckets []MetricBucket) []MetricBucket {
+	for i, b := range buckets {
+		buckets[i].MinGravity = u.ConvertGravity(b.MinGravity)
+		buckets[i].MaxGravity = u.ConvertGravity(b.MaxGravity)
+		buckets[i].AvgGravity = u.ConvertGravity(b.AvgGravity)
+		buckets[i].MinTemperature = u.ConvertTemperature(b.MinTemperature)
+		buckets[i].MaxTemperature = u.ConvertTemperature(b.MaxTemperature)
+		buckets[i].AvgTemperature = u.ConvertTemperature(b.AvgTemperature)
+	}
+	return buckets
+}
+
+// Batch converts the gravities of a batch, leaving unset (zero) ones alone
+func (u Units) Batch(b Batch) Batch {
+	if b.OriginalGravity != 0 {
+		b.OriginalGravity = u.ConvertGravity(b.OriginalGravity)
+	}
+	if b.TargetGravity != 0 {
+		b.TargetGravity = u.ConvertGravity(b.TargetGravity)
+	}
+	b.Attenuation = u.Attenuation(b.Attenuation)
+	return b
+}
+
+// Attenuation converts the gravities of an attenuation
+func (u Units) Attenuation(a *Attenuation) *Attenuation {
+	if a == nil {
+		return nil
+	}
+	converted := *a
+	converted.OriginalGravity = u.ConvertGravity(a.OriginalGravity)
+	converted.Gravity = u.ConvertGravity(a.Gravity)
+	return &converted
+}
+
+// Attenuations converts the gravities of every attenuation
+func (u Units) Attenuations(series []*Attenuation) []*Attenuation {
+	for i := range series {
+		series[i] = u.Attenuation(series[i])
+	}
+	return series
+}
+
+// Forecast converts the gravities of a forecast
+func (u Units) Forecast(f Forecast) Forecast {
+	f.OriginalGravity = u.ConvertGravity(f.OriginalGravity)
+	f.FinalGravity = u.ConvertGravity(f.FinalGravity)
+	f.FinalGravityLow = u.ConvertGravity(f.FinalGravityLow)
+	f.FinalGravityHigh = u.ConvertGravity(f.FinalGravityHigh)
+	return f
+}
+
+// BatchToSG converts the gravities of a batch given in the gravity units back
+// to specific gravity for storage
+func (u Units) BatchToSG(b Batch) Batch {
+	if b.OriginalGravity != 0 {
+		b.OriginalGravity = u.GravityToSG(b.OriginalGravity)
+	}
+	if b.TargetGravity != 0 {
+		b.TargetGravity = u.GravityToSG(b.TargetGravity)
+	}
+	return b
+}
+
+// SGToPlato uses the ASBC polynomial
+func SGToPlato(sg float64) float64 {
+	return -616.868 + 1111.14*sg - 630.272*sg*sg + 135.997*sg*sg*sg
+}
+
+// PlatoToSG inverts SGToPlato, refining the usual approximation
+func PlatoToSG(plato float64) float64 {
+	derivative := func(sg float64) float64 {
+		return 1111.14 - 2*630.272*sg + 3*135.997*sg*sg
+	}
+	return invertGravity(SGToPlato, derivative, plato, 1+plato/(258.6-(plato/258.2)*227.1))
+}
+
+// SGToBrix uses the polynomial fitted to the sucrose tables
+func SGToBrix(sg float64) float64 {
+	return ((182.4601*sg-775.6821)*sg+1262.7794)*sg - 669.5622
+}
+
+// BrixToSG inverts SGToBrix, starting from the Plato approximation which
+// Brix closely tracks
+func BrixToSG(brix float64) float64 {
+	derivative := func(sg float64) float64 {
+		return (3*182.4601*sg-2*775.6821)*sg + 1262.7794
+	}
+	return invertGravity(SGToBrix, derivative, brix, 1+brix/(258.6-(brix/258.2)*227.1))
+}
+
+// invertGravity finds the specific gravity at which convert gives value by
+// Newton's method from the guess. Both polynomials rise steadily over any
+// gravity a wort could have, so a few steps are plenty.
+func invertGravity(convert func(float64) float64, derivative func(float64) float64, value float64, guess float64) float64 {
+	sg := guess
+	for i := 0; i < 8; i++ {
+		step := (convert(sg) - value) / derivative(sg)
+		sg -= step
+		if math.Abs(step) < 1e-12 {
+			break
+		}
+	}
+	return sg
+}
+
+// FahrenheitToCelsius converts °F to °C
+func FahrenheitToCelsius(f float64) float64 {
+	return (f - 32) * 5 / 9
+}
+
+// CelsiusToFahrenheit converts °C to °F
+func CelsiusToFahrenheit(c float64) float64 {
+	return c*9/5 + 32
+}
+
+func round(value float64, places int) float64 {
+	scale := math.Pow(10, float64(places))
+	return math.Round(value*scale) / scale
+}
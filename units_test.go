@@ -0,0 +1,67 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestGravityRoundTrips(t *testing.T) {
+	for sg := 0.990; sg <= 1.130; sg += 0.001 {
+		if got := PlatoToSG(SGToPlato(sg)); math.Abs(got-sg) > 1e-9 {
+			t.Errorf("SG %.3f to Plato and back gave %.9f", sg, got)
+		}
+		if got := BrixToSG(SGToBrix(sg)); math.Abs(got-sg) > 1e-9 {
+			t.Errorf("SG %.3f to Brix and back gave %.9f", sg, got)
+		}
+	}
+	for degrees := 0.0; degrees <= 30; degrees += 0.5 {
+		if got := SGToPlato(PlatoToSG(degrees)); math.Abs(got-degrees) > 1e-6 {
+			t.Errorf("%.1f°P to SG and back gave %.6f", degrees, got)
+		}
+		if got := SGToBrix(BrixToSG(degrees)); math.Abs(got-degrees) > 1e-6 {
+			t.Errorf("%.1f°Bx to SG and back gave %.6f", degrees, got)
+		}
+	}
+}
+
+func TestGravityConversions(t *testing.T) {
+	tests := []struct {
+		units   string
+		sg      float64
+		gravity float64
+	}{
+		{GravitySG, 1.050, 1.050},
+		{GravityPlato, 1.000, 0},
+		{GravityPlato, 1.050, 12.39},
+		{GravityBrix, 1.000, 0},
+		{GravityBrix, 1.050, 12.39},
+		{GravityBrix, 1.080, 19.33},
+	}
+	for _, test := range tests {
+		u := Units{Gravity: test.units}
+		if got := u.ConvertGravity(test.sg); math.Abs(got-test.gravity) > 0.01 {
+			t.Errorf("%.3f in %s gave %.2f, want %.2f", test.sg, test.units, got, test.gravity)
+		}
+		if got := u.GravityToSG(u.ConvertGravity(test.sg)); math.Abs(got-test.sg) > 0.0001 {
+			t.Errorf("%.3f through %s gave %.4f", test.sg, test.units, got)
+		}
+	}
+}
+
+func TestTemperatureRoundTrips(t *testing.T) {
+	if got := FahrenheitToCelsius(212); got != 100 {
+		t.Errorf("212°F gave %v°C", got)
+	}
+	if got := CelsiusToFahrenheit(-40); got != -40 {
+		t.Errorf("-40°C gave %v°F", got)
+	}
+	for f := 32.0; f <= 212; f += 0.5 {
+		if got := CelsiusToFahrenheit(FahrenheitToCelsius(f)); math.Abs(got-f) > 1e-9 {
+			t.Errorf("%.1f°F to °C and back gave %v", f, got)
+		}
+	}
+	u := Units{Temperature: TemperatureC}
+	if got := u.ConvertTemperature(68); got != 20 {
+		t.Errorf("68°F in °C gave %v", got)
+	}
+}